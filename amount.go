@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Currency signs skipped in typed amounts
+const currencySigns = "€$£₽¥₴₸₺₹₩₪"
+
+// Currency codes and local abbreviations skipped in typed amounts
+var currencyCodes = map[string]bool{
+	"eur": true, "usd": true, "gbp": true, "rub": true, "uah": true, "byn": true, "kzt": true,
+	"chf": true, "pln": true, "czk": true, "sek": true, "nok": true, "dkk": true, "try": true,
+	"gel": true, "amd": true, "jpy": true, "cny": true, "ils": true, "cad": true, "aud": true,
+	"руб": true, "р": true, "грн": true, "тг": true, "eu": true, "euro": true, "euros": true,
+	"dollar": true, "dollars": true, "евро": true,
+}
+
+// Parses amount typed by a user: decimal commas, thousands separators,
+// currency signs and codes are allowed as well as + - * / expressions like
+// "30+12.5" for two receipts. Result is rounded to cents.
+func parseAmount(text string, settings *groupSettings) (float64, error) {
+	p := amountParser{decimal: settings.decimalSeparator()}
+	if err := p.tokenize(text); err != nil {
+		return 0, err
+	}
+	if len(p.tokens) == 0 {
+		return 0, fmt.Errorf("no number")
+	}
+	value, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	if p.pos != len(p.tokens) {
+		return 0, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("division by zero")
+	}
+	return math.Round(value*100) / 100, nil
+}
+
+func parsePositiveAmount(text string, settings *groupSettings) (float64, error) {
+	amount, err := parseAmount(text, settings)
+	if err == nil && amount <= 0 {
+		err = fmt.Errorf("amount must be positive")
+	}
+	return amount, err
+}
+
+// Explains why typed amount was rejected and how to type it
+func wrongAmountMsg(chatId int64, err error, settings *groupSettings) tgbotapi2.MessageConfig {
+	return tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Cannot read the amount: %v. Type a number like 12,50 or a sum like 30+12.5."), err))
+}
+
+type amountToken struct {
+	text  string
+	op    rune // 0 for numbers
+	value float64
+}
+
+// Recursive descent over + - * / and parentheses
+type amountParser struct {
+	decimal string // decimal separator of the group language
+	tokens  []amountToken
+	pos     int
+}
+
+func (p *amountParser) tokenize(text string) error {
+	runes := []rune(strings.TrimSpace(text))
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r) || strings.ContainsRune(currencySigns, r) || r == '=':
+			i++
+		case strings.ContainsRune("+-*/×()", r):
+			op := r
+			if op == '×' {
+				op = '*'
+			}
+			p.tokens = append(p.tokens, amountToken{text: string(r), op: op})
+			i++
+		case unicode.IsDigit(r) || r == '.' || r == ',':
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == ',' || isGroupSpace(runes, j)) {
+				j++
+			}
+			number := string(runes[i:j])
+			value, err := parseNumber(number, p.decimal)
+			if err != nil {
+				return err
+			}
+			p.tokens = append(p.tokens, amountToken{text: number, value: value})
+			i = j
+		case unicode.IsLetter(r):
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			word := string(runes[i:j])
+			if !currencyCodes[strings.TrimSuffix(strings.ToLower(word), ".")] {
+				return fmt.Errorf("unexpected %q", word)
+			}
+			i = j
+		default:
+			return fmt.Errorf("unexpected %q", string(r))
+		}
+	}
+	return nil
+}
+
+// Spaces and apostrophes separate thousands when followed by exactly three
+// digits, e.g. "1 500" or "1'500"
+func isGroupSpace(runes []rune, i int) bool {
+	if !strings.ContainsRune("   '’", runes[i]) || i == 0 || !unicode.IsDigit(runes[i-1]) {
+		return false
+	}
+	digits := 0
+	for j := i + 1; j < len(runes) && unicode.IsDigit(runes[j]); j++ {
+		digits++
+	}
+	end := i + 1 + digits
+	return digits == 3 && (end == len(runes) || !unicode.IsDigit(runes[end]))
+}
+
+// Tells decimal separator from thousands separators: the last of "." and ","
+// is decimal when both are used. A single separator is decimal unless it is
+// not the decimal separator of the group and is followed by exactly three
+// digits, so "1.500" is 1.5 in English and 1500 in Russian groups.
+func parseNumber(number, decimalSep string) (float64, error) {
+	clean := strings.Map(func(r rune) rune {
+		if strings.ContainsRune("   '’", r) {
+			return -1
+		}
+		return r
+	}, number)
+
+	decimal := ""
+	dots, commas := strings.Count(clean, "."), strings.Count(clean, ",")
+	switch {
+	case dots > 0 && commas > 0:
+		if strings.LastIndex(clean, ".") > strings.LastIndex(clean, ",") {
+			decimal = "."
+		} else {
+			decimal = ","
+		}
+	case dots+commas == 1:
+		sep := "."
+		if commas == 1 {
+			sep = ","
+		}
+		idx := strings.Index(clean, sep)
+		if sep == decimalSep || len(clean)-idx-1 != 3 || idx == 0 || strings.TrimLeft(clean[:idx], "0") == "" {
+			decimal = sep
+		}
+	}
+
+	var intPart, fracPart string
+	if len(decimal) != 0 {
+		idx := strings.LastIndex(clean, decimal)
+		intPart, fracPart = clean[:idx], clean[idx+1:]
+		if strings.ContainsAny(fracPart, ".,") {
+			return 0, fmt.Errorf("wrong number %q", number)
+		}
+	} else {
+		intPart = clean
+	}
+	// Thousands groups must have three digits each
+	groups := strings.FieldsFunc(intPart, func(r rune) bool { return r == '.' || r == ',' })
+	for i, g := range groups {
+		if i > 0 && len(g) != 3 {
+			return 0, fmt.Errorf("wrong number %q", number)
+		}
+	}
+	digits := strings.Join(groups, "")
+	if len(digits) == 0 {
+		digits = "0"
+	}
+	if len(fracPart) != 0 {
+		digits += "." + fracPart
+	}
+	value, err := strconv.ParseFloat(digits, 64)
+	if err != nil {
+		return 0, fmt.Errorf("wrong number %q", number)
+	}
+	return value, nil
+}
+
+func (p *amountParser) peek() rune {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].op
+	}
+	return -1
+}
+
+func (p *amountParser) expr() (float64, error) {
+	value, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		rhs, err := p.term()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			value += rhs
+		} else {
+			value -= rhs
+		}
+	}
+	return value, nil
+}
+
+func (p *amountParser) term() (float64, error) {
+	value, err := p.factor()
+	if err != nil {
+		return 0, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		rhs, err := p.factor()
+		if err != nil {
+			return 0, err
+		}
+		if op == '*' {
+			value *= rhs
+		} else {
+			value /= rhs
+		}
+	}
+	return value, nil
+}
+
+func (p *amountParser) factor() (float64, error) {
+	if p.pos == len(p.tokens) {
+		return 0, fmt.Errorf("expression ends too early")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	switch token.op {
+	case 0:
+		return token.value, nil
+	case '-':
+		value, err := p.factor()
+		return -value, err
+	case '(':
+		value, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("missing %q", ")")
+		}
+		p.pos++
+		return value, nil
+	}
+	return 0, fmt.Errorf("unexpected %q", token.text)
+}
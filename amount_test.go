@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+
+func TestParseAmount(t *testing.T) {
+	en := &groupSettings{language: "en"}
+	ru := &groupSettings{language: "ru"}
+	tests := []struct {
+		text     string
+		settings *groupSettings
+		want     float64
+		wantErr  bool
+	}{
+		{"12,50", en, 12.5, false},
+		{"12,50", ru, 12.5, false},
+		{"1.500", en, 1.5, false},
+		{"1.500", ru, 1500, false},
+		{"4.990", en, 4.99, false},
+		{"1,500", en, 1500, false},
+		{"1,500", ru, 1.5, false},
+		{"1,234.5", en, 1234.5, false},
+		{"10.000,50", en, 10000.5, false},
+		{"10.000,50", ru, 10000.5, false},
+		{"30+12.5", en, 42.5, false},
+		{"€12", en, 12, false},
+		{"12 eur", en, 12, false},
+		{"1 500", en, 1500, false},
+		{"2*(3+4)", en, 14, false},
+		{"(2+3", en, 0, true},
+		{"10/0", en, 0, true},
+		{"12 apples", en, 0, true},
+		{"", en, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAmount(tt.text, tt.settings)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAmount(%q, %s) error = %v, want error %v", tt.text, tt.settings.language, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseAmount(%q, %s) = %v, want %v", tt.text, tt.settings.language, got, tt.want)
+		}
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		number  string
+		decimal string
+		want    float64
+		wantErr bool
+	}{
+		{"12,50", ".", 12.5, false},
+		{"1.500", ".", 1.5, false},
+		{"1.500", ",", 1500, false},
+		{"1,500", ".", 1500, false},
+		{"0.500", ",", 0.5, false},
+		{".500", ",", 0.5, false},
+		{"1.5000", ",", 1.5, false},
+		{"1,234.5", ".", 1234.5, false},
+		{"1,234.5", ",", 1234.5, false},
+		{"10.000,50", ".", 10000.5, false},
+		{"1.000.000", ".", 1000000, false},
+		{"1 500", ".", 1500, false},
+		{"1,23.5", ".", 0, true},
+		{"1.2.3", ".", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseNumber(tt.number, tt.decimal)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseNumber(%q, %q) error = %v, want error %v", tt.number, tt.decimal, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseNumber(%q, %q) = %v, want %v", tt.number, tt.decimal, got, tt.want)
+		}
+	}
+}
+
+func TestIsGroupSpace(t *testing.T) {
+	tests := []struct {
+		text string
+		i    int
+		want bool
+	}{
+		{"1 500", 1, true},
+		{"1'500", 1, true},
+		{"1 500 000", 5, true},
+		{"1 50", 1, false},
+		{"1 5000", 1, false},
+		{" 500", 0, false},
+		{"a 500", 1, false},
+		{"1-500", 1, false},
+	}
+	for _, tt := range tests {
+		if got := isGroupSpace([]rune(tt.text), tt.i); got != tt.want {
+			t.Errorf("isGroupSpace(%q, %d) = %v, want %v", tt.text, tt.i, got, tt.want)
+		}
+	}
+}
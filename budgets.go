@@ -0,0 +1,444 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Periods of a budget: calendar month in group timezone or fixed dates
+const (
+	budgetMonthly = "monthly"
+	budgetCustom  = "custom"
+)
+
+// Shares of a budget which trigger a group alert, in percent
+var budgetAlertLevels = []int{80, 100}
+
+// Spending limit of the group or one of its categories
+type budget struct {
+	id         int64
+	categoryId int64 // zero for all expenses of the group
+	category   string
+	amount     float64
+	period     string
+	from       sql.NullTime // bounds of custom period
+	to         sql.NullTime
+}
+
+// Returns the period of the budget containing t
+func (b *budget) bounds(t time.Time, loc *time.Location) (from, to time.Time, ok bool) {
+	if b.period == budgetMonthly {
+		t = t.In(loc)
+		from = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		return from, from.AddDate(0, 1, 0), true
+	}
+	if !b.from.Valid || !b.to.Valid || t.Before(b.from.Time) || !t.Before(b.to.Time) {
+		return time.Time{}, time.Time{}, false
+	}
+	return b.from.Time, b.to.Time, true
+}
+
+func (b *budget) title(settings *groupSettings) string {
+	name := b.category
+	if b.categoryId == 0 {
+		name = settings.tr("All expenses")
+	}
+	if b.period == budgetMonthly {
+		return fmt.Sprintf(settings.tr("%s, monthly"), name)
+	}
+	return fmt.Sprintf("%s, %s – %s", name, settings.formatDay(b.from.Time), settings.formatDay(b.to.Time.AddDate(0, 0, -1)))
+}
+
+func selectGroupBudgets(uid int) (budgets []budget, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT B.id, IFNULL(B.category_id, 0), IFNULL(C.name, ''), B.amount, B.period, B.from_ts, B.to_ts
+FROM budgets B LEFT JOIN categories C ON C.id=B.category_id
+WHERE B.group_id=(SELECT group_id FROM users WHERE id=?) ORDER BY B.id`, uid)
+	if err != nil {
+		err = fmt.Errorf("select group budgets: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b budget
+		if err = rows.Scan(&b.id, &b.categoryId, &b.category, &b.amount, &b.period, &b.from, &b.to); err != nil {
+			err = fmt.Errorf("scan budget: %v", err)
+			return
+		}
+		budgets = append(budgets, b)
+	}
+	return
+}
+
+// Sums up group expenses in [from, to), only of the category unless it is zero
+func selectBudgetUsage(uid int, categoryId int64, from, to time.Time) (used float64, err error) {
+	query := `SELECT IFNULL(SUM(T.amount), 0) FROM transactions T
+WHERE T.owner_id IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?))
+AND T.voided_ts IS NULL AND T.ts>=? AND T.ts<?`
+	args := []interface{}{uid, from.UTC(), to.UTC()}
+	if categoryId != 0 {
+		query += ` AND T.category_id=?`
+		args = append(args, categoryId)
+	}
+	if err = db.QueryRow(query, args...).Scan(&used); err != nil {
+		err = fmt.Errorf("select budget usage: %v", err)
+	}
+	return
+}
+
+// Extrapolates spending so far to the whole period; the first day counts as
+// a full one to keep early projections sane
+func projectSpending(used float64, from, to, now time.Time) float64 {
+	elapsed := now.Sub(from)
+	if elapsed < 24*time.Hour {
+		elapsed = 24 * time.Hour
+	}
+	total := to.Sub(from)
+	if elapsed >= total {
+		return used
+	}
+	return used * float64(total) / float64(elapsed)
+}
+
+// Checks budgets after a recurring expense was created or an expense was
+// edited, by the stored category and date of the transaction
+func checkTransactionBudgets(trid int64, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	var owner, categoryId int64
+	var ts time.Time
+	var voided bool
+	err := db.QueryRow(`SELECT owner_id, IFNULL(category_id, 0), ts, voided_ts IS NOT NULL FROM transactions WHERE id=?`, trid).
+		Scan(&owner, &categoryId, &ts, &voided)
+	if err != nil {
+		logE.Printf("check budgets of transaction %d: %v", trid, err)
+		return
+	}
+	if !voided {
+		checkBudgets(int(owner), categoryId, ts, bot, tasksChan)
+	}
+}
+
+// Alerts the group when a new expense of the category brings a budget of the
+// current period to one of the alert levels; each level is announced once
+func checkBudgets(uid int, categoryId int64, ts time.Time, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "check budgets: "
+
+	settings, err := getUserSettings(uid)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	budgets, err := selectGroupBudgets(uid)
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+	now := time.Now()
+	for i := range budgets {
+		b := &budgets[i]
+		if b.categoryId != 0 && b.categoryId != categoryId {
+			continue
+		}
+		from, to, ok := b.bounds(now, settings.location())
+		if !ok || ts.Before(from) || !ts.Before(to) {
+			continue
+		}
+		used, err := selectBudgetUsage(uid, b.categoryId, from, to)
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			return
+		}
+		level := 0
+		for _, l := range budgetAlertLevels {
+			if used >= b.amount*float64(l)/100-balanceEpsilon {
+				level = l
+			}
+		}
+		if level == 0 {
+			continue
+		}
+
+		mt := &markBudgetAlertTask{id: b.id, period: from, level: level, err: make(chan error)}
+		tasksChan <- mt
+		if err := <-mt.err; err != nil {
+			logE.Printf(logPrefix+"execute mark-budget-alert task: %v", err)
+			continue
+		}
+		if !mt.marked {
+			continue
+		}
+
+		text := fmt.Sprintf(settings.tr("Budget %s is %d%% used: %s of %s, %s left."),
+			b.title(settings), level, settings.money(used), settings.money(b.amount), settings.money(b.amount-used))
+		if level >= 100 {
+			text = fmt.Sprintf(settings.tr("Budget %s is exceeded: %s of %s used."),
+				b.title(settings), settings.money(used), settings.money(b.amount))
+		}
+		groupMembers, err := selectGroupMembers(uid)
+		if err != nil {
+			logE.Printf(logPrefix+"select group members: %v", err)
+			return
+		}
+		for _, member := range sortedMemberIds(groupMembers) {
+			notifyMember(member, "⚠ "+text, settings, bot, tasksChan)
+		}
+	}
+}
+
+func formatBudgets(budgets []budget, uid int, settings *groupSettings) (string, error) {
+	if len(budgets) == 0 {
+		return settings.tr("No budgets yet."), nil
+	}
+	now := time.Now()
+	var sections []string
+	for i := range budgets {
+		b := &budgets[i]
+		lines := []string{b.title(settings)}
+		from, to, ok := b.bounds(now, settings.location())
+		if !ok {
+			lines = append(lines, settings.tr("Not active now"))
+			sections = append(sections, strings.Join(lines, "\n"))
+			continue
+		}
+		used, err := selectBudgetUsage(uid, b.categoryId, from, to)
+		if err != nil {
+			return "", err
+		}
+		percent := int(math.Round(used / b.amount * 100))
+		if used <= b.amount {
+			lines = append(lines, fmt.Sprintf(settings.tr("%s of %s used (%d%%), %s left"),
+				settings.money(used), settings.money(b.amount), percent, settings.money(b.amount-used)))
+		} else {
+			lines = append(lines, fmt.Sprintf(settings.tr("%s of %s used (%d%%), %s over"),
+				settings.money(used), settings.money(b.amount), percent, settings.money(used-b.amount)))
+		}
+		projected := projectSpending(used, from, to, now)
+		projection := fmt.Sprintf(settings.tr("Projected by %s: %s"), settings.formatDay(to.AddDate(0, 0, -1)), settings.money(projected))
+		if projected > b.amount+balanceEpsilon {
+			projection += ", " + fmt.Sprintf(settings.tr("over by %s"), settings.money(projected-b.amount))
+		}
+		lines = append(lines, projection)
+		sections = append(sections, strings.Join(lines, "\n"))
+	}
+	return strings.Join(sections, "\n\n"), nil
+}
+
+// Parses period like "01/11/2026 - 15/11/2026", both days inclusive
+func parsePeriod(text string, settings *groupSettings) (from, to time.Time, err error) {
+	parts := strings.FieldsFunc(text, func(r rune) bool { return r == '–' || r == '—' })
+	if len(parts) != 2 {
+		if idx := strings.Index(text, " - "); idx != -1 {
+			parts = []string{text[:idx], text[idx+3:]}
+		}
+	}
+	if len(parts) != 2 {
+		return from, to, fmt.Errorf("expected two days separated by \" - \"")
+	}
+	if from, err = parseDay(parts[0], settings); err != nil {
+		return
+	}
+	var last time.Time
+	if last, err = parseDay(parts[1], settings); err != nil {
+		return
+	}
+	to = last.AddDate(0, 0, 1)
+	if !from.Before(to) {
+		err = fmt.Errorf("the period ends before it starts")
+	}
+	return
+}
+
+func budgetHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "budget handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	if settings.groupId == 0 {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr(notInGroupMessage)))
+		return
+	}
+	isLeader, err := isGroupLeader(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"check leader: %v", err)
+		return
+	}
+	canManage := isLeader && !settings.archived
+
+	const (
+		done   = "⏎"
+		back   = "◀"
+		add    = "add"
+		remove = "delete"
+	)
+	backKb := tgbotapi2.NewInlineKeyboardMarkup(tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(back, back)))
+
+	sent, _ := bot.Send(newAbortableMsg(chatId, settings.tr("Budgets")))
+	show := func(text string, kb tgbotapi2.InlineKeyboardMarkup) {
+		edit := newAbortableEditMsg(chatId, sent.MessageID, text)
+		edit.ReplyMarkup = &kb
+		bot.Send(edit)
+	}
+	var budgets []budget
+	showReport := func() bool {
+		if budgets, err = selectGroupBudgets(callerId); err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			return false
+		}
+		text, err := formatBudgets(budgets, callerId, settings)
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			return false
+		}
+		var rows [][]tgbotapi2.InlineKeyboardButton
+		if canManage {
+			manageRow := tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(settings.tr("+ Add"), add))
+			if len(budgets) != 0 {
+				manageRow = append(manageRow, tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Delete"), remove))
+			}
+			rows = append(rows, manageRow)
+		}
+		rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(done, done)))
+		show(text, tgbotapi2.NewInlineKeyboardMarkup(rows...))
+		return true
+	}
+	if !showReport() {
+		return
+	}
+
+	waitTask := func(errChan chan error) {
+		if err := <-errChan; err != nil {
+			logE.Printf(logPrefix+"execute budget task: %v", err)
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Failed to update budgets.")))
+		}
+	}
+
+	// Asks scope, period and amount of a new budget; returns nil budget when
+	// user went back and false on abort
+	askBudget := func() (*budget, bool) {
+		categories, err := selectGroupCategories(callerId)
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			return nil, false
+		}
+		rows := [][]tgbotapi2.InlineKeyboardButton{
+			tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(settings.tr("All expenses"), "0")),
+		}
+		for _, c := range categories {
+			rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(c.name, strconv.FormatInt(c.id, 10))))
+		}
+		rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(back, back)))
+		show(settings.tr("Which expenses does the budget limit?"), tgbotapi2.NewInlineKeyboardMarkup(rows...))
+
+		b := &budget{}
+		switch choice := nextMenuChoice(chatId, sent.MessageID, bot, replyChan); choice {
+		case "":
+			return nil, false
+		case back:
+			return nil, true
+		default:
+			if b.categoryId, err = strconv.ParseInt(choice, 10, 64); err != nil {
+				return nil, true
+			}
+		}
+
+		show(settings.tr("Select the budget period."), tgbotapi2.NewInlineKeyboardMarkup(
+			tgbotapi2.NewInlineKeyboardRow(
+				tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Monthly"), budgetMonthly),
+				tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Custom period"), budgetCustom),
+			),
+			tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(back, back)),
+		))
+		switch b.period = nextMenuChoice(chatId, sent.MessageID, bot, replyChan); b.period {
+		case "":
+			return nil, false
+		case budgetMonthly:
+		case budgetCustom:
+			now := time.Now().In(settings.location())
+			example := fmt.Sprintf("%s - %s", settings.formatDay(now), settings.formatDay(now.AddDate(0, 0, 13)))
+			show(fmt.Sprintf(settings.tr("Type the first and the last day like %s."), example), backKb)
+			for !b.from.Valid {
+				text, ok := nextMenuText(chatId, sent.MessageID, back, bot, replyChan)
+				if !ok || len(text) == 0 {
+					return nil, ok
+				}
+				from, to, err := parsePeriod(text, settings)
+				if err != nil {
+					bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Cannot read the period: %v."), err)))
+					continue
+				}
+				b.from = sql.NullTime{Time: from, Valid: true}
+				b.to = sql.NullTime{Time: to, Valid: true}
+			}
+		default:
+			return nil, true
+		}
+
+		show(settings.tr("Type the budget amount."), backKb)
+		for b.amount == 0 {
+			text, ok := nextMenuText(chatId, sent.MessageID, back, bot, replyChan)
+			if !ok || len(text) == 0 {
+				return nil, ok
+			}
+			amount, err := parsePositiveAmount(text, settings)
+			if err != nil {
+				bot.Send(wrongAmountMsg(chatId, err, settings))
+				continue
+			}
+			b.amount = amount
+		}
+		return b, true
+	}
+
+	for {
+		switch choice := nextMenuChoice(chatId, sent.MessageID, bot, replyChan); {
+		case choice == "" || choice == done:
+			bot.Send(tgbotapi2.NewEditMessageReplyMarkup(chatId, sent.MessageID, tgbotapi2.NewInlineKeyboardMarkup()))
+			return
+		case choice == remove && canManage:
+			var rows [][]tgbotapi2.InlineKeyboardButton
+			for i := range budgets {
+				rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(
+					budgets[i].title(settings), strconv.FormatInt(budgets[i].id, 10))))
+			}
+			rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(back, back)))
+			show(settings.tr("Which budget to delete?"), tgbotapi2.NewInlineKeyboardMarkup(rows...))
+			switch choice := nextMenuChoice(chatId, sent.MessageID, bot, replyChan); choice {
+			case "":
+				return
+			case back:
+			default:
+				if id, err := strconv.ParseInt(choice, 10, 64); err == nil {
+					errChan := make(chan error)
+					tasksChan <- &deleteBudgetTask{callerId, id, errChan}
+					waitTask(errChan)
+				}
+			}
+		case choice == add && canManage:
+			b, ok := askBudget()
+			if !ok {
+				return
+			}
+			if b != nil {
+				errChan := make(chan error)
+				tasksChan <- &addBudgetTask{callerId, b, errChan}
+				waitTask(errChan)
+			}
+		default:
+			continue
+		}
+		if !showReport() {
+			return
+		}
+	}
+}
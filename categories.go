@@ -0,0 +1,398 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Categories every new group starts with
+var defaultCategories = []string{"Groceries", "Rent", "Utilities", "Transport", "Eating out", "Entertainment", "Other"}
+
+type category struct {
+	id   int64
+	name string
+}
+
+func selectGroupCategories(uid int) (categories []category, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT id, name FROM categories WHERE group_id=(SELECT group_id FROM users WHERE id=?)
+ORDER BY name`, uid)
+	if err != nil {
+		err = fmt.Errorf("select group categories: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c category
+		if err = rows.Scan(&c.id, &c.name); err != nil {
+			err = fmt.Errorf("scan category: %v", err)
+			return
+		}
+		categories = append(categories, c)
+	}
+	return
+}
+
+// Returns category of the latest group transaction with the same title, zero
+// if there is none
+func suggestCategory(uid int, title string) (categoryId int64, err error) {
+	err = db.QueryRow(`SELECT T.category_id FROM transactions T
+WHERE T.owner_id IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?))
+AND T.category_id IS NOT NULL AND LOWER(T.title)=LOWER(?)
+ORDER BY T.ts DESC LIMIT 1`, uid, strings.TrimSpace(title)).Scan(&categoryId)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("select suggested category: %v", err)
+	}
+	return
+}
+
+// Lets payer pick a category of the expense, the one used for the same title
+// before goes first
+func askCategory(chatId int64, uid int, title string, settings *groupSettings, bot *tgbotapi2.BotAPI, replyChan <-chan reply) (categoryId int64, ok bool) {
+	logPrefix := "ask category: "
+
+	categories, err := selectGroupCategories(uid)
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return 0, true
+	}
+	if len(categories) == 0 {
+		return 0, true
+	}
+	suggested, err := suggestCategory(uid, title)
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+	}
+
+	var buttons []tgbotapi2.InlineKeyboardButton
+	for _, c := range categories {
+		button := tgbotapi2.NewInlineKeyboardButtonData(c.name, strconv.FormatInt(c.id, 10))
+		if c.id == suggested {
+			button.Text = "★ " + c.name
+			buttons = append([]tgbotapi2.InlineKeyboardButton{button}, buttons...)
+		} else {
+			buttons = append(buttons, button)
+		}
+	}
+	var rows [][]tgbotapi2.InlineKeyboardButton
+	for i := 0; i < len(buttons); i += 2 {
+		end := i + 2
+		if end > len(buttons) {
+			end = len(buttons)
+		}
+		rows = append(rows, buttons[i:end])
+	}
+	rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(settings.tr("No category"), "0")))
+
+	msg := newAbortableMsg(chatId, settings.tr("Which category is it?"))
+	msg.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(rows...)
+	sent, _ := bot.Send(msg)
+
+	for r := range replyChan {
+		if isAbort(r) {
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return 0, false
+		}
+		if r.cb == nil || r.cb.Message == nil || r.cb.Message.MessageID != sent.MessageID {
+			continue
+		}
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+		id, err := strconv.ParseInt(r.cb.Data, 10, 64)
+		if err != nil {
+			continue
+		}
+		name := settings.tr("No category")
+		for _, c := range categories {
+			if c.id == id {
+				name = c.name
+			}
+		}
+		bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, fmt.Sprintf(settings.tr("Category: %s"), name)))
+		return id, true
+	}
+	return 0, false
+}
+
+// Spending of one category split by the members who consumed it
+type categorySpending struct {
+	name    string // empty for uncategorized expenses
+	total   float64
+	members map[int64]float64
+}
+
+// Sums up group expenses in [from, to) by category, zero bounds are open
+func selectCategorySpending(uid int, from, to time.Time) (spending []categorySpending, err error) {
+	conds := []string{
+		`T.owner_id IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?))`,
+		`T.voided_ts IS NULL`,
+	}
+	args := []interface{}{uid}
+	if !from.IsZero() {
+		conds = append(conds, `T.ts>=?`)
+		args = append(args, from.UTC())
+	}
+	if !to.IsZero() {
+		conds = append(conds, `T.ts<?`)
+		args = append(args, to.UTC())
+	}
+
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT IFNULL(C.name, ''), O.dst, SUM(O.amount)
+FROM transactions T JOIN operations O ON O.transaction_id=T.id LEFT JOIN categories C ON C.id=T.category_id
+WHERE `+strings.Join(conds, " AND ")+`
+GROUP BY T.category_id, O.dst`, args...)
+	if err != nil {
+		err = fmt.Errorf("select category spending: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	byName := make(map[string]*categorySpending)
+	for rows.Next() {
+		var name string
+		var dst int64
+		var amount float64
+		if err = rows.Scan(&name, &dst, &amount); err != nil {
+			err = fmt.Errorf("scan category spending: %v", err)
+			return
+		}
+		s, ok := byName[name]
+		if !ok {
+			s = &categorySpending{name: name, members: make(map[int64]float64)}
+			byName[name] = s
+		}
+		s.total += amount
+		s.members[dst] += amount
+	}
+	for _, s := range byName {
+		spending = append(spending, *s)
+	}
+	sort.Slice(spending, func(i, j int) bool { return spending[i].total > spending[j].total })
+	return
+}
+
+type reportPeriod struct {
+	title  string
+	bounds func(now time.Time) (from, to time.Time)
+}
+
+var reportPeriods = []reportPeriod{
+	{"This month", func(now time.Time) (time.Time, time.Time) {
+		from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		return from, from.AddDate(0, 1, 0)
+	}},
+	{"Last month", func(now time.Time) (time.Time, time.Time) {
+		to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		return to.AddDate(0, -1, 0), to
+	}},
+	{"This year", func(now time.Time) (time.Time, time.Time) {
+		from := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, now.Location())
+		return from, from.AddDate(1, 0, 0)
+	}},
+	{"All time", func(now time.Time) (time.Time, time.Time) {
+		return time.Time{}, time.Time{}
+	}},
+}
+
+func formatCategoryReport(period string, spending []categorySpending, names map[int64]string, settings *groupSettings) string {
+	if len(spending) == 0 {
+		return fmt.Sprintf(settings.tr("No expenses, %s."), strings.ToLower(settings.tr(period)))
+	}
+
+	formatMembers := func(members map[int64]float64) string {
+		var parts []string
+		for _, uid := range sortedMemberIds(names) {
+			if amount, ok := members[uid]; ok {
+				parts = append(parts, fmt.Sprintf("%s %s", names[uid], settings.money(amount)))
+			}
+		}
+		return strings.Join(parts, ", ")
+	}
+
+	lines := []string{fmt.Sprintf(settings.tr("Spending by category, %s:"), strings.ToLower(settings.tr(period))), ""}
+	var total float64
+	totalMembers := make(map[int64]float64)
+	for _, s := range spending {
+		name := s.name
+		if len(name) == 0 {
+			name = settings.tr("Uncategorized")
+		}
+		lines = append(lines, fmt.Sprintf("%s — %s", name, settings.money(s.total)), "    "+formatMembers(s.members))
+		total += s.total
+		for uid, amount := range s.members {
+			totalMembers[uid] += amount
+		}
+	}
+	lines = append(lines, "", fmt.Sprintf(settings.tr("Total — %s"), settings.money(total)), "    "+formatMembers(totalMembers))
+	return strings.Join(lines, "\n")
+}
+
+func categoriesHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "categories handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	groupMembers, err := selectAllGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+	isLeader, err := isGroupLeader(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"check leader: %v", err)
+		return
+	}
+	canManage := isLeader && !settings.archived
+
+	const (
+		done   = "⏎"
+		back   = "◀"
+		manage = "manage"
+		add    = "add"
+		rename = "rename"
+		remove = "delete"
+	)
+	composeReportKb := func() tgbotapi2.InlineKeyboardMarkup {
+		var periodRow []tgbotapi2.InlineKeyboardButton
+		for i, p := range reportPeriods {
+			periodRow = append(periodRow, tgbotapi2.NewInlineKeyboardButtonData(settings.tr(p.title), strconv.Itoa(i)))
+		}
+		rows := [][]tgbotapi2.InlineKeyboardButton{periodRow}
+		if canManage {
+			rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Manage categories"), manage)))
+		}
+		rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(done, done)))
+		return tgbotapi2.NewInlineKeyboardMarkup(rows...)
+	}
+	sent, _ := bot.Send(newAbortableMsg(chatId, settings.tr("Spending by category")))
+	show := func(text string, kb tgbotapi2.InlineKeyboardMarkup) {
+		edit := newAbortableEditMsg(chatId, sent.MessageID, text)
+		edit.ReplyMarkup = &kb
+		bot.Send(edit)
+	}
+	showReport := func(period reportPeriod) {
+		from, to := period.bounds(time.Now().In(settings.location()))
+		spending, err := selectCategorySpending(callerId, from, to)
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			return
+		}
+		show(formatCategoryReport(period.title, spending, groupMembers, settings), composeReportKb())
+	}
+	showReport(reportPeriods[0])
+
+	waitTask := func(errChan chan error) {
+		if err := <-errChan; err != nil {
+			logE.Printf(logPrefix+"execute category task: %v", err)
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Failed to update categories.")))
+		}
+	}
+	backKb := tgbotapi2.NewInlineKeyboardMarkup(tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(back, back)))
+
+	for {
+		choice := nextMenuChoice(chatId, sent.MessageID, bot, replyChan)
+		switch {
+		case choice == "" || choice == done:
+			bot.Send(tgbotapi2.NewEditMessageReplyMarkup(chatId, sent.MessageID, tgbotapi2.NewInlineKeyboardMarkup()))
+			return
+		case choice == manage && canManage:
+		default:
+			if i, err := strconv.Atoi(choice); err == nil && i >= 0 && i < len(reportPeriods) {
+				showReport(reportPeriods[i])
+			}
+			continue
+		}
+
+		// Category list management
+		for managing := true; managing; {
+			categories, err := selectGroupCategories(callerId)
+			if err != nil {
+				logE.Printf(logPrefix+"%v", err)
+				return
+			}
+			var rows [][]tgbotapi2.InlineKeyboardButton
+			for _, c := range categories {
+				rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(c.name, strconv.FormatInt(c.id, 10))))
+			}
+			rows = append(rows, tgbotapi2.NewInlineKeyboardRow(
+				tgbotapi2.NewInlineKeyboardButtonData(settings.tr("+ Add"), add),
+				tgbotapi2.NewInlineKeyboardButtonData(back, back),
+			))
+			show(settings.tr("Categories of the group"), tgbotapi2.NewInlineKeyboardMarkup(rows...))
+
+			choice := nextMenuChoice(chatId, sent.MessageID, bot, replyChan)
+			switch choice {
+			case "":
+				return
+			case back:
+				managing = false
+				showReport(reportPeriods[0])
+			case add:
+				show(settings.tr("Type the name of the new category."), backKb)
+				name, ok := nextMenuText(chatId, sent.MessageID, back, bot, replyChan)
+				if !ok {
+					return
+				}
+				if len(name) != 0 {
+					errChan := make(chan error)
+					tasksChan <- &addCategoryTask{callerId, name, errChan}
+					waitTask(errChan)
+				}
+			default:
+				id, err := strconv.ParseInt(choice, 10, 64)
+				if err != nil {
+					continue
+				}
+				var selected *category
+				for i := range categories {
+					if categories[i].id == id {
+						selected = &categories[i]
+					}
+				}
+				if selected == nil {
+					continue
+				}
+				show(fmt.Sprintf(settings.tr("Category %q"), selected.name), tgbotapi2.NewInlineKeyboardMarkup(tgbotapi2.NewInlineKeyboardRow(
+					tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Rename"), rename),
+					tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Delete"), remove),
+					tgbotapi2.NewInlineKeyboardButtonData(back, back),
+				)))
+				switch nextMenuChoice(chatId, sent.MessageID, bot, replyChan) {
+				case "":
+					return
+				case rename:
+					show(fmt.Sprintf(settings.tr("Type the new name of %q."), selected.name), backKb)
+					name, ok := nextMenuText(chatId, sent.MessageID, back, bot, replyChan)
+					if !ok {
+						return
+					}
+					if len(name) != 0 {
+						errChan := make(chan error)
+						tasksChan <- &renameCategoryTask{callerId, id, name, errChan}
+						waitTask(errChan)
+					}
+				case remove:
+					errChan := make(chan error)
+					tasksChan <- &deleteCategoryTask{callerId, id, errChan}
+					waitTask(errChan)
+				}
+			}
+		}
+	}
+}
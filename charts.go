@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// Size of chart images in pixels
+const (
+	chartWidth  = 1200
+	chartHeight = 800
+)
+
+// Pie charts show this many largest slices, the rest is merged into one
+const chartMaxSlices = 8
+
+// Pie charts split spending by payer or by category
+const (
+	pieByPayer    = "payer"
+	pieByCategory = "category"
+)
+
+var chartPalette = []color.RGBA{
+	{0x63, 0x6E, 0xFA, 0xFF}, {0xEF, 0x55, 0x3B, 0xFF}, {0x00, 0xCC, 0x96, 0xFF}, {0xAB, 0x63, 0xFA, 0xFF},
+	{0xFF, 0xA1, 0x5A, 0xFF}, {0x19, 0xD3, 0xF3, 0xFF}, {0xFF, 0x66, 0x92, 0xFF}, {0xB6, 0xE8, 0x80, 0xFF},
+	{0xFF, 0x97, 0xFF, 0xFF}, {0xFE, 0xCB, 0x52, 0xFF},
+}
+
+var chartGridColor = color.RGBA{0xE5, 0xEC, 0xF6, 0xFF}
+
+type chart struct {
+	img           *image.RGBA
+	regular, bold font.Face
+}
+
+func newChart(title string) (*chart, error) {
+	regular, bold, err := newRenderFaces()
+	if err != nil {
+		return nil, err
+	}
+	c := &chart{image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight)), regular, bold}
+	draw.Draw(c.img, c.img.Bounds(), image.White, image.Point{}, draw.Src)
+	c.text(c.bold, title, chartWidth/2, 50, tableTextColor, 0.5)
+	return c, nil
+}
+
+func (c *chart) close() {
+	c.regular.Close()
+	c.bold.Close()
+}
+
+// Draws text with baseline at y; anchor 0 puts its left edge at x, 0.5 its
+// center and 1 its right edge
+func (c *chart) text(face font.Face, s string, x, y int, col color.Color, anchor float64) {
+	d := font.Drawer{Dst: c.img, Src: image.NewUniform(col), Face: face}
+	d.Dot = fixed.P(x-int(float64(textWidth(face, s))*anchor), y)
+	d.DrawString(s)
+}
+
+func (c *chart) fill(r image.Rectangle, col color.Color) {
+	draw.Draw(c.img, r, image.NewUniform(col), image.Point{}, draw.Src)
+}
+
+// Draws a line by stamping squares of the given width along it
+func (c *chart) line(x0, y0, x1, y1, width int, col color.Color) {
+	steps := int(math.Max(math.Abs(float64(x1-x0)), math.Abs(float64(y1-y0))))
+	for i := 0; i <= steps; i++ {
+		x, y := x0, y0
+		if steps != 0 {
+			x, y = x0+(x1-x0)*i/steps, y0+(y1-y0)*i/steps
+		}
+		c.fill(image.Rect(x-width/2, y-width/2, x-width/2+width, y-width/2+width), col)
+	}
+}
+
+// Draws colored squares with labels one under another
+func (c *chart) legend(x, y int, labels []string) {
+	lineHeight := c.regular.Metrics().Height.Ceil() + 12
+	for i, label := range labels {
+		top := y + i*lineHeight
+		c.fill(image.Rect(x, top, x+24, top+24), chartPalette[i%len(chartPalette)])
+		c.text(c.regular, label, x+36, top+20, tableTextColor, 0)
+	}
+}
+
+// Picks round ticks covering [lo, hi], about five of them
+func niceTicks(lo, hi float64) (start, step float64, n int) {
+	if hi-lo < balanceEpsilon {
+		hi = lo + 1
+	}
+	raw := (hi - lo) / 5
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if step = m * mag; step >= raw {
+			break
+		}
+	}
+	start = math.Floor(lo/step) * step
+	n = int(math.Round((math.Ceil(hi/step)*step - start) / step))
+	return
+}
+
+// Draws horizontal grid of the plot area with money labels on the left;
+// returns function mapping values to y coordinates
+func (c *chart) valueAxis(area image.Rectangle, lo, hi float64, settings *groupSettings) func(float64) int {
+	start, step, n := niceTicks(lo, hi)
+	y := func(v float64) int {
+		return area.Max.Y - int(math.Round((v-start)/(step*float64(n))*float64(area.Dy())))
+	}
+	for i := 0; i <= n; i++ {
+		v := start + float64(i)*step
+		col := chartGridColor
+		if math.Abs(v) < balanceEpsilon {
+			col = tableMutedColor
+		}
+		c.fill(image.Rect(area.Min.X, y(v), area.Max.X, y(v)+2), col)
+		c.text(c.regular, settings.money(v), area.Min.X-12, y(v)+8, tableTextColor, 1)
+	}
+	return y
+}
+
+func (c *chart) save(path string) error {
+	return savePNG(c.img, path)
+}
+
+func renderMonthlyChart(months []time.Time, totals []float64, settings *groupSettings, path string) error {
+	c, err := newChart(settings.tr("Spending by month"))
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	area := image.Rect(170, 100, chartWidth-40, chartHeight-80)
+	var hi float64
+	for _, total := range totals {
+		hi = math.Max(hi, total)
+	}
+	y := c.valueAxis(area, 0, hi, settings)
+
+	slot := area.Dx() / len(months)
+	// Labels of a long period are thinned out to keep them apart
+	every := (len(months) + 11) / 12
+	for i, month := range months {
+		x := area.Min.X + i*slot
+		c.fill(image.Rect(x+slot*15/100, y(totals[i]), x+slot*85/100, y(0)), chartPalette[0])
+		if i%every == 0 {
+			c.text(c.regular, month.Format("01/2006"), x+slot/2, area.Max.Y+36, tableTextColor, 0.5)
+		}
+		if len(months) <= 6 && totals[i] > 0 {
+			c.text(c.regular, settings.money(totals[i]), x+slot/2, y(totals[i])-10, tableTextColor, 0.5)
+		}
+	}
+	return c.save(path)
+}
+
+func renderPieChart(title string, labels []string, values []float64, settings *groupSettings, path string) error {
+	c, err := newChart(title)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return values[order[i]] > values[order[j]] })
+	var sliceLabels []string
+	var slices []float64
+	var total float64
+	for k, i := range order {
+		if k < chartMaxSlices-1 || len(order) == chartMaxSlices {
+			sliceLabels = append(sliceLabels, labels[i])
+			slices = append(slices, values[i])
+		} else if k == chartMaxSlices-1 {
+			sliceLabels = append(sliceLabels, settings.tr("Other"))
+			slices = append(slices, values[i])
+		} else {
+			slices[len(slices)-1] += values[i]
+		}
+		total += values[i]
+	}
+
+	// Slices go clockwise from the top
+	const cx, cy, r = 380, 440, 300
+	for py := cy - r; py <= cy+r; py++ {
+		for px := cx - r; px <= cx+r; px++ {
+			dx, dy := float64(px-cx), float64(py-cy)
+			if dx*dx+dy*dy > r*r {
+				continue
+			}
+			angle := math.Atan2(dx, -dy)
+			if angle < 0 {
+				angle += 2 * math.Pi
+			}
+			share, slice := angle/(2*math.Pi)*total, 0
+			for slice < len(slices)-1 && share >= slices[slice] {
+				share -= slices[slice]
+				slice++
+			}
+			c.img.Set(px, py, chartPalette[slice%len(chartPalette)])
+		}
+	}
+
+	var legend []string
+	for i, label := range sliceLabels {
+		legend = append(legend, fmt.Sprintf("%s — %s (%.0f%%)", label, settings.money(slices[i]), slices[i]/total*100))
+	}
+	c.legend(740, 160, legend)
+	return c.save(path)
+}
+
+// Draws balance of every member as a step line over times
+func renderBalanceChart(times []time.Time, names []string, balances [][]float64, settings *groupSettings, path string) error {
+	c, err := newChart(settings.tr("Balances (positive when owed to the member)"))
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	area := image.Rect(170, 100, chartWidth-300, chartHeight-80)
+	var lo, hi float64
+	for _, series := range balances {
+		for _, v := range series {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+	}
+	y := c.valueAxis(area, lo, hi, settings)
+
+	first, last := times[0], times[len(times)-1]
+	span := last.Sub(first)
+	if span <= 0 {
+		span = time.Hour
+	}
+	x := func(t time.Time) int {
+		return area.Min.X + int(float64(t.Sub(first))/float64(span)*float64(area.Dx()))
+	}
+	for _, t := range []time.Time{first, first.Add(span / 2), last} {
+		c.text(c.regular, settings.formatDay(t), x(t), area.Max.Y+36, tableTextColor, 0.5)
+	}
+
+	for k, series := range balances {
+		col := chartPalette[k%len(chartPalette)]
+		for i := 1; i < len(series); i++ {
+			c.line(x(times[i-1]), y(series[i-1]), x(times[i]), y(series[i-1]), 4, col)
+			c.line(x(times[i]), y(series[i-1]), x(times[i]), y(series[i]), 4, col)
+		}
+	}
+	c.legend(area.Max.X+30, area.Min.Y, names)
+	return c.save(path)
+}
+
+// Replaces open bounds of the period by the first expense of the group and
+// now
+func closeChartPeriod(uid int, from, to time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	now := time.Now().In(loc)
+	if to.IsZero() {
+		to = now
+	}
+	if from.IsZero() {
+		// MIN() would lose the column type and return the time as text
+		var first time.Time
+		err := db.QueryRow(`SELECT T.ts FROM transactions T
+WHERE T.owner_id IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?))
+ORDER BY T.ts LIMIT 1`, uid).Scan(&first)
+		switch {
+		case err == sql.ErrNoRows:
+			from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		case err != nil:
+			return from, to, fmt.Errorf("select first transaction: %v", err)
+		default:
+			first = first.In(loc)
+			from = time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc)
+		}
+	}
+	return from, to, nil
+}
+
+// Sums up group expenses of [from, to) by month
+func selectMonthlySpending(uid int, from, to time.Time, loc *time.Location) (months []time.Time, totals []float64, err error) {
+	monthIndex := func(t time.Time) int {
+		t = t.In(loc)
+		return t.Year()*12 + int(t.Month()) - 1
+	}
+	first := from.In(loc)
+	for m := monthIndex(from); m <= monthIndex(to.Add(-time.Nanosecond)); m++ {
+		months = append(months, time.Date(first.Year(), first.Month()+time.Month(m-monthIndex(from)), 1, 0, 0, 0, 0, loc))
+		totals = append(totals, 0)
+	}
+
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT T.ts, T.amount FROM transactions T
+WHERE T.owner_id IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?))
+AND T.voided_ts IS NULL AND T.ts>=? AND T.ts<?`, uid, from.UTC(), to.UTC())
+	if err != nil {
+		err = fmt.Errorf("select monthly spending: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts time.Time
+		var amount float64
+		if err = rows.Scan(&ts, &amount); err != nil {
+			err = fmt.Errorf("scan monthly spending: %v", err)
+			return
+		}
+		if i := monthIndex(ts) - monthIndex(from); i >= 0 && i < len(totals) {
+			totals[i] += amount
+		}
+	}
+	return
+}
+
+// Returns balances of members after every change within [from, to), starting
+// with balances at from; old repayments without time count from the start
+func selectBalanceHistory(uid int, members []int64, from, to time.Time) (times []time.Time, balances [][]float64, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT T.ts, R.created_ts, O.src, O.dst, O.amount
+FROM operations O LEFT JOIN transactions T ON O.transaction_id=T.id LEFT JOIN repayments R ON R.operation_id=O.id
+WHERE O.src!=O.dst AND T.voided_ts IS NULL AND `+acceptedSharesOnly+`
+AND O.dst IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?))
+ORDER BY COALESCE(T.ts, R.created_ts), O.id`, uid)
+	if err != nil {
+		err = fmt.Errorf("select balance history: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	debts := make(map[int64]float64)
+	balances = make([][]float64, len(members))
+	snapshot := func(t time.Time) {
+		times = append(times, t)
+		for i, member := range members {
+			balances[i] = append(balances[i], -debts[member])
+		}
+	}
+	started := false
+	for rows.Next() {
+		var transTs, repaidTs sql.NullTime
+		var src, dst int64
+		var amount float64
+		if err = rows.Scan(&transTs, &repaidTs, &src, &dst, &amount); err != nil {
+			err = fmt.Errorf("scan balance history: %v", err)
+			return
+		}
+		ts := transTs
+		if !ts.Valid {
+			ts = repaidTs
+		}
+		if ts.Valid && !ts.Time.Before(to) {
+			break
+		}
+		debts[dst] += amount
+		debts[src] -= amount
+		if !ts.Valid || ts.Time.Before(from) {
+			continue
+		}
+		if !started {
+			snapshot(from)
+			started = true
+		}
+		snapshot(ts.Time)
+	}
+	if !started {
+		snapshot(from)
+	}
+	snapshot(to)
+	return
+}
+
+// Renders the charts of [from, to) into a new temporary directory, which the
+// caller removes once they are sent; no pages when there were no expenses
+func createCharts(uid int, from, to time.Time, pieBy string, settings *groupSettings) (dir string, paths []string, err error) {
+	months, totals, err := selectMonthlySpending(uid, from, to, settings.location())
+	if err != nil {
+		return
+	}
+	var spent float64
+	for _, total := range totals {
+		spent += total
+	}
+	if spent < balanceEpsilon {
+		return
+	}
+
+	var pieTitle string
+	var labels []string
+	var values []float64
+	names, err := selectAllGroupMembers(uid)
+	if err != nil {
+		err = fmt.Errorf("select group members: %v", err)
+		return
+	}
+	if pieBy == pieByCategory {
+		pieTitle = settings.tr("Spending by category")
+		spending, err := selectCategorySpending(uid, from, to)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, s := range spending {
+			name := s.name
+			if len(name) == 0 {
+				name = settings.tr("Uncategorized")
+			}
+			labels = append(labels, name)
+			values = append(values, s.total)
+		}
+	} else {
+		pieTitle = settings.tr("Spending by payer")
+		paid, err := selectPaidByMember(uid, from, to)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, member := range sortedMemberIds(names) {
+			if amount, ok := paid[member]; ok {
+				labels = append(labels, names[member])
+				values = append(values, amount)
+			}
+		}
+	}
+
+	members, err := selectGroupMembers(uid)
+	if err != nil {
+		err = fmt.Errorf("select group members: %v", err)
+		return
+	}
+	memberIds := sortedMemberIds(members)
+	var memberNames []string
+	for _, member := range memberIds {
+		memberNames = append(memberNames, members[member])
+	}
+	end := to
+	if now := time.Now(); now.Before(end) {
+		end = now
+	}
+	times, balances, err := selectBalanceHistory(uid, memberIds, from, end)
+	if err != nil {
+		return
+	}
+
+	if dir, err = ioutil.TempDir("", "sid-charts-"); err != nil {
+		err = fmt.Errorf("create temporary directory: %v", err)
+		return
+	}
+	renders := []func(path string) error{
+		func(path string) error { return renderMonthlyChart(months, totals, settings, path) },
+		func(path string) error { return renderPieChart(pieTitle, labels, values, settings, path) },
+		func(path string) error { return renderBalanceChart(times, memberNames, balances, settings, path) },
+	}
+	for i, render := range renders {
+		path := filepath.Join(dir, fmt.Sprintf("chart-%d.png", i+1))
+		if err = render(path); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("render chart: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	return
+}
+
+// Uploads photos as one album; the bot API library sends media groups of
+// already uploaded files only
+func sendPhotoGroup(bot *tgbotapi2.BotAPI, chatId int64, paths []string) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	var media []map[string]string
+	for i, path := range paths {
+		name := fmt.Sprintf("photo%d", i)
+		media = append(media, map[string]string{"type": "photo", "media": "attach://" + name})
+		part, err := w.CreateFormFile(name, filepath.Base(path))
+		if err != nil {
+			return fmt.Errorf("create form file: %v", err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("open photo: %v", err)
+		}
+		_, err = io.Copy(part, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("read photo: %v", err)
+		}
+	}
+	mediaJSON, err := json.Marshal(media)
+	if err != nil {
+		return fmt.Errorf("marshal media: %v", err)
+	}
+	w.WriteField("chat_id", strconv.FormatInt(chatId, 10))
+	w.WriteField("media", string(mediaJSON))
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("close multipart body: %v", err)
+	}
+
+	resp, err := bot.Client.Post(fmt.Sprintf(tgbotapi2.APIEndpoint, bot.Token, "sendMediaGroup"), w.FormDataContentType(), &body)
+	if err != nil {
+		return fmt.Errorf("send media group: %v", err)
+	}
+	defer resp.Body.Close()
+	var apiResp tgbotapi2.APIResponse
+	if err = json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return fmt.Errorf("decode media group response: %v", err)
+	}
+	if !apiResp.Ok {
+		return fmt.Errorf("send media group: %s", apiResp.Description)
+	}
+	return nil
+}
+
+func chartsHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply) {
+	logPrefix := "charts handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	if settings.groupId == 0 {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr(notInGroupMessage)))
+		return
+	}
+
+	const (
+		back   = "◀"
+		custom = "custom"
+	)
+	sent, _ := bot.Send(newAbortableMsg(chatId, settings.tr("Spending charts")))
+	show := func(text string, kb tgbotapi2.InlineKeyboardMarkup) {
+		edit := newAbortableEditMsg(chatId, sent.MessageID, text)
+		edit.ReplyMarkup = &kb
+		bot.Send(edit)
+	}
+
+	var periodRows [][]tgbotapi2.InlineKeyboardButton
+	for i, p := range reportPeriods {
+		periodRows = append(periodRows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(settings.tr(p.title), strconv.Itoa(i))))
+	}
+	periodRows = append(periodRows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Custom period"), custom)))
+
+	var from, to time.Time
+	for chosen := false; !chosen; {
+		show(settings.tr("Choose the period of the charts."), tgbotapi2.NewInlineKeyboardMarkup(periodRows...))
+		switch choice := nextMenuChoice(chatId, sent.MessageID, bot, replyChan); choice {
+		case "":
+			return
+		case custom:
+			now := time.Now().In(settings.location())
+			example := fmt.Sprintf("%s - %s", settings.formatDay(now.AddDate(0, -1, 0)), settings.formatDay(now))
+			show(fmt.Sprintf(settings.tr("Type the first and the last day like %s."), example),
+				tgbotapi2.NewInlineKeyboardMarkup(tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(back, back))))
+			for !chosen {
+				text, ok := nextMenuText(chatId, sent.MessageID, back, bot, replyChan)
+				if !ok {
+					return
+				}
+				if len(text) == 0 {
+					break
+				}
+				if from, to, err = parsePeriod(text, settings); err != nil {
+					bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Cannot read the period: %v."), err)))
+					continue
+				}
+				chosen = true
+			}
+		default:
+			i, err := strconv.Atoi(choice)
+			if err != nil || i < 0 || i >= len(reportPeriods) {
+				continue
+			}
+			from, to = reportPeriods[i].bounds(time.Now().In(settings.location()))
+			chosen = true
+		}
+	}
+	if from, to, err = closeChartPeriod(callerId, from, to, settings.location()); err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+
+	show(settings.tr("Split the pie chart by payer or by category?"), tgbotapi2.NewInlineKeyboardMarkup(tgbotapi2.NewInlineKeyboardRow(
+		tgbotapi2.NewInlineKeyboardButtonData(settings.tr("By payer"), pieByPayer),
+		tgbotapi2.NewInlineKeyboardButtonData(settings.tr("By category"), pieByCategory),
+	)))
+	pieBy := nextMenuChoice(chatId, sent.MessageID, bot, replyChan)
+	if len(pieBy) == 0 {
+		return
+	}
+
+	period := fmt.Sprintf("%s – %s", settings.formatDay(from), settings.formatDay(to.Add(-time.Nanosecond)))
+	dir, paths, err := createCharts(callerId, from, to, pieBy, settings)
+	if err != nil {
+		logE.Printf(logPrefix+"create charts: %v", err)
+		bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, settings.tr("Failed to draw the charts.")))
+		return
+	}
+	if len(paths) == 0 {
+		bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, fmt.Sprintf(settings.tr("No expenses in %s."), period)))
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, fmt.Sprintf(settings.tr("Spending charts for %s"), period)))
+	if err := sendPhotoGroup(bot, chatId, paths); err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Failed to send the charts.")))
+	}
+}
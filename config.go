@@ -26,6 +26,9 @@ type configParams struct {
 	BotName string `toml:"bot_name"`
 	Token   string `toml:"token"`
 	DBPath  string `toml:"db_path"`
+
+	// Optional directory for local copies of receipt photos
+	ReceiptsDir string `toml:"receipts_dir"`
 }
 
 type configImpl struct {
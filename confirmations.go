@@ -0,0 +1,360 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// States of participant's share in an expense of a group requiring approval;
+// shares without a state are accepted
+const (
+	sharePending  = "pending"
+	shareAccepted = "accepted"
+	shareDisputed = "disputed"
+)
+
+// Callback data of the buttons sent along with a pending share, followed by
+// transaction id; they are pressed outside of any conversation
+const (
+	acceptSharePrefix  = "accept:"
+	disputeSharePrefix = "dispute:"
+)
+
+// Condition on operations O leaving out shares which are pending or disputed
+const acceptedSharesOnly = `NOT EXISTS (SELECT 1 FROM share_confirmations C
+WHERE C.transaction_id=O.transaction_id AND C.member_id=O.dst AND C.state!='accepted')`
+
+// Marks shares of the participants as pending when their group approves
+// expenses; payer agrees with own share and placeholders cannot answer
+func insertPendingShares(trans *sql.Tx, trid, owner int64, shares map[int64]float64, ts time.Time) error {
+	var approval string
+	err := trans.QueryRow(`SELECT G.approval FROM groups G, users U WHERE U.group_id=G.id AND U.id=?`, owner).Scan(&approval)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("select group approval: %v", err)
+	}
+	if approval != approvalParticipants {
+		return nil
+	}
+	for uid := range shares {
+		if uid == owner || isPlaceholder(uid) {
+			continue
+		}
+		if _, err = trans.Exec(`INSERT INTO share_confirmations (transaction_id, member_id, state, created_ts) VALUES (?, ?, ?, ?);`,
+			trid, uid, sharePending, ts.UTC()); err != nil {
+			return fmt.Errorf("exec insert pending share query: %v", err)
+		}
+	}
+	return nil
+}
+
+// Returns state of member's share, empty if it needs no confirmation
+func selectShareState(trid, uid int64) (state string, err error) {
+	err = db.QueryRow(`SELECT state FROM share_confirmations WHERE transaction_id=? AND member_id=?`, trid, uid).Scan(&state)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		err = fmt.Errorf("select share state: %v", err)
+	}
+	return
+}
+
+type overdueShare struct {
+	trid   int64
+	member int64
+}
+
+// Returns pending shares whose group timeout has passed by now
+func selectOverdueShares(now time.Time) (shares []overdueShare, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT C.transaction_id, C.member_id, C.created_ts, G.auto_accept_hours
+FROM share_confirmations C, transactions T, users U, groups G
+WHERE C.state=? AND T.id=C.transaction_id AND U.id=T.owner_id AND G.id=U.group_id AND G.auto_accept_hours>0`, sharePending)
+	if err != nil {
+		err = fmt.Errorf("select pending shares: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s overdueShare
+		var created time.Time
+		var hours int
+		if err = rows.Scan(&s.trid, &s.member, &created, &hours); err != nil {
+			err = fmt.Errorf("scan pending share: %v", err)
+			return
+		}
+		if !created.Add(time.Duration(hours) * time.Hour).After(now) {
+			shares = append(shares, s)
+		}
+	}
+	return
+}
+
+// Accepts shares left unanswered for longer than their group allows
+func runAutoAcceptScheduler(bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "auto-accept scheduler: "
+
+	for ; ; time.Sleep(time.Minute) {
+		shares, err := selectOverdueShares(time.Now())
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			continue
+		}
+		for _, s := range shares {
+			at := &answerShareTask{trid: s.trid, memberId: s.member, state: shareAccepted, auto: true, err: make(chan error)}
+			tasksChan <- at
+			if err := <-at.err; err != nil {
+				if _, ok := err.(*errorNotAllowed); !ok {
+					logE.Printf(logPrefix+"execute answer-share task: %v", err)
+				}
+				continue
+			}
+			settings, err := getUserSettings(int(s.member))
+			if err != nil {
+				logE.Printf(logPrefix+"get settings: %v", err)
+				continue
+			}
+			notifyMember(s.member, fmt.Sprintf(settings.tr("Your share of transaction %d was accepted automatically."), s.trid),
+				settings, bot, tasksChan)
+		}
+	}
+}
+
+// Describes transaction for messages sent to its payer and participants
+func describeTransaction(tr *transactionInfo, heading string, groupMembers map[int64]string, settings *groupSettings) string {
+	var participants []int64
+	for _, uid := range sortedMemberIds(groupMembers) {
+		if _, ok := tr.shares[uid]; ok {
+			participants = append(participants, uid)
+		}
+	}
+	return fmt.Sprintf(settings.tr("%s #%d on %s: %s paid %s"), settings.tr(heading), tr.id, settings.formatTime(tr.time),
+		groupMembers[tr.owner], fmt.Sprintf(settings.tr("%s for %s (%s)"), settings.money(tr.amount), tr.title,
+			joinNames(participants, groupMembers, settings)))
+}
+
+func shareConfirmationKb(trid int64, disputed bool, settings *groupSettings) tgbotapi2.InlineKeyboardMarkup {
+	buttons := []tgbotapi2.InlineKeyboardButton{
+		tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Accept"), fmt.Sprintf("%s%d", acceptSharePrefix, trid)),
+	}
+	if !disputed {
+		buttons = append(buttons, tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Dispute"), fmt.Sprintf("%s%d", disputeSharePrefix, trid)))
+	}
+	return tgbotapi2.NewInlineKeyboardMarkup(buttons)
+}
+
+// Asks participant to accept or dispute the share; unlike notices it is sent
+// whatever notification mode the member chose since an answer is expected
+func sendSharePrompt(uid int64, tr *transactionInfo, text string, settings *groupSettings, bot *tgbotapi2.BotAPI) {
+	text += "\n\n" + settings.tr("Please accept or dispute your share, until then it does not count in balances.")
+	if settings.autoAccept > 0 {
+		text += " " + fmt.Sprintf(settings.tr("Unanswered shares are accepted in %d hours."), settings.autoAccept)
+	}
+	msg := tgbotapi2.NewMessage(uid, text)
+	msg.ReplyMarkup = shareConfirmationKb(tr.id, false, settings)
+	if mode, err := selectNotifyMode(uid, settings.groupId); err == nil && mode == notifyMuted {
+		msg.DisableNotification = true
+	}
+	if _, err := bot.Send(msg); err != nil {
+		logW.Printf("send share prompt to %d: %v", uid, err)
+	}
+}
+
+// Sends prompts for all pending shares of the transaction, e.g. after it was
+// edited
+func requestShareConfirmations(trid int64, heading string, bot *tgbotapi2.BotAPI) {
+	logPrefix := "request share confirmations: "
+
+	tr, err := selectTransaction(trid)
+	if err != nil || tr == nil {
+		logE.Printf(logPrefix+"select transaction %d: %v", trid, err)
+		return
+	}
+	settings, err := getUserSettings(int(tr.owner))
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	groupMembers, err := selectAllGroupMembers(int(tr.owner))
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+	text := describeTransaction(tr, heading, groupMembers, settings)
+	for _, uid := range sortedMemberIds(groupMembers) {
+		share, ok := tr.shares[uid]
+		if !ok {
+			continue
+		}
+		state, err := selectShareState(trid, uid)
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			continue
+		}
+		if state == sharePending {
+			sendSharePrompt(uid, tr, text+"\n"+fmt.Sprintf(settings.tr("Your share: %s"), settings.money(share)), settings, bot)
+		}
+	}
+}
+
+func parseShareCallback(data, prefix string) (int64, bool) {
+	trid, err := strconv.ParseInt(strings.TrimPrefix(data, prefix), 10, 64)
+	return trid, err == nil
+}
+
+// Handles Accept button of a share prompt
+func acceptShareHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "accept share handler: "
+
+	cb := update.CallbackQuery
+	settings, err := getUserSettings(cb.From.ID)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	trid, ok := parseShareCallback(cb.Data, acceptSharePrefix)
+	if !ok {
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, ""))
+		return
+	}
+
+	at := &answerShareTask{trid: trid, memberId: int64(cb.From.ID), state: shareAccepted, err: make(chan error)}
+	tasksChan <- at
+	if err := <-at.err; err != nil {
+		if _, ok := err.(*errorNotAllowed); ok {
+			bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, settings.tr("Nothing to confirm.")))
+			return
+		}
+		logE.Printf(logPrefix+"execute answer-share task: %v", err)
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, settings.tr("Failed to register operation")))
+		return
+	}
+	bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, settings.tr("Accepted.")))
+	if cb.Message != nil {
+		bot.Send(tgbotapi2.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID,
+			cb.Message.Text+"\n\n✓ "+settings.tr("Accepted.")))
+	}
+}
+
+// Handles Dispute button of a share prompt: asks for a comment in reply to
+// the question, so that no conversation the member has open is interrupted
+func disputeShareHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI) {
+	logPrefix := "dispute share handler: "
+
+	cb := update.CallbackQuery
+	bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, ""))
+	if cb.Message == nil {
+		return
+	}
+	callerId := cb.From.ID
+	chatId := cb.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	trid, ok := parseShareCallback(cb.Data, disputeSharePrefix)
+	if !ok {
+		return
+	}
+	tr, err := selectTransaction(trid)
+	if err != nil {
+		logE.Printf(logPrefix+"select transaction: %v", err)
+		return
+	}
+	state, err := selectShareState(trid, int64(callerId))
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+	if tr == nil || state != sharePending {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Nothing to confirm.")))
+		return
+	}
+	groupMembers, err := selectAllGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+
+	msg := tgbotapi2.NewMessage(chatId, fmt.Sprintf(disputePromptFormat, trid)+" "+
+		fmt.Sprintf(settings.tr("What is wrong with it? Reply to this message, your comment goes to %s."), groupMembers[tr.owner]))
+	msg.ReplyToMessageID = cb.Message.MessageID
+	msg.ReplyMarkup = tgbotapi2.ForceReply{ForceReply: true, Selective: true}
+	bot.Send(msg)
+}
+
+// Starts the question asking why a share is disputed, followed by
+// transaction id
+const disputePromptFormat = "✗ tr #%d."
+
+// Returns id of the transaction whose share the question is about
+func parseDisputePrompt(msg *tgbotapi2.Message) (trid int64, ok bool) {
+	if msg == nil {
+		return 0, false
+	}
+	_, err := fmt.Sscanf(msg.Text, disputePromptFormat, &trid)
+	return trid, err == nil
+}
+
+// Handles the comment given in reply to the dispute question and passes it to
+// the payer
+func disputeCommentHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "dispute comment handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+	comment := strings.TrimSpace(update.Message.Text)
+	trid, ok := parseDisputePrompt(update.Message.ReplyToMessage)
+	if !ok || len(comment) == 0 {
+		return
+	}
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	tr, err := selectTransaction(trid)
+	if err != nil || tr == nil {
+		logE.Printf(logPrefix+"select transaction %d: %v", trid, err)
+		return
+	}
+	groupMembers, err := selectAllGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+
+	at := &answerShareTask{trid: trid, memberId: int64(callerId), state: shareDisputed, comment: comment, err: make(chan error)}
+	tasksChan <- at
+	if err := <-at.err; err != nil {
+		if _, ok := err.(*errorNotAllowed); ok {
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Nothing to confirm.")))
+			return
+		}
+		logE.Printf(logPrefix+"execute answer-share task: %v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Failed to register operation")))
+		return
+	}
+
+	// Disputed share may still be accepted once the payer sorts it out
+	msg := tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Disputed: %s"), comment)+"\n"+
+		fmt.Sprintf(settings.tr("Sent to %s."), groupMembers[tr.owner]))
+	msg.ReplyMarkup = shareConfirmationKb(trid, true, settings)
+	bot.Send(msg)
+
+	if !isPlaceholder(tr.owner) {
+		bot.Send(tgbotapi2.NewMessage(tr.owner, fmt.Sprintf(settings.tr("%s disputes their share %s of tr #%d %q: %s\n/edit%d /undo%d"),
+			groupMembers[int64(callerId)], settings.money(tr.shares[int64(callerId)]), trid, tr.title, comment, trid, trid)))
+	}
+}
@@ -4,14 +4,18 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
 )
 
 func selectExpensesFromDB(uid int64, users map[int64]string) (expenses []userExpense, err error) {
 	var rows *sql.Rows
 	log.Printf("select expenses for uid=%d, users=%v", uid, users)
-	rows, err = db.Query(`SELECT T.title, O.amount, O.src, T.ts
+	rows, err = db.Query(`SELECT T.title, O.amount, O.src, T.ts, T.voided_ts IS NOT NULL
 FROM operations O, transactions T
-WHERE O.transaction_id=T.id AND O.dst=?
+WHERE O.transaction_id=T.id AND O.dst=? AND `+acceptedSharesOnly+`
 ORDER BY T.ts ASC;`, uid)
 	if err != nil {
 		err = fmt.Errorf("select user expenses: %v", err)
@@ -22,7 +26,7 @@ ORDER BY T.ts ASC;`, uid)
 	for rows.Next() {
 		var ue userExpense
 		var src int64
-		err = rows.Scan(&ue.title, &ue.amount, &src, &ue.time)
+		err = rows.Scan(&ue.title, &ue.amount, &src, &ue.time, &ue.voided)
 		if err != nil {
 			return
 		}
@@ -39,11 +43,227 @@ ORDER BY T.ts ASC;`, uid)
 	return
 }
 
+type ledgerEntry struct {
+	trid     sql.NullInt64
+	title    string
+	category string
+	time     time.Time
+	src      int64
+	dst      int64
+	amount   float64
+	voided   bool
+}
+
+// Returns all operations of user's group, repayments have no transaction;
+// shares which are pending or disputed are left out like in balances
+func selectGroupLedger(uid int) (entries []ledgerEntry, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT O.transaction_id, IFNULL(T.title, ''), IFNULL(C.name, ''), T.ts, O.src, O.dst, O.amount, T.voided_ts IS NOT NULL
+FROM operations O LEFT JOIN transactions T ON O.transaction_id=T.id LEFT JOIN categories C ON C.id=T.category_id
+WHERE O.src IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?)) AND `+acceptedSharesOnly+`
+ORDER BY O.id ASC;`, uid)
+	if err != nil {
+		err = fmt.Errorf("select group ledger: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e ledgerEntry
+		var ts *time.Time
+		if err = rows.Scan(&e.trid, &e.title, &e.category, &ts, &e.src, &e.dst, &e.amount, &e.voided); err != nil {
+			err = fmt.Errorf("scan ledger entry: %v", err)
+			return
+		}
+		if ts != nil {
+			e.time = *ts
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+type transactionInfo struct {
+	id         int64
+	title      string
+	amount     float64
+	time       time.Time
+	owner      int64
+	voided     bool
+	category   string
+	hasReceipt bool
+	hasItems   bool
+	shares     map[int64]float64 // amount charged to every participant
+}
+
+func selectTransaction(trid int64) (t *transactionInfo, err error) {
+	t = &transactionInfo{id: trid}
+	err = db.QueryRow(`SELECT title, IFNULL(amount, 0), ts, owner_id, voided_ts IS NOT NULL FROM transactions WHERE id=?`, trid).
+		Scan(&t.title, &t.amount, &t.time, &t.owner, &t.voided)
+	if err != nil {
+		t = nil
+		if err != sql.ErrNoRows {
+			err = fmt.Errorf("select transaction %d: %v", trid, err)
+		}
+		return
+	}
+	t.shares, err = selectTransactionShares(trid)
+	return
+}
+
+// Checks that transaction belongs to caller's group which is not archived and
+// that group edit policy lets caller change it
+func canModifyTransaction(trid int64, callerId int) (bool, error) {
+	var ownerId int64
+	var callerIsLeader bool
+	err := db.QueryRow(`SELECT T.owner_id, C.is_leader FROM transactions T, users O, users C
+WHERE T.id=? AND O.id=T.owner_id AND C.id=? AND O.group_id=C.group_id`, trid, callerId).Scan(&ownerId, &callerIsLeader)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("select transaction %d in caller group: %v", trid, err)
+	}
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		return false, err
+	}
+	return !settings.archived && settings.canModify(int64(callerId), ownerId, callerIsLeader), nil
+}
+
+// Restricts transactions listed by selectGroupTransactions, zero values match
+// everything; amount bounds apply only when set, since zero is a valid bound
+type transactionFilter struct {
+	payer        int64
+	participant  int64
+	involving    int64 // payer or participant
+	text         string
+	from         time.Time
+	to           time.Time
+	minAmount    float64
+	hasMinAmount bool
+	maxAmount    float64
+	hasMaxAmount bool
+}
+
+type transactionsSummary struct {
+	count int
+	sum   float64 // total of matching transactions which are not voided
+}
+
+// Returns a page of transactions of user's group newest first along with the
+// summary of all matching transactions
+func selectGroupTransactions(uid int, filter transactionFilter, offset, limit int) (entries []transactionInfo, summary transactionsSummary, err error) {
+	conds := []string{`T.owner_id IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?))`}
+	args := []interface{}{uid}
+	if filter.payer != 0 {
+		conds = append(conds, `T.owner_id=?`)
+		args = append(args, filter.payer)
+	}
+	if filter.participant != 0 {
+		conds = append(conds, `EXISTS (SELECT 1 FROM operations O WHERE O.transaction_id=T.id AND O.dst=?)`)
+		args = append(args, filter.participant)
+	}
+	if filter.involving != 0 {
+		conds = append(conds, `(T.owner_id=? OR EXISTS (SELECT 1 FROM operations O WHERE O.transaction_id=T.id AND O.dst=?))`)
+		args = append(args, filter.involving, filter.involving)
+	}
+	if len(filter.text) != 0 {
+		conds = append(conds, `T.title LIKE ? ESCAPE '\'`)
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(filter.text)
+		args = append(args, "%"+escaped+"%")
+	}
+	if !filter.from.IsZero() {
+		conds = append(conds, `T.ts>=?`)
+		args = append(args, filter.from.UTC())
+	}
+	if !filter.to.IsZero() {
+		conds = append(conds, `T.ts<?`)
+		args = append(args, filter.to.UTC())
+	}
+	if filter.hasMinAmount {
+		conds = append(conds, `T.amount>?`)
+		args = append(args, filter.minAmount)
+	}
+	if filter.hasMaxAmount {
+		conds = append(conds, `T.amount<?`)
+		args = append(args, filter.maxAmount)
+	}
+	where := strings.Join(conds, " AND ")
+
+	if err = db.QueryRow(`SELECT COUNT(*), IFNULL(SUM(CASE WHEN T.voided_ts IS NULL THEN T.amount END), 0)
+FROM transactions T WHERE `+where, args...).Scan(&summary.count, &summary.sum); err != nil {
+		err = fmt.Errorf("count group transactions: %v", err)
+		return
+	}
+
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT T.id, T.title, IFNULL(T.amount, 0), T.ts, T.owner_id, T.voided_ts IS NOT NULL,
+IFNULL((SELECT C.name FROM categories C WHERE C.id=T.category_id), ''), T.receipt_file_id IS NOT NULL,
+EXISTS (SELECT 1 FROM transaction_items I WHERE I.transaction_id=T.id)
+FROM transactions T WHERE `+where+`
+ORDER BY T.ts DESC, T.id DESC LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		err = fmt.Errorf("select group transactions: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e transactionInfo
+		if err = rows.Scan(&e.id, &e.title, &e.amount, &e.time, &e.owner, &e.voided, &e.category, &e.hasReceipt, &e.hasItems); err != nil {
+			err = fmt.Errorf("scan transaction: %v", err)
+			return
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+
+	for i := range entries {
+		if entries[i].shares, err = selectTransactionShares(entries[i].id); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Returns receipt of transaction if it belongs to caller's group
+func selectReceipt(trid int64, callerId int) (fileId, path string, err error) {
+	err = db.QueryRow(`SELECT IFNULL(T.receipt_file_id, ''), IFNULL(T.receipt_path, '') FROM transactions T, users O, users C
+WHERE T.id=? AND O.id=T.owner_id AND C.id=? AND O.group_id=C.group_id`, trid, callerId).Scan(&fileId, &path)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("select receipt of transaction %d: %v", trid, err)
+	}
+	return
+}
+
+func selectTransactionShares(trid int64) (shares map[int64]float64, err error) {
+	shares = make(map[int64]float64)
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT dst, amount FROM operations WHERE transaction_id=?`, trid)
+	if err != nil {
+		err = fmt.Errorf("select transaction operations: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dst int64
+		var amount float64
+		if err = rows.Scan(&dst, &amount); err != nil {
+			err = fmt.Errorf("scan transaction operation: %v", err)
+			return
+		}
+		shares[dst] += amount
+	}
+	return
+}
+
 func calcDebt(uid int, debt *float64) error {
 	logPrefix := "calculate debt: "
 	var rows *sql.Rows
-	rows, err := db.Query(`SELECT SUM(O.amount) FROM operations O
-WHERE O.src=? AND O.dst!=?`, uid, uid)
+	rows, err := db.Query(`SELECT SUM(O.amount) FROM operations O LEFT JOIN transactions T ON O.transaction_id=T.id
+WHERE O.src=? AND O.dst!=? AND T.voided_ts IS NULL AND `+acceptedSharesOnly, uid, uid)
 	if err != nil {
 		return fmt.Errorf(logPrefix+"select sum of payments: %v", err)
 	}
@@ -57,8 +277,8 @@ WHERE O.src=? AND O.dst!=?`, uid, uid)
 	rows.Close()
 	logD.Printf(logPrefix+"+%.2f", plus)
 
-	rows, err = db.Query(`SELECT SUM(O.amount) FROM operations O
-WHERE O.dst=? AND O.src!=?`, uid, uid)
+	rows, err = db.Query(`SELECT SUM(O.amount) FROM operations O LEFT JOIN transactions T ON O.transaction_id=T.id
+WHERE O.dst=? AND O.src!=? AND T.voided_ts IS NULL AND `+acceptedSharesOnly, uid, uid)
 	if err != nil {
 		return fmt.Errorf(logPrefix+"select sum of debts: %v", err)
 	}
@@ -76,24 +296,161 @@ WHERE O.dst=? AND O.src!=?`, uid, uid)
 	return nil
 }
 
+// Calculates how much debtor owes creditor, negative when creditor owes
+func calcPairDebt(debtor, creditor int, debt *float64) error {
+	err := db.QueryRow(`SELECT COALESCE(SUM(CASE WHEN O.src=? THEN O.amount ELSE -O.amount END), 0)
+FROM operations O LEFT JOIN transactions T ON O.transaction_id=T.id
+WHERE ((O.src=? AND O.dst=?) OR (O.src=? AND O.dst=?)) AND T.voided_ts IS NULL AND `+acceptedSharesOnly,
+		creditor, creditor, debtor, debtor, creditor).Scan(debt)
+	if err != nil {
+		return fmt.Errorf("calculate pair debt: %v", err)
+	}
+	*debt = math.Round(*debt*100) / 100
+	return nil
+}
+
+// Calculates how much the debt of uid grew in [from, to) through expenses
+// dated and repayments entered in the period
+func calcBalanceChange(uid int, from, to time.Time, change *float64) error {
+	err := db.QueryRow(`SELECT COALESCE(SUM(CASE WHEN O.dst=? THEN O.amount ELSE -O.amount END), 0)
+FROM operations O LEFT JOIN transactions T ON O.transaction_id=T.id LEFT JOIN repayments R ON R.operation_id=O.id
+WHERE (O.src=? OR O.dst=?) AND O.src!=O.dst AND T.voided_ts IS NULL AND `+acceptedSharesOnly+`
+AND ((T.ts>=? AND T.ts<?) OR (R.created_ts>=? AND R.created_ts<?))`,
+		uid, uid, uid, from.UTC(), to.UTC(), from.UTC(), to.UTC()).Scan(change)
+	if err != nil {
+		return fmt.Errorf("calculate balance change: %v", err)
+	}
+	return nil
+}
+
+type member struct {
+	id       int64
+	name     string
+	nickname string
+	username string
+	active   bool
+}
+
+// Returns unambiguous display names of active members of user's group
 func selectGroupMembers(user int) (groupMembers map[int64]string, err error) {
+	members, err := selectGroupMemberList(user)
+	if err != nil {
+		return
+	}
+	names := displayNames(members)
 	groupMembers = make(map[int64]string)
+	for _, m := range members {
+		if m.active {
+			groupMembers[m.id] = names[m.id]
+		}
+	}
+	return
+}
+
+// Same as selectGroupMembers but also includes members who left the group,
+// which is needed to name everyone in the group history
+func selectAllGroupMembers(user int) (groupMembers map[int64]string, err error) {
+	members, err := selectGroupMemberList(user)
+	if err != nil {
+		return
+	}
+	groupMembers = displayNames(members)
+	return
+}
+
+func selectGroupMemberList(user int) (members []member, err error) {
 	var rows *sql.Rows
-	rows, err = db.Query(`SELECT id, name FROM users
-WHERE group_id=(SELECT group_id FROM users WHERE id=?);`, user)
+	rows, err = db.Query(`SELECT id, name, IFNULL(nickname, ''), IFNULL(username, ''), is_active FROM users
+WHERE group_id=(SELECT group_id FROM users WHERE id=?)
+ORDER BY id;`, user)
 	if err != nil {
 		err = fmt.Errorf("select same group members: %v", err)
 		return
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var uid int64
-		var name string
-		err = rows.Scan(&uid, &name)
+		var m member
+		err = rows.Scan(&m.id, &m.name, &m.nickname, &m.username, &m.active)
 		if err != nil {
 			break
 		}
-		groupMembers[uid] = name
+		members = append(members, m)
+	}
+	return
+}
+
+// Builds display names preferring nicknames; members sharing the same name get
+// their Telegram username or an ordinal appended
+func displayNames(members []member) map[int64]string {
+	base := make(map[int64]string)
+	count := make(map[string]int)
+	for _, m := range members {
+		name := m.name
+		if len(m.nickname) != 0 {
+			name = m.nickname
+		}
+		base[m.id] = name
+		count[strings.ToLower(name)]++
+	}
+
+	names := make(map[int64]string)
+	taken := make(map[string]bool)
+	ordinal := make(map[string]int)
+	for _, m := range members {
+		name := base[m.id]
+		key := strings.ToLower(name)
+		if count[key] > 1 {
+			if len(m.username) != 0 && !strings.Contains(name, m.username) {
+				name += " @" + m.username
+			} else {
+				ordinal[key]++
+				name += fmt.Sprintf(" #%d", ordinal[key])
+			}
+		}
+		for taken[strings.ToLower(name)] {
+			name += "'"
+		}
+		taken[strings.ToLower(name)] = true
+		names[m.id] = name
+	}
+	return names
+}
+
+// Returns member ids ordered by display name to keep keyboards stable
+func sortedMemberIds(groupMembers map[int64]string) []int64 {
+	var ids []int64
+	for uid := range groupMembers {
+		ids = append(ids, uid)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return strings.ToLower(groupMembers[ids[i]]) < strings.ToLower(groupMembers[ids[j]])
+	})
+	return ids
+}
+
+func selectGroupLeaders(user int) (leaders []int64, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT id FROM users
+WHERE group_id=(SELECT group_id FROM users WHERE id=?) AND is_leader=1 AND is_active=1;`, user)
+	if err != nil {
+		err = fmt.Errorf("select group leaders: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid int64
+		if err = rows.Scan(&uid); err != nil {
+			return
+		}
+		leaders = append(leaders, uid)
+	}
+	return
+}
+
+func isGroupLeader(uid int) (isLeader bool, err error) {
+	err = db.QueryRow(`SELECT is_leader FROM users WHERE id=?`, uid).Scan(&isLeader)
+	if err == sql.ErrNoRows {
+		err = nil
 	}
 	return
 }
@@ -116,3 +473,219 @@ WHERE U.group_id=G.id AND U.id=?`, uid)
 	}
 	return
 }
+
+func createTables() error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS groups (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+name TEXT NOT NULL,
+create_ts TIMESTAMP NOT NULL,
+invite TEXT NOT NULL UNIQUE);`,
+		`CREATE TABLE IF NOT EXISTS users (
+id INTEGER PRIMARY KEY,
+name TEXT NOT NULL,
+group_id INTEGER REFERENCES groups(id),
+is_leader BOOLEAN NOT NULL DEFAULT 0);`,
+		`CREATE TABLE IF NOT EXISTS transactions (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+title TEXT NOT NULL,
+ts TIMESTAMP NOT NULL,
+owner_id INTEGER NOT NULL);`,
+		`CREATE TABLE IF NOT EXISTS operations (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+src INTEGER NOT NULL,
+dst INTEGER NOT NULL,
+amount REAL NOT NULL,
+transaction_id INTEGER REFERENCES transactions(id));`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("exec %q: %v", stmt, err)
+		}
+	}
+	return nil
+}
+
+// Schema changes applied on top of the tables created by createTables. The
+// index of the last applied migration plus one is kept in sqlite user_version,
+// so new migrations must only be appended.
+var migrations = []string{
+	`ALTER TABLE users ADD COLUMN claim_code TEXT;`,
+	`ALTER TABLE users ADD COLUMN nickname TEXT;`,
+	`ALTER TABLE users ADD COLUMN username TEXT;`,
+	`ALTER TABLE groups ADD COLUMN currency TEXT NOT NULL DEFAULT '€';`,
+	`ALTER TABLE groups ADD COLUMN timezone TEXT NOT NULL DEFAULT 'Local';`,
+	`ALTER TABLE groups ADD COLUMN language TEXT NOT NULL DEFAULT 'en';`,
+	`ALTER TABLE groups ADD COLUMN date_format TEXT NOT NULL DEFAULT '02/01/2006 15:04:05';`,
+	`ALTER TABLE groups ADD COLUMN split_mode TEXT NOT NULL DEFAULT 'equal';`,
+	`ALTER TABLE groups ADD COLUMN edit_policy TEXT NOT NULL DEFAULT 'payer_or_leader';`,
+	`ALTER TABLE users ADD COLUMN is_active BOOLEAN NOT NULL DEFAULT 1;`,
+	`ALTER TABLE users ADD COLUMN leave_requested_ts TIMESTAMP;`,
+	`ALTER TABLE groups ADD COLUMN archived_ts TIMESTAMP;`,
+	`ALTER TABLE transactions ADD COLUMN amount REAL;`,
+	`UPDATE transactions SET amount=(SELECT SUM(O.amount) FROM operations O WHERE O.transaction_id=transactions.id);`,
+	`CREATE TABLE transaction_revisions (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+title TEXT NOT NULL,
+amount REAL,
+ts TIMESTAMP NOT NULL,
+owner_id INTEGER NOT NULL,
+operations TEXT NOT NULL,
+edited_by INTEGER NOT NULL,
+edited_ts TIMESTAMP NOT NULL);`,
+	`ALTER TABLE transactions ADD COLUMN voided_ts TIMESTAMP;`,
+	`ALTER TABLE transactions ADD COLUMN voided_by INTEGER;`,
+	`CREATE INDEX IF NOT EXISTS transactions_owner_ts ON transactions (owner_id, ts);`,
+	`CREATE INDEX IF NOT EXISTS transactions_ts ON transactions (ts);`,
+	`CREATE INDEX IF NOT EXISTS operations_transaction ON operations (transaction_id);`,
+	`CREATE INDEX IF NOT EXISTS operations_src ON operations (src);`,
+	`CREATE INDEX IF NOT EXISTS operations_dst ON operations (dst);`,
+	`CREATE INDEX IF NOT EXISTS users_group ON users (group_id);`,
+	`CREATE TABLE categories (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+group_id INTEGER NOT NULL REFERENCES groups(id),
+name TEXT NOT NULL,
+UNIQUE (group_id, name));`,
+	`ALTER TABLE transactions ADD COLUMN category_id INTEGER REFERENCES categories(id);`,
+	`INSERT INTO categories (group_id, name) SELECT G.id, C.name FROM groups G,
+(SELECT 'Groceries' AS name UNION ALL SELECT 'Rent' UNION ALL SELECT 'Utilities' UNION ALL SELECT 'Transport'
+UNION ALL SELECT 'Eating out' UNION ALL SELECT 'Entertainment' UNION ALL SELECT 'Other') C;`,
+	`CREATE TABLE recurring (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+owner_id INTEGER NOT NULL,
+title TEXT NOT NULL,
+amount REAL NOT NULL,
+category_id INTEGER REFERENCES categories(id),
+schedule TEXT NOT NULL,
+schedule_day INTEGER NOT NULL,
+schedule_month INTEGER NOT NULL DEFAULT 0,
+next_ts TIMESTAMP NOT NULL,
+next_amount REAL);`,
+	`CREATE TABLE recurring_shares (
+recurring_id INTEGER NOT NULL REFERENCES recurring(id),
+member_id INTEGER NOT NULL,
+weight REAL NOT NULL,
+PRIMARY KEY (recurring_id, member_id));`,
+	`CREATE INDEX IF NOT EXISTS recurring_next ON recurring (next_ts);`,
+	`ALTER TABLE transactions ADD COLUMN receipt_file_id TEXT;`,
+	`ALTER TABLE transactions ADD COLUMN receipt_path TEXT;`,
+	`CREATE TABLE transaction_items (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+name TEXT NOT NULL,
+amount REAL NOT NULL,
+extra BOOLEAN NOT NULL DEFAULT 0);`,
+	`CREATE TABLE transaction_item_shares (
+item_id INTEGER NOT NULL REFERENCES transaction_items(id),
+member_id INTEGER NOT NULL,
+PRIMARY KEY (item_id, member_id));`,
+	`CREATE INDEX IF NOT EXISTS transaction_items_transaction ON transaction_items (transaction_id);`,
+	`CREATE TABLE notification_prefs (
+member_id INTEGER NOT NULL,
+group_id INTEGER NOT NULL REFERENCES groups(id),
+mode TEXT NOT NULL,
+PRIMARY KEY (member_id, group_id));`,
+	`CREATE TABLE queued_notifications (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+member_id INTEGER NOT NULL,
+group_id INTEGER NOT NULL REFERENCES groups(id),
+text TEXT NOT NULL,
+created_ts TIMESTAMP NOT NULL);`,
+	`ALTER TABLE groups ADD COLUMN approval TEXT NOT NULL DEFAULT 'none';`,
+	`ALTER TABLE groups ADD COLUMN auto_accept_hours INTEGER NOT NULL DEFAULT 48;`,
+	`CREATE TABLE share_confirmations (
+transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+member_id INTEGER NOT NULL,
+state TEXT NOT NULL,
+comment TEXT,
+created_ts TIMESTAMP NOT NULL,
+PRIMARY KEY (transaction_id, member_id));`,
+	`CREATE INDEX IF NOT EXISTS share_confirmations_state ON share_confirmations (state);`,
+	`CREATE TABLE repayments (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+src INTEGER NOT NULL,
+dst INTEGER NOT NULL,
+amount REAL NOT NULL,
+state TEXT NOT NULL,
+created_ts TIMESTAMP NOT NULL,
+reminded_ts TIMESTAMP,
+operation_id INTEGER REFERENCES operations(id));`,
+	`CREATE TABLE payment_requests (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+creditor_id INTEGER NOT NULL,
+debtor_id INTEGER NOT NULL,
+amount REAL NOT NULL,
+state TEXT NOT NULL,
+created_ts TIMESTAMP NOT NULL,
+repayment_id INTEGER REFERENCES repayments(id));`,
+	`ALTER TABLE groups ADD COLUMN reminder_schedule TEXT NOT NULL DEFAULT 'off';`,
+	`ALTER TABLE groups ADD COLUMN reminder_threshold REAL NOT NULL DEFAULT 10;`,
+	`ALTER TABLE groups ADD COLUMN quiet_hours TEXT NOT NULL DEFAULT '22-9';`,
+	`CREATE TABLE balance_reminders (
+member_id INTEGER NOT NULL REFERENCES users(id),
+group_id INTEGER NOT NULL REFERENCES groups(id),
+checked_ts TIMESTAMP,
+snoozed_until TIMESTAMP,
+PRIMARY KEY (member_id, group_id));`,
+	`CREATE TABLE budgets (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+group_id INTEGER NOT NULL REFERENCES groups(id),
+category_id INTEGER REFERENCES categories(id),
+amount REAL NOT NULL,
+period TEXT NOT NULL,
+from_ts TIMESTAMP,
+to_ts TIMESTAMP,
+alert_level INTEGER NOT NULL DEFAULT 0,
+alert_period_ts TIMESTAMP);`,
+	`ALTER TABLE groups ADD COLUMN summary_schedule TEXT NOT NULL DEFAULT 'off';`,
+	`ALTER TABLE groups ADD COLUMN summary_sections TEXT NOT NULL DEFAULT 'total,categories,biggest,members,balances,settleup';`,
+	`ALTER TABLE groups ADD COLUMN summary_sent_ts TIMESTAMP;`,
+	utcTimestamps("groups", "create_ts", "archived_ts", "summary_sent_ts"),
+	utcTimestamps("users", "leave_requested_ts"),
+	utcTimestamps("transactions", "ts", "voided_ts"),
+	utcTimestamps("transaction_revisions", "ts", "edited_ts"),
+	utcTimestamps("recurring", "next_ts"),
+	utcTimestamps("queued_notifications", "created_ts"),
+	utcTimestamps("share_confirmations", "created_ts"),
+	utcTimestamps("repayments", "created_ts", "reminded_ts"),
+	utcTimestamps("payment_requests", "created_ts"),
+	utcTimestamps("balance_reminders", "checked_ts", "snoozed_until"),
+	utcTimestamps("budgets", "from_ts", "to_ts", "alert_period_ts"),
+	`ALTER TABLE groups ADD COLUMN reset_policy TEXT NOT NULL DEFAULT 'leader';`,
+}
+
+// Timestamps are stored in UTC, which is how the driver writes a UTC time,
+// so that columns compare as strings and indexes on them work. Returns the
+// migration rewriting older values entered with the server offset.
+func utcTimestamps(table string, columns ...string) string {
+	var sets []string
+	for _, c := range columns {
+		// Fraction is trimmed of trailing zeros like the driver does
+		sets = append(sets, fmt.Sprintf(`%[1]s=COALESCE(rtrim(rtrim(strftime('%%Y-%%m-%%d %%H:%%M:%%f', %[1]s), '0'), '.')||'+00:00', %[1]s)`, c))
+	}
+	return fmt.Sprintf(`UPDATE %s SET %s;`, table, strings.Join(sets, ", "))
+}
+
+func migrateTables() error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version;`).Scan(&version); err != nil {
+		return fmt.Errorf("get schema version: %v", err)
+	}
+	for ; version < len(migrations); version++ {
+		logI.Printf("applying migration #%d", version+1)
+		if _, err := db.Exec(migrations[version]); err != nil {
+			return fmt.Errorf("apply migration #%d: %v", version+1, err)
+		}
+		if _, err := db.Exec(fmt.Sprintf(`PRAGMA user_version=%d;`, version+1)); err != nil {
+			return fmt.Errorf("set schema version: %v", err)
+		}
+	}
+	return nil
+}
+
+// Placeholder members have no Telegram account, so they get negative ids which
+// never clash with Telegram user ids
+func isPlaceholder(uid int64) bool {
+	return uid < 0
+}
@@ -1,8 +1,29 @@
 package main
 
+import "fmt"
+
 type errorNotAllowed struct {
 }
 
 func (ena errorNotAllowed) Error() string {
 	return "not allowed"
 }
+
+type errorOpenBalance struct {
+	debt float64
+}
+
+func (eob errorOpenBalance) Error() string {
+	return fmt.Sprintf("open balance %.2f", eob.debt)
+}
+
+// Points at the argument of a one-line command which could not be parsed
+type errorBadToken struct {
+	pos    int // index of the token among arguments
+	token  string
+	reason string
+}
+
+func (ebt errorBadToken) Error() string {
+	return fmt.Sprintf("%q: %s", ebt.token, ebt.reason)
+}
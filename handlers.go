@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
 	"fmt"
-	"log"
+	"math"
+	"os"
 	"time"
 
 	"sort"
 	"strconv"
+	"strings"
 
 	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/satori/go.uuid"
@@ -71,6 +75,15 @@ S:
 				bot.Send(tgbotapi2.NewMessage(chatId, "Aborted."))
 				goto S
 			}
+			if claim := parseClaimCode(r.msg.Text); len(claim) != 0 {
+				if err := claimPlaceholder(callerId, callerName, claim, tasksChan); err != nil {
+					logE.Printf(logPrefix+"execute claim task: %v", err)
+					bot.Send(tgbotapi2.NewMessage(chatId, "Failed to claim member."))
+					return
+				}
+				bot.Send(tgbotapi2.NewMessage(chatId, "You successfully joined group!"))
+				return
+			}
 			invite := parseInviteCode(r.msg.Text)
 			if len(invite) != 0 {
 				errChan := make(chan error)
@@ -113,40 +126,376 @@ S:
 }
 
 func leaveGroupHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, botName string, replyChan <-chan reply, tasksChan chan<- task) {
-	logPrefix := "leavegroup handler"
+	logPrefix := "leavegroup handler: "
 
 	callerId := update.Message.From.ID
 	callerName := username(update.Message.From)
 	chatId := update.Message.Chat.ID
 
-	// Ask for confirmation
-	confirmRequest := newAbortableMsg(chatId, `Are you sure you want to leave the group? Type "yes"`)
-	bot.Send(confirmRequest)
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	var debt float64
+	if err := calcDebt(callerId, &debt); err != nil {
+		logE.Printf(logPrefix+"calculate debt: %v", err)
+		return
+	}
+
+	var leaveTask *leaveGroupTask
+	var replyTo int
+	if math.Abs(debt) < balanceEpsilon {
+		// Ask for confirmation
+		confirmRequest := newAbortableMsg(chatId, `Are you sure you want to leave the group? Type "yes"`)
+		bot.Send(confirmRequest)
+
+		// Parse answer
+		r := <-replyChan
+		if isAbort(r) {
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return
+		}
+		if r.msg == nil {
+			return
+		}
+		if r.msg.Text != "yes" {
+			return
+		}
+		leaveTask = &leaveGroupTask{userId: callerId, mode: leaveSettled}
+		replyTo = r.msg.MessageID
+	} else {
+		// Member with open balance must decide what happens to it
+		const (
+			choiceSettle   = "Settle first"
+			choiceTransfer = "Transfer balance to another member"
+			choiceWriteOff = "Ask leader to write it off"
+		)
+		kb := tgbotapi2.NewInlineKeyboardMarkup(
+			tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(choiceSettle, choiceSettle)),
+			tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(choiceTransfer, choiceTransfer)),
+			tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(choiceWriteOff, choiceWriteOff)),
+		)
+		msg := newAbortableMsg(chatId, debtMessage(settings, debt)+". Your balance must be settled before leaving the group.")
+		msg.ReplyMarkup = kb
+		sent, _ := bot.Send(msg)
+
+		r := <-replyChan
+		if isAbort(r) || r.cb == nil {
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return
+		}
+		replyTo = sent.MessageID
+
+		switch r.cb.Data {
+		case choiceSettle:
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID,
+				"Use /igive to pay back your debts or ask members who owe you to do so, then /leavegroup again."))
+			return
+		case choiceTransfer:
+			groupMembers, err := selectGroupMembers(callerId)
+			if err != nil {
+				logE.Printf(logPrefix+"select group members: %v", err)
+				return
+			}
+			var userButtons [][]tgbotapi2.InlineKeyboardButton
+			for _, uid := range sortedMemberIds(groupMembers) {
+				if uid == int64(callerId) {
+					continue
+				}
+				userButtons = append(userButtons, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(groupMembers[uid], strconv.FormatInt(uid, 10))))
+			}
+			edit := newAbortableEditMsg(chatId, sent.MessageID, "Who takes over your balance?")
+			memberKb := tgbotapi2.NewInlineKeyboardMarkup(userButtons...)
+			edit.ReplyMarkup = &memberKb
+			bot.Send(edit)
+
+			r = <-replyChan
+			if isAbort(r) || r.cb == nil {
+				bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
+				bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+				return
+			}
+			transferTo, err := strconv.ParseInt(r.cb.Data, 10, 64)
+			if err != nil {
+				logI.Printf(logPrefix+"selected: %q", r.cb.Data)
+				return
+			}
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID,
+				fmt.Sprintf("Your balance goes to %s.", groupMembers[transferTo])))
+			leaveTask = &leaveGroupTask{userId: callerId, mode: leaveTransfer, transferTo: transferTo}
+		case choiceWriteOff:
+			// Leaders cannot approve writing off their own balance
+			groupLeaders, err := selectGroupLeaders(callerId)
+			if err != nil {
+				logE.Printf(logPrefix+"select group leaders: %v", err)
+				return
+			}
+			var leaders []int64
+			for _, leader := range groupLeaders {
+				if leader != int64(callerId) {
+					leaders = append(leaders, leader)
+				}
+			}
+			if len(leaders) == 0 {
+				bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID,
+					"There is no other leader to approve the write-off. Settle or transfer your balance instead."))
+				return
+			}
+			errChan := make(chan error)
+			tasksChan <- &leaveGroupTask{userId: callerId, mode: leaveRequestWriteOff, err: errChan}
+			if err := <-errChan; err != nil {
+				logE.Printf(logPrefix+"execute request-leave task: %v", err)
+				return
+			}
+			groupMembers, err := selectGroupMembers(callerId)
+			if err != nil {
+				logE.Printf(logPrefix+"select group members: %v", err)
+				return
+			}
+			for _, leader := range leaders {
+				bot.Send(tgbotapi2.NewMessage(leader, fmt.Sprintf("%s wants to leave the group with balance %s. /approveleave%d to write it off.",
+					groupMembers[int64(callerId)], settings.money(-debt), callerId)))
+			}
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID,
+				"I asked your group leader to approve the write-off. You will leave the group once it is approved."))
+			return
+		default:
+			return
+		}
+	}
+
+	// Put new task into queue
+	errChan := make(chan error)
+	leaveTask.err = errChan
+	tasksChan <- leaveTask
+	err = <-errChan
+	if err != nil {
+		if _, ok := err.(*errorOpenBalance); ok {
+			bot.Send(tgbotapi2.NewMessage(chatId, "Your balance changed meanwhile. Try /leavegroup again."))
+			return
+		}
+		logE.Printf(logPrefix+"execute leave-group task: %v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, "Failed to leave the group."))
+		return
+	}
+	bot.Send(tgbotapi2.NewMessage(chatId, "You left the group."))
+
+	handleUserWithoutGroup(callerId, callerName, chatId, replyTo, bot, botName, replyChan, tasksChan, logPrefix)
+}
+
+func approveLeaveHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "approveleave handler: "
+
+	chatId := update.Message.Chat.ID
+	callerId := update.Message.From.ID
+	approveCommand := "approveleave"
+	uid, err := strconv.Atoi(update.Message.Text[1+len(approveCommand):])
+	if err != nil {
+		bot.Send(tgbotapi2.NewMessage(chatId, "Invalid member index."))
+		return
+	}
+
+	errChan := make(chan error)
+	tasksChan <- &leaveGroupTask{userId: uid, mode: leaveWriteOff, approverId: callerId, err: errChan}
+	if err = <-errChan; err != nil {
+		if _, ok := err.(*errorNotAllowed); ok {
+			bot.Send(tgbotapi2.NewMessage(chatId, "You are not allowed to approve this."))
+			return
+		}
+		logE.Printf(logPrefix+"execute leave-group task: %v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, "Failed to write off the balance."))
+		return
+	}
+	bot.Send(tgbotapi2.NewMessage(chatId, "Done. The balance was split among remaining members."))
+	bot.Send(tgbotapi2.NewMessage(int64(uid), "Your balance was written off and you left the group. Use /start to join another one."))
+}
+
+func addMemberHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, botName string, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "addmember handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	g, err := getUserGroup(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get user group: %v", err)
+		return
+	}
+	if g == nil {
+		bot.Send(tgbotapi2.NewMessage(chatId, notInGroupMessage))
+		return
+	}
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	if isReadOnly(settings, chatId, bot) {
+		return
+	}
 
-	// Parse answer
+	// Ask for name
+	bot.Send(newAbortableMsg(chatId, "Enter name of the member without Telegram account."))
 	r := <-replyChan
 	if isAbort(r) {
 		bot.Send(tgbotapi2.NewMessage(chatId, "Aborted."))
 		return
 	}
-	if r.msg == nil {
+	if r.msg == nil || len(r.msg.Text) == 0 {
 		return
 	}
-	if r.msg.Text != "yes" {
+	name := r.msg.Text
+
+	claimCode, err := uuid.NewV4()
+	if err != nil {
+		logE.Printf(logPrefix+"generate uuid for claim code: %v", err)
 		return
 	}
 
-	// Put new task into queue
 	errChan := make(chan error)
-	tasksChan <- &leaveGroupTask{callerId, errChan}
-	err := <-errChan
+	tasksChan <- &addPlaceholderTask{callerId, name, claimCode.String(), errChan}
+	if err = <-errChan; err != nil {
+		logE.Printf(logPrefix+"execute add-placeholder task: %v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, "Failed to add member."))
+		return
+	}
+
+	bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf("%s added. If %s ever joins Telegram, forward the message below to take over the history:", name, name)))
+	claimMsg := tgbotapi2.NewMessage(chatId,
+		fmt.Sprintf("This message lets you claim member %q of group %q (MBC-%s). Just forward it to @%s.", name, g.name, claimCode.String(), botName))
+	bot.Send(claimMsg)
+}
+
+func claimHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "claim handler: "
+
+	callerId := update.Message.From.ID
+	callerName := username(update.Message.From)
+	chatId := update.Message.Chat.ID
+
+	bot.Send(newAbortableMsg(chatId, "Forward me the claim message you received."))
+	for r := range replyChan {
+		if isAbort(r) {
+			bot.Send(tgbotapi2.NewMessage(chatId, "Aborted."))
+			return
+		}
+		if r.msg == nil {
+			continue
+		}
+		claim := parseClaimCode(r.msg.Text)
+		if len(claim) == 0 {
+			bot.Send(tgbotapi2.NewMessage(chatId, "Wrong message."))
+			continue
+		}
+		err := claimPlaceholder(callerId, callerName, claim, tasksChan)
+		if err != nil {
+			if _, ok := err.(*errorNotAllowed); ok {
+				bot.Send(tgbotapi2.NewMessage(chatId, "This member belongs to another group. Leave your group first."))
+				return
+			}
+			logE.Printf(logPrefix+"execute claim task: %v", err)
+			bot.Send(tgbotapi2.NewMessage(chatId, "Failed to claim member."))
+			return
+		}
+		var debt float64
+		if err := calcDebt(callerId, &debt); err != nil {
+			logE.Printf(logPrefix+"calculate debt: %v", err)
+			return
+		}
+		settings, err := getUserSettings(callerId)
+		if err != nil {
+			logE.Printf(logPrefix+"get settings: %v", err)
+			return
+		}
+		bot.Send(tgbotapi2.NewMessage(chatId, "Done. "+debtMessage(settings, debt)))
+		return
+	}
+}
+
+func claimPlaceholder(callerId int, callerName string, claimCode string, tasksChan chan<- task) error {
+	errChan := make(chan error)
+	tasksChan <- &claimPlaceholderTask{callerId, callerName, claimCode, errChan}
+	return <-errChan
+}
+
+func nickHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "nick handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	groupMembers, err := selectGroupMembers(callerId)
 	if err != nil {
-		logE.Printf(logPrefix+"execute leave-group task: %v", err)
+		logE.Printf(logPrefix+"select group members: %v", err)
 		return
 	}
-	bot.Send(tgbotapi2.NewMessage(chatId, "You left the group."))
+	isLeader, err := isGroupLeader(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"check leader: %v", err)
+		return
+	}
+
+	// Members may rename themselves and placeholders, leaders may rename anyone
+	var userButtons [][]tgbotapi2.InlineKeyboardButton
+	for _, uid := range sortedMemberIds(groupMembers) {
+		if !isLeader && uid != int64(callerId) && !isPlaceholder(uid) {
+			continue
+		}
+		userButtons = append(userButtons, []tgbotapi2.InlineKeyboardButton{tgbotapi2.NewInlineKeyboardButtonData(groupMembers[uid], strconv.Itoa(int(uid)))})
+	}
+	if len(userButtons) == 0 {
+		bot.Send(tgbotapi2.NewMessage(chatId, notInGroupMessage))
+		return
+	}
+
+	msgWho := newAbortableMsg(chatId, "Whose nickname would you like to set?")
+	msgWho.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(userButtons...)
+	sent, _ := bot.Send(msgWho)
+
+	r := <-replyChan
+	if isAbort(r) {
+		bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
+		bot.Send(tgbotapi2.NewMessage(chatId, "Aborted."))
+		return
+	}
+	if r.cb == nil {
+		return
+	}
+	memberId, err := strconv.ParseInt(r.cb.Data, 10, 64)
+	if err != nil {
+		logI.Printf(logPrefix+"selected: %q", r.cb.Data)
+		return
+	}
+
+	bot.Send(newAbortableEditMsg(chatId, r.cb.Message.MessageID,
+		fmt.Sprintf("Enter new nickname for %s or \"-\" to remove it.", groupMembers[memberId])))
+	r = <-replyChan
+	if isAbort(r) {
+		bot.Send(tgbotapi2.NewMessage(chatId, "Aborted."))
+		return
+	}
+	if r.msg == nil {
+		return
+	}
+	nickname := strings.TrimSpace(r.msg.Text)
+	if nickname == "-" {
+		nickname = ""
+	}
 
-	handleUserWithoutGroup(callerId, callerName, chatId, r.msg.MessageID, bot, botName, replyChan, tasksChan, logPrefix)
+	errChan := make(chan error)
+	tasksChan <- &setNicknameTask{callerId, memberId, nickname, errChan}
+	if err = <-errChan; err != nil {
+		if _, ok := err.(*errorNotAllowed); ok {
+			bot.Send(tgbotapi2.NewMessage(chatId, "You are not allowed to rename this member."))
+			return
+		}
+		logE.Printf(logPrefix+"execute set-nickname task: %v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, "Failed to set nickname."))
+		return
+	}
+	bot.Send(tgbotapi2.NewMessage(chatId, "Done."))
 }
 
 func resetHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
@@ -181,28 +530,85 @@ func ipayHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-ch
 	chatId := update.Message.Chat.ID
 	var r reply
 
-	// Ask for title
-	msgTitleDemand := newAbortableMsg(chatId, "What did you pay for?")
-	bot.Send(msgTitleDemand)
-
-	//msg = tgbotapi2.NewMessage(chatId, "What did you pay for?")
-	//msg.ReplyMarkup = tgbotapi.ReplyKeyboardRemove{true, false}
-	//bot.Send(msg)
+	settings, err := getUserSettings(ownerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	if isReadOnly(settings, chatId, bot) {
+		return
+	}
 
-	// Parse title
-	r = <-replyChan
-	if isAbort(r) {
-		bot.Send(tgbotapi2.NewMessage(chatId, "Aborted."))
+	// One-line form like "/ipay 25.50 pizza @alice @bob", whatever is missing
+	// is asked for below
+	argsText := commandArguments(update.Message.Text)
+	args, err := parseCommandLine(argsText, false, ownerId, settings)
+	if err != nil {
+		if _, ok := err.(*errorBadToken); !ok {
+			logE.Printf(logPrefix+"parse arguments: %v", err)
+			return
+		}
+		bot.Send(tgbotapi2.NewMessage(chatId, describeBadToken(argsText, err, settings)))
 		return
 	}
-	title := r.msg.Text
+	oneLine := len(argsText) != 0
+
+	title := args.title
+	titleMsgId := update.Message.MessageID
+	var receipt string
+	if len(title) == 0 {
+		// Ask for title
+		msgTitleDemand := newAbortableMsg(chatId, settings.tr("What did you pay for?"))
+		bot.Send(msgTitleDemand)
+
+		//msg = tgbotapi2.NewMessage(chatId, "What did you pay for?")
+		//msg.ReplyMarkup = tgbotapi.ReplyKeyboardRemove{true, false}
+		//bot.Send(msg)
+
+		// Parse title, a receipt photo may come along with it as caption
+		for r = <-replyChan; ; r = <-replyChan {
+			if isAbort(r) {
+				bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+				return
+			}
+			if r.msg == nil {
+				continue
+			}
+			if fileId := largestPhoto(r.msg); len(fileId) != 0 {
+				receipt = fileId
+				if len(r.msg.Caption) == 0 {
+					bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Receipt saved. What did you pay for?")))
+					continue
+				}
+				r.msg.Text = r.msg.Caption
+			}
+			break
+		}
+		title = r.msg.Text
+		titleMsgId = r.msg.MessageID
+	}
 	logD.Println("title: ", title)
 
-	amount, rplMsgId := retrieveAmount(chatId, r.msg.MessageID, "pay", bot, replyChan)
-	if amount <= 0 {
-		logI.Printf(logPrefix+"entered amount: %.2f", amount)
-		// TODO: send smth
-		return
+	categoryId := args.categoryId
+	ok := true
+	if categoryId == 0 && oneLine {
+		if categoryId, err = suggestCategory(ownerId, title); err != nil {
+			logE.Printf(logPrefix+"%v", err)
+		}
+	} else if categoryId == 0 {
+		if categoryId, ok = askCategory(chatId, ownerId, title, settings, bot, replyChan); !ok {
+			return
+		}
+	}
+
+	amount, rplMsgId := args.amount, titleMsgId
+	var items []receiptItem
+	if amount == 0 {
+		if amount, items, rplMsgId, ok = askAmountOrItems(chatId, titleMsgId, settings, bot, replyChan); !ok {
+			logI.Printf(logPrefix+"entered amount: %.2f", amount)
+			// TODO: send smth
+			return
+		}
 	}
 
 	// Select users with similar group id from db
@@ -213,117 +619,284 @@ func ipayHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-ch
 		return
 	}
 
-	// Ask for members
-	// TODO: handle similar names
-	composeUsersKb := func(except map[int64]bool) tgbotapi2.InlineKeyboardMarkup {
-		var userButtons [][]tgbotapi2.InlineKeyboardButton
-		for uid, name := range groupMembers {
-			if except != nil && except[uid] {
-				continue
+	// Ask for members, itemised receipt is split by its items
+	selectedIds := args.participants
+	var shares map[int64]float64
+	var lastCb *tgbotapi2.CallbackQuery
+	if len(selectedIds) != 0 {
+		// Named in the command
+	} else if items != nil {
+		if lastCb, ok = askItemMembers(chatId, rplMsgId, items, groupMembers, settings, bot, replyChan); !ok {
+			return
+		}
+		amount, shares = splitItems(items)
+		for _, uid := range sortedMemberIds(groupMembers) {
+			if _, ok := shares[uid]; ok {
+				selectedIds = append(selectedIds, uid)
 			}
-			userButtons = append(userButtons, []tgbotapi2.InlineKeyboardButton{tgbotapi2.NewInlineKeyboardButtonData(name, strconv.Itoa(int(uid)))})
 		}
-		if len(userButtons) > 0 {
-			userButtons = append(userButtons, []tgbotapi2.InlineKeyboardButton{tgbotapi2.NewInlineKeyboardButtonData("⏎", "⏎")})
+	} else {
+		if selectedIds, lastCb, ok = askParticipants(chatId, rplMsgId, settings.tr("Who did you pay for?"), groupMembers, settings, bot, replyChan); !ok {
+			return
 		}
-		return tgbotapi2.NewInlineKeyboardMarkup(userButtons...)
+	}
+	transTime := time.Unix(int64(update.Message.Date), 0)
+	if lastCb != nil {
+		transTime = time.Unix(int64(lastCb.Message.Date), 0)
 	}
 
-	msgWho := newAbortableMsg(chatId, "Who did you pay for?")
-	msgWho.ReplyToMessageID = rplMsgId
-	msgWho.ReplyMarkup = composeUsersKb(nil)
-	sent, _ := bot.Send(msgWho)
+	// Send summary
+	membersStr := joinNames(selectedIds, groupMembers, settings)
 
-	selected := make(map[int64]bool)
-	var transTime time.Time
-	for r = range replyChan {
-		if isAbort(r) {
-			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
-			bot.Send(tgbotapi2.NewMessage(chatId, "Aborted."))
+	// Collect shares of selected members
+	if shares == nil {
+		if shares, ok = askShares(chatId, selectedIds, membersStr, settings, bot, replyChan); !ok {
 			return
 		}
-		if r.cb.Data == "⏎" {
-			log.Println(r.cb.Message.Date)
-			transTime = time.Unix(int64(r.cb.Message.Date), 0)
-			log.Println(transTime)
-			break
-		}
-
-		uid, _ := strconv.Atoi(r.cb.Data)
-		selected[int64(uid)] = true
-		alertUpdateAmount := tgbotapi2.NewCallbackWithAlert(r.cb.ID, r.cb.Data)
-		alertUpdateAmount.ShowAlert = false
-		bot.AnswerCallbackQuery(alertUpdateAmount)
+	}
 
-		newKb := composeUsersKb(selected)
-		if len(newKb.InlineKeyboard) == 0 {
-			log.Println(r.cb.Message.Date)
-			transTime = time.Unix(int64(r.cb.Message.Date), 0)
-			log.Println(transTime)
-			break
+	// Expenses may be entered after the fact
+	if !args.ts.IsZero() {
+		transTime = args.ts
+	} else if !oneLine {
+		if transTime, ok = askDate(chatId, transTime, settings, bot, replyChan); !ok {
+			return
 		}
-
-		msgEditWho := tgbotapi2.NewEditMessageText(chatId, r.cb.Message.MessageID, "Who else did you pay for?")
-		bot.Send(msgEditWho)
-
-		msgEditUsersKb := tgbotapi2.NewEditMessageReplyMarkup(chatId, r.cb.Message.MessageID, composeUsersKb(selected))
-		bot.Send(msgEditUsersKb)
 	}
 
-	// Send summary
-	membersStr := ""
-	memberIdx := 0
-	for uid, _ := range selected {
-		if len(membersStr) > 0 {
-			if memberIdx == len(selected)-1 {
-				membersStr += " and "
-			} else {
-				membersStr += ", "
-			}
-		}
-		membersStr += groupMembers[uid]
+	// Someone else may be named as the payer
+	payerId := ownerId
+	summary := settings.tr("You paid ")
+	if args.payer != 0 && args.payer != int64(ownerId) {
+		payerId = int(args.payer)
+		summary = fmt.Sprintf(settings.tr("%s paid "), groupMembers[args.payer])
 	}
 
-	title = fmt.Sprintf("€%.2f for %s (%s)", amount, title, membersStr)
-	summary := "You paid " + title
-	alertUpdateAmount := tgbotapi2.NewCallbackWithAlert(r.cb.ID, summary)
-	alertUpdateAmount.ShowAlert = false
-	bot.AnswerCallbackQuery(alertUpdateAmount)
+	summaryTitle := fmt.Sprintf(settings.tr("%s for %s (%s)"), settings.money(amount), title, membersStr)
+	summary += summaryTitle
+	if lastCb != nil {
+		alertUpdateAmount := tgbotapi2.NewCallbackWithAlert(lastCb.ID, summary)
+		alertUpdateAmount.ShowAlert = false
+		bot.AnswerCallbackQuery(alertUpdateAmount)
 
-	msgEditSummary := tgbotapi2.NewEditMessageText(chatId, r.cb.Message.MessageID, "Okay, I got it.")
-	bot.Send(msgEditSummary)
+		msgEditSummary := tgbotapi2.NewEditMessageText(chatId, lastCb.Message.MessageID, settings.tr("Okay, I got it."))
+		bot.Send(msgEditSummary)
+	} else {
+		bot.Send(tgbotapi2.NewMessage(chatId, summary))
+	}
 
 	// Print transaction id on task executed
 	transIdx := make(chan int64)
 	go func(transIdx chan int64, title string, ownerId int) {
 		trid := <-transIdx
-		msgText := fmt.Sprintf("Failed to create transaction for %q", title)
+		msgText := fmt.Sprintf(settings.tr("Failed to create transaction for %q"), title)
 		if trid != -1 {
-			msgText = fmt.Sprintf("*tr #%d: %q* /undo%d", trid, title, trid)
+			msgText = fmt.Sprintf("*tr #%d: %q* /undo%d /edit%d", trid, title, trid, trid)
+			if items != nil {
+				msgText += fmt.Sprintf(" /items%d", trid)
+			}
 		}
 		msg := tgbotapi2.NewMessage(chatId, msgText)
 		msg.ParseMode = "markdown"
 		bot.Send(msg)
 
+		if trid != -1 && len(receipt) != 0 {
+			if err := attachReceipt(ownerId, trid, receipt, bot, tasksChan); err != nil {
+				logE.Printf(logPrefix+"attach receipt: %v", err)
+			}
+		}
+
 		var debt float64
 		if err := calcDebt(ownerId, &debt); err != nil {
 			logE.Printf(logPrefix+"calculate debt: %v", err)
 			return
 		}
-		msgText = debtMessage(debt)
+		msgText = debtMessage(settings, debt)
 		msg = tgbotapi2.NewMessage(chatId, msgText)
 		bot.Send(msg)
-	}(transIdx, title, ownerId)
 
-	// Put new task into tasks channel
+		if trid != -1 {
+			notifyTransaction(trid, "New expense", int64(ownerId), bot, tasksChan)
+			checkBudgets(ownerId, categoryId, transTime, bot, tasksChan)
+		}
+	}(transIdx, summaryTitle, ownerId)
+
+	// Put new task into tasks channel
 	tasksChan <- &payTask{
-		title:    title,
-		amount:   amount,
-		ts:       transTime,
-		owner:    ownerId,
-		members:  selected,
-		transIdx: transIdx,
+		title:      title,
+		amount:     amount,
+		ts:         transTime,
+		owner:      payerId,
+		categoryId: categoryId,
+		shares:     shares,
+		items:      items,
+		transIdx:   transIdx,
+	}
+}
+
+// Lets user tick participants one by one until ⏎ is pressed or nobody is
+// left; returns them in member order along with the last callback
+func askParticipants(chatId int64, replyTo int, question string, groupMembers map[int64]string, settings *groupSettings, bot *tgbotapi2.BotAPI, replyChan <-chan reply) (selectedIds []int64, lastCb *tgbotapi2.CallbackQuery, ok bool) {
+	composeUsersKb := func(except map[int64]bool) tgbotapi2.InlineKeyboardMarkup {
+		var userButtons [][]tgbotapi2.InlineKeyboardButton
+		for _, uid := range sortedMemberIds(groupMembers) {
+			if except != nil && except[uid] {
+				continue
+			}
+			userButtons = append(userButtons, []tgbotapi2.InlineKeyboardButton{tgbotapi2.NewInlineKeyboardButtonData(groupMembers[uid], strconv.Itoa(int(uid)))})
+		}
+		if len(userButtons) > 0 {
+			userButtons = append(userButtons, []tgbotapi2.InlineKeyboardButton{tgbotapi2.NewInlineKeyboardButtonData("⏎", "⏎")})
+		}
+		return tgbotapi2.NewInlineKeyboardMarkup(userButtons...)
+	}
+
+	msgWho := newAbortableMsg(chatId, question)
+	msgWho.ReplyToMessageID = replyTo
+	msgWho.ReplyMarkup = composeUsersKb(nil)
+	sent, _ := bot.Send(msgWho)
+
+	selected := make(map[int64]bool)
+	for r := range replyChan {
+		if isAbort(r) {
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return nil, nil, false
+		}
+		if r.cb == nil {
+			continue
+		}
+		lastCb = r.cb
+		if r.cb.Data == "⏎" {
+			if len(selected) == 0 {
+				bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+				continue
+			}
+			break
+		}
+
+		uid, _ := strconv.Atoi(r.cb.Data)
+		selected[int64(uid)] = true
+		alertUpdateAmount := tgbotapi2.NewCallbackWithAlert(r.cb.ID, r.cb.Data)
+		alertUpdateAmount.ShowAlert = false
+		bot.AnswerCallbackQuery(alertUpdateAmount)
+
+		newKb := composeUsersKb(selected)
+		if len(newKb.InlineKeyboard) == 0 {
+			break
+		}
+
+		msgEditWho := tgbotapi2.NewEditMessageText(chatId, r.cb.Message.MessageID, settings.tr("Who else did you pay for?"))
+		bot.Send(msgEditWho)
+
+		msgEditUsersKb := tgbotapi2.NewEditMessageReplyMarkup(chatId, r.cb.Message.MessageID, newKb)
+		bot.Send(msgEditUsersKb)
+	}
+	if lastCb == nil {
+		return nil, nil, false
+	}
+
+	for _, uid := range sortedMemberIds(groupMembers) {
+		if selected[uid] {
+			selectedIds = append(selectedIds, uid)
+		}
 	}
+	return selectedIds, lastCb, true
+}
+
+// Asks for weights of participants when group splits by shares, otherwise
+// everyone gets an equal share
+func askShares(chatId int64, ids []int64, membersStr string, settings *groupSettings, bot *tgbotapi2.BotAPI, replyChan <-chan reply) (shares map[int64]float64, ok bool) {
+	shares = make(map[int64]float64)
+	for _, uid := range ids {
+		shares[uid] = 1
+	}
+	if settings.splitMode != splitShares || len(ids) < 2 {
+		return shares, true
+	}
+
+	msgShares := newAbortableMsg(chatId, fmt.Sprintf(settings.tr("Enter shares for %s separated by spaces, e.g. \"2 1 1\"."), membersStr))
+	bot.Send(msgShares)
+	for r := range replyChan {
+		if isAbort(r) {
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return nil, false
+		}
+		if r.msg == nil {
+			continue
+		}
+		if parsed := parseShares(r.msg.Text, len(ids)); parsed != nil {
+			for i, uid := range ids {
+				shares[uid] = parsed[i]
+			}
+			return shares, true
+		}
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Wrong shares.")))
+	}
+	return nil, false
+}
+
+// Asks when the expense happened; "today" keeps the time of entry, typed dates
+// without time of day get noon
+func askDate(chatId int64, now time.Time, settings *groupSettings, bot *tgbotapi2.BotAPI, replyChan <-chan reply) (ts time.Time, ok bool) {
+	const (
+		today     = "today"
+		yesterday = "yesterday"
+	)
+	msg := newAbortableMsg(chatId, fmt.Sprintf(settings.tr("When was it? Pick a day or type a date like %s."), settings.formatTime(now)))
+	msg.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(tgbotapi2.NewInlineKeyboardRow(
+		tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Today"), today),
+		tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Yesterday"), yesterday),
+	))
+	sent, _ := bot.Send(msg)
+
+	for r := range replyChan {
+		if isAbort(r) {
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return ts, false
+		}
+		switch {
+		case r.cb != nil && r.cb.Message != nil && r.cb.Message.MessageID == sent.MessageID:
+			bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+			switch r.cb.Data {
+			case today:
+				ts = now
+			case yesterday:
+				ts = now.AddDate(0, 0, -1)
+			default:
+				continue
+			}
+		case r.msg != nil:
+			parsed, err := settings.parseDate(r.msg.Text)
+			if err != nil {
+				bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Wrong date: %v."), err)))
+				continue
+			}
+			ts = parsed
+		default:
+			continue
+		}
+		bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, fmt.Sprintf(settings.tr("Date: %s"), settings.formatTime(ts))))
+		return ts, true
+	}
+	return ts, false
+}
+
+// Joins member names as "A, B and C"
+func joinNames(ids []int64, names map[int64]string, settings *groupSettings) string {
+	str := ""
+	for idx, uid := range ids {
+		if len(str) > 0 {
+			if idx == len(ids)-1 {
+				str += settings.tr(" and ")
+			} else {
+				str += ", "
+			}
+		}
+		str += names[uid]
+	}
+	return str
 }
 
 func igiveHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
@@ -333,12 +906,40 @@ func igiveHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-c
 
 	// Retrieve the amount
 	chatId := update.Message.Chat.ID
-	amount, rplMsgId := retrieveAmount(chatId, update.Message.MessageID, "give back", bot, replyChan)
-	if amount <= 0 {
-		logI.Printf(logPrefix+"entered amount: %.2f", amount)
+	settings, err := getUserSettings(srcId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	if isReadOnly(settings, chatId, bot) {
 		return
 	}
 
+	// One-line form like "/igive 20 @alice"
+	argsText := commandArguments(update.Message.Text)
+	args, err := parseCommandLine(argsText, true, srcId, settings)
+	if err != nil {
+		if _, ok := err.(*errorBadToken); !ok {
+			logE.Printf(logPrefix+"parse arguments: %v", err)
+			return
+		}
+		bot.Send(tgbotapi2.NewMessage(chatId, describeBadToken(argsText, err, settings)))
+		return
+	}
+	if len(args.participants) == 1 && args.participants[0] == int64(srcId) {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("You cannot give money back to yourself.")))
+		return
+	}
+
+	amount, rplMsgId := args.amount, update.Message.MessageID
+	if amount == 0 {
+		amount, rplMsgId = retrieveAmount(chatId, update.Message.MessageID, "give back", settings, bot, replyChan)
+		if amount <= 0 {
+			logI.Printf(logPrefix+"entered amount: %.2f", amount)
+			return
+		}
+	}
+
 	// Select users with similar group id from db
 	groupMembers, err := selectGroupMembers(srcId)
 	if err != nil {
@@ -347,19 +948,24 @@ func igiveHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-c
 		return
 	}
 
+	if len(args.participants) == 1 {
+		giveBack(chatId, amount, srcId, int(args.participants[0]), 0, groupMembers, settings, bot, tasksChan)
+		return
+	}
+
 	// Ask for dst
 	composeUsersKb := func() tgbotapi2.InlineKeyboardMarkup {
 		var userButtons [][]tgbotapi2.InlineKeyboardButton
-		for uid, name := range groupMembers {
-			if name == groupMembers[int64(srcId)] {
+		for _, uid := range sortedMemberIds(groupMembers) {
+			if uid == int64(srcId) {
 				continue
 			}
-			userButtons = append(userButtons, []tgbotapi2.InlineKeyboardButton{tgbotapi2.NewInlineKeyboardButtonData(name, strconv.Itoa(int(uid)))})
+			userButtons = append(userButtons, []tgbotapi2.InlineKeyboardButton{tgbotapi2.NewInlineKeyboardButtonData(groupMembers[uid], strconv.Itoa(int(uid)))})
 		}
 		return tgbotapi2.NewInlineKeyboardMarkup(userButtons...)
 	}
 
-	msgWho := newAbortableMsg(chatId, "Who did you give money back?")
+	msgWho := newAbortableMsg(chatId, settings.tr("Who did you give money back?"))
 	msgWho.ReplyMarkup = composeUsersKb()
 	msgWho.ReplyToMessageID = rplMsgId
 	sent, _ := bot.Send(msgWho)
@@ -367,7 +973,7 @@ func igiveHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-c
 	r := <-replyChan
 	if isAbort(r) {
 		bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
-		bot.Send(tgbotapi2.NewMessage(chatId, "Aborted."))
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
 		return
 	}
 
@@ -377,39 +983,58 @@ func igiveHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-c
 		return
 	}
 
-	msgEditSummary := tgbotapi2.NewEditMessageText(chatId, r.cb.Message.MessageID, "Okay, I got it.")
+	msgEditSummary := tgbotapi2.NewEditMessageText(chatId, r.cb.Message.MessageID, settings.tr("Okay, I got it."))
 	bot.Send(msgEditSummary)
 
+	giveBack(chatId, amount, srcId, selected, 0, groupMembers, settings, bot, tasksChan)
+}
+
+// Registers repayment, optionally paying a payment request, and reports the
+// new balance of the payer
+func giveBack(chatId int64, amount float64, srcId, selected int, requestId int64, groupMembers map[int64]string, settings *groupSettings, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "igive handler: "
+
 	selectedName, _ := groupMembers[int64(selected)]
-	msgSummary := tgbotapi2.NewMessage(chatId, fmt.Sprintf("You gave back €%.2f to %s", amount, selectedName))
+	msgSummary := tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("You gave back %s to %s"), settings.money(amount), selectedName))
 	bot.Send(msgSummary)
 
-	succeeded := make(chan bool)
-	go func(succeeded chan bool, ownerId int) {
-		taskSucceeded := <-succeeded
+	gt := &giveTask{
+		amount:    amount,
+		src:       srcId,
+		dst:       selected,
+		requestId: requestId,
+		succeeded: make(chan bool),
+	}
+	go func(gt *giveTask) {
+		taskSucceeded := <-gt.succeeded
 		if !taskSucceeded {
-			msgText := "Failed to register operation"
+			msgText := settings.tr("Failed to register operation")
 			msg := tgbotapi2.NewMessage(chatId, msgText)
 			bot.Send(msg)
 			return
 		}
 
+		// Balance changes once the recipient confirms
+		if gt.pendingId != 0 {
+			rp := &repayment{id: gt.pendingId, src: int64(gt.src), dst: int64(gt.dst), amount: gt.amount}
+			if err := sendRepaymentPrompt(rp, groupMembers, settings, bot); err != nil {
+				logW.Printf(logPrefix+"send repayment prompt: %v", err)
+			}
+			bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Waiting for %s to confirm it."), selectedName)))
+			return
+		}
+
 		var debt float64
-		if err := calcDebt(ownerId, &debt); err != nil {
+		if err := calcDebt(gt.src, &debt); err != nil {
 			logE.Printf(logPrefix+"calculate debt: %v", err)
 			return
 		}
-		msgText := debtMessage(debt)
+		msgText := debtMessage(settings, debt)
 		msg := tgbotapi2.NewMessage(chatId, msgText)
 		bot.Send(msg)
-	}(succeeded, srcId)
+	}(gt)
 
-	tasksChan <- &giveTask{
-		amount:    amount,
-		src:       srcId,
-		dst:       selected,
-		succeeded: succeeded,
-	}
+	tasksChan <- gt
 }
 
 func ioweHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI) {
@@ -418,12 +1043,32 @@ func ioweHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI) {
 	requestorId := update.Message.From.ID
 	chatId := update.Message.Chat.ID
 
+	settings, err := getUserSettings(requestorId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+
 	var debt float64
 	if err := calcDebt(requestorId, &debt); err != nil {
 		logE.Printf(logPrefix+"calculate debt: %v", err)
 		return
 	}
-	msg := tgbotapi2.NewMessage(chatId, debtMessage(debt))
+	msgText := debtMessage(settings, debt)
+
+	// Repayments count once their recipients confirm them
+	pending, err := selectPendingRepayments(requestorId)
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+	} else if len(pending) != 0 {
+		names, err := selectAllGroupMembers(requestorId)
+		if err != nil {
+			logE.Printf(logPrefix+"select group members: %v", err)
+			return
+		}
+		msgText += "\n\n" + formatPendingRepayments(pending, names, settings)
+	}
+	msg := tgbotapi2.NewMessage(chatId, msgText)
 	bot.Send(msg)
 }
 
@@ -450,7 +1095,13 @@ func statHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI) {
 		// TODO: send smth
 		return
 	}
-	log.Println("groupMembers: %v", groupMembers)
+	logD.Printf(logPrefix+"group members: %v", groupMembers)
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
 
 	var debtors []debtor
 	for uid, name := range groupMembers {
@@ -469,20 +1120,32 @@ func statHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI) {
 		if len(debtsSummary) != 0 {
 			debtsSummary += "\n"
 		}
-		debtsSummary += fmt.Sprintf("`%-8s \t%-7.2f`", debtor.name, debtor.debt)
+		debtsSummary += fmt.Sprintf("`%-8s \t%-7s`", debtor.name, settings.money(debtor.debt))
 	}
 
 	msg := tgbotapi2.NewMessage(chatId, debtsSummary)
 	msg.ParseMode = "markdown"
 	bot.Send(msg)
 
-	expensesImage, err := createExpensesImage(int64(update.Message.From.ID), groupMembers)
+	// Expenses may be paid by members who already left
+	allMembers, err := selectAllGroupMembers(callerId)
 	if err != nil {
-		logE.Printf(logPrefix+"create expenses image: %v", err)
+		logE.Printf(logPrefix+"select all group members: %v", err)
 		return
 	}
-	msgImg := tgbotapi2.NewPhotoUpload(chatId, expensesImage)
-	bot.Send(msgImg)
+	dir, pages, err := createExpensesImages(int64(update.Message.From.ID), allMembers, settings)
+	if err != nil {
+		logE.Printf(logPrefix+"create expenses images: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	for i, page := range pages {
+		msgImg := tgbotapi2.NewPhotoUpload(chatId, page)
+		if len(pages) > 1 {
+			msgImg.Caption = fmt.Sprintf(settings.tr("Page %d of %d"), i+1, len(pages))
+		}
+		bot.Send(msgImg)
+	}
 }
 
 func undoHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
@@ -490,11 +1153,21 @@ func undoHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-ch
 
 	chatId := update.Message.Chat.ID
 	caller := update.Message.From.ID
+	settings, err := getUserSettings(caller)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	if isReadOnly(settings, chatId, bot) {
+		return
+	}
+
+	// Same handler serves /undo<id> and /redo<id>
 	undoCommand := "undo"
+	redo := strings.HasPrefix(update.Message.Text[1:], "redo")
 	var trid int
-	var err error
 	if trid, err = strconv.Atoi(update.Message.Text[1+len(undoCommand):]); err != nil {
-		msg := tgbotapi2.NewMessage(chatId, "Invalid transaction index.")
+		msg := tgbotapi2.NewMessage(chatId, settings.tr("Invalid transaction index."))
 		bot.Send(msg)
 		return
 	}
@@ -502,9 +1175,17 @@ func undoHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-ch
 	undoSucceeded := make(chan bool)
 	go func(undoRes chan bool, trid int, ownerId int) {
 		succeeded := <-undoRes
-		msgText := fmt.Sprintf("Failed to undo transaction %d", trid)
-		if succeeded {
-			msgText = fmt.Sprintf("Transaction %d removed.", trid)
+		var msgText string
+		if redo {
+			msgText = fmt.Sprintf(settings.tr("Failed to redo transaction %d"), trid)
+			if succeeded {
+				msgText = fmt.Sprintf(settings.tr("Transaction %d restored."), trid)
+			}
+		} else {
+			msgText = fmt.Sprintf(settings.tr("Failed to undo transaction %d"), trid)
+			if succeeded {
+				msgText = fmt.Sprintf(settings.tr("Transaction %d voided. /redo%d"), trid, trid)
+			}
 		}
 		msg := tgbotapi2.NewMessage(chatId, msgText)
 		msg.ParseMode = "markdown"
@@ -515,7 +1196,7 @@ func undoHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-ch
 			logE.Printf(logPrefix+"calculate debt: %v", err)
 			return
 		}
-		msgText = debtMessage(debt)
+		msgText = debtMessage(settings, debt)
 		msg = tgbotapi2.NewMessage(chatId, msgText)
 		bot.Send(msg)
 	}(undoSucceeded, trid, caller)
@@ -523,10 +1204,608 @@ func undoHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-ch
 	tasksChan <- &undoTask{
 		trid:      trid,
 		ownerId:   caller,
+		redo:      redo,
 		succeeded: undoSucceeded,
 	}
 }
 
+const historyPageSize = 10
+
+func historyHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply) {
+	logPrefix := "history handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	groupMembers, err := selectAllGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+
+	filters := []namedFilter{
+		{"All", transactionFilter{}},
+		{"Mine", transactionFilter{payer: int64(callerId)}},
+		{"Involving me", transactionFilter{involving: int64(callerId)}},
+	}
+	browseTransactions(chatId, callerId, filters, false, groupMembers, settings, bot, replyChan)
+}
+
+func findHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply) {
+	logPrefix := "find handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	members, err := selectGroupMemberList(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+
+	findCommand := "find"
+	filter, err := parseFindQuery(update.Message.Text[1+len(findCommand):], settings, members)
+	if err != nil {
+		bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf("%v.\nUsage: /find [text] [from:date] [to:date] [by:@member] [for:@member] [>amount] [<amount]", err)))
+		return
+	}
+	browseTransactions(chatId, callerId, []namedFilter{{"", filter}}, true, displayNames(members), settings, bot, replyChan)
+}
+
+type namedFilter struct {
+	name   string
+	filter transactionFilter
+}
+
+// Shows transactions page by page in a single message; with several filters
+// a row of buttons switches between them
+func browseTransactions(chatId int64, callerId int, filters []namedFilter, showTotals bool, names map[int64]string, settings *groupSettings, bot *tgbotapi2.BotAPI, replyChan <-chan reply) {
+	logPrefix := "browse transactions: "
+
+	const (
+		pagePrev = "◀"
+		pageNext = "▶"
+	)
+	current := 0
+	page := 0
+
+	var sent tgbotapi2.Message
+	for {
+		entries, summary, err := selectGroupTransactions(callerId, filters[current].filter, page*historyPageSize, historyPageSize)
+		if err != nil {
+			logE.Printf(logPrefix+"select group transactions: %v", err)
+			return
+		}
+		pages := (summary.count + historyPageSize - 1) / historyPageSize
+		if pages == 0 {
+			pages = 1
+		}
+
+		text := formatHistory(entries, names, settings)
+		if len(entries) == 0 {
+			text = settings.tr("No transactions found.")
+		}
+		if showTotals {
+			text = fmt.Sprintf(settings.tr("Found %d transactions, %s in total.")+"\n\n", summary.count, settings.money(summary.sum)) + text
+		}
+
+		var rows [][]tgbotapi2.InlineKeyboardButton
+		if len(filters) > 1 {
+			var filterRow []tgbotapi2.InlineKeyboardButton
+			for i, f := range filters {
+				label := f.name
+				if i == current {
+					label = "• " + f.name
+				}
+				filterRow = append(filterRow, tgbotapi2.NewInlineKeyboardButtonData(label, strconv.Itoa(i)))
+			}
+			rows = append(rows, filterRow)
+		}
+		rows = append(rows, tgbotapi2.NewInlineKeyboardRow(
+			tgbotapi2.NewInlineKeyboardButtonData(pagePrev, pagePrev),
+			tgbotapi2.NewInlineKeyboardButtonData(fmt.Sprintf("%d/%d", page+1, pages), "-"),
+			tgbotapi2.NewInlineKeyboardButtonData(pageNext, pageNext),
+		))
+		kb := tgbotapi2.NewInlineKeyboardMarkup(rows...)
+
+		// Every page is shown in the same message
+		if sent.MessageID == 0 {
+			msg := tgbotapi2.NewMessage(chatId, text)
+			msg.ReplyMarkup = kb
+			sent, _ = bot.Send(msg)
+		} else {
+			edit := tgbotapi2.NewEditMessageText(chatId, sent.MessageID, text)
+			edit.ReplyMarkup = &kb
+			bot.Send(edit)
+		}
+
+		for changed := false; !changed; {
+			r, ok := nextReply(replyChan)
+			if !ok || isAbort(r) {
+				bot.Send(tgbotapi2.NewEditMessageReplyMarkup(chatId, sent.MessageID, tgbotapi2.NewInlineKeyboardMarkup()))
+				return
+			}
+			if r.cb == nil || r.cb.Message == nil || r.cb.Message.MessageID != sent.MessageID {
+				continue
+			}
+			bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+			switch r.cb.Data {
+			case pagePrev:
+				changed = page > 0
+				if changed {
+					page--
+				}
+			case pageNext:
+				changed = page < pages-1
+				if changed {
+					page++
+				}
+			default:
+				if i, err := strconv.Atoi(r.cb.Data); err == nil && i >= 0 && i < len(filters) && i != current {
+					current = i
+					page = 0
+					changed = true
+				}
+			}
+		}
+	}
+}
+
+func formatHistory(entries []transactionInfo, names map[int64]string, settings *groupSettings) string {
+	var lines []string
+	for _, e := range entries {
+		var participants []int64
+		for _, uid := range sortedMemberIds(names) {
+			if _, ok := e.shares[uid]; ok {
+				participants = append(participants, uid)
+			}
+		}
+		title := e.title
+		if len(e.category) != 0 {
+			title += " [" + e.category + "]"
+		}
+		line := fmt.Sprintf("#%d · %s · %s paid %s for %s\n    %s",
+			e.id, settings.formatTime(e.time), names[e.owner], settings.money(e.amount), title,
+			joinNames(participants, names, settings))
+		if e.hasItems {
+			line += fmt.Sprintf(" · 🧾 /items%d", e.id)
+		}
+		if e.hasReceipt {
+			line += fmt.Sprintf(" · 📎 /receipt%d", e.id)
+		}
+		if e.voided {
+			line = "(voided) " + line + fmt.Sprintf(" · /redo%d", e.id)
+		} else {
+			line += fmt.Sprintf(" · /undo%d /edit%d", e.id, e.id)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n\n")
+}
+
+func archiveGroupHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "archivegroup handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	if settings.archived {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("This group is archived and read-only.")))
+		return
+	}
+
+	// Ask for confirmation
+	bot.Send(newAbortableMsg(chatId, fmt.Sprintf(`Archived group %q becomes read-only: its history stays available through /stat and /export, but nothing can be added or undone. Type "yes" to archive it.`, settings.name)))
+	r := <-replyChan
+	if isAbort(r) {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+		return
+	}
+	if r.msg == nil || r.msg.Text != "yes" {
+		return
+	}
+
+	errChan := make(chan error)
+	tasksChan <- &archiveGroupTask{callerId, errChan}
+	if err = <-errChan; err != nil {
+		if _, ok := err.(*errorNotAllowed); ok {
+			bot.Send(tgbotapi2.NewMessage(chatId, "You are not allowed to archive the group. Ask your group leader."))
+			return
+		}
+		logE.Printf(logPrefix+"execute archive-group task: %v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, "Failed to archive the group."))
+		return
+	}
+	bot.Send(tgbotapi2.NewMessage(chatId, "Group archived. Members may now /leavegroup without settling."))
+}
+
+func deleteGroupHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "deletegroup handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	isLeader, err := isGroupLeader(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"check leader: %v", err)
+		return
+	}
+	if !isLeader {
+		bot.Send(tgbotapi2.NewMessage(chatId, "You are not allowed to delete the group. Ask your group leader."))
+		return
+	}
+
+	// Ask for confirmation
+	bot.Send(newAbortableMsg(chatId, fmt.Sprintf("All members, transactions and balances of group %q will be removed forever. Type the group name to confirm.", settings.name)))
+	r := <-replyChan
+	if isAbort(r) {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+		return
+	}
+	if r.msg == nil || r.msg.Text != settings.name {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+		return
+	}
+
+	deleteTask := &deleteGroupTask{callerId: callerId, err: make(chan error)}
+	tasksChan <- deleteTask
+	if err = <-deleteTask.err; err != nil {
+		logE.Printf(logPrefix+"execute delete-group task: %v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, "Failed to delete the group."))
+		return
+	}
+	for _, uid := range deleteTask.members {
+		if uid == int64(callerId) {
+			continue
+		}
+		bot.Send(tgbotapi2.NewMessage(uid, fmt.Sprintf("Group %q was deleted by its leader. Use /start to join another one.", settings.name)))
+	}
+	bot.Send(tgbotapi2.NewMessage(chatId, "Group deleted. Use /start to create a new one."))
+}
+
+func exportHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI) {
+	logPrefix := "export handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	groupMembers, err := selectAllGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+	entries, err := selectGroupLedger(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group ledger: %v", err)
+		return
+	}
+
+	var buf bytes.Buffer
+	csvWriter := csv.NewWriter(&buf)
+	csvWriter.Write([]string{"Transaction", "Date", "Title", "Category", "Payer", "Participant", "Amount", "Voided"})
+	for _, e := range entries {
+		record := []string{"", "", "Repayment", e.category, groupMembers[e.src], groupMembers[e.dst], fmt.Sprintf("%.2f", e.amount), strconv.FormatBool(e.voided)}
+		if e.trid.Valid {
+			record[0] = strconv.FormatInt(e.trid.Int64, 10)
+			record[1] = settings.formatTime(e.time)
+			record[2] = e.title
+		}
+		csvWriter.Write(record)
+	}
+	csvWriter.Flush()
+	if err = csvWriter.Error(); err != nil {
+		logE.Printf(logPrefix+"write csv: %v", err)
+		return
+	}
+
+	doc := tgbotapi2.NewDocumentUpload(chatId, tgbotapi2.FileBytes{Name: settings.name + ".csv", Bytes: buf.Bytes()})
+	bot.Send(doc)
+}
+
+// Tells user that group does not accept changes anymore
+func isReadOnly(settings *groupSettings, chatId int64, bot *tgbotapi2.BotAPI) bool {
+	if settings.archived {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("This group is archived and read-only.")))
+	}
+	return settings.archived
+}
+
+func editHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "handle edit: "
+
+	chatId := update.Message.Chat.ID
+	callerId := update.Message.From.ID
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	if isReadOnly(settings, chatId, bot) {
+		return
+	}
+
+	editCommand := "edit"
+	trid, err := strconv.ParseInt(update.Message.Text[1+len(editCommand):], 10, 64)
+	if err != nil {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Invalid transaction index.")))
+		return
+	}
+	allowed, err := canModifyTransaction(trid, callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"check access: %v", err)
+		return
+	}
+	if !allowed {
+		bot.Send(tgbotapi2.NewMessage(chatId, "You are not allowed to edit this transaction."))
+		return
+	}
+	tr, err := selectTransaction(trid)
+	if err != nil || tr == nil {
+		logE.Printf(logPrefix+"select transaction: %v", err)
+		return
+	}
+	if tr.voided {
+		bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf("Transaction %d is voided. /redo%d to restore it first.", trid, trid)))
+		return
+	}
+
+	groupMembers, err := selectGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+	allMembers, err := selectAllGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select all group members: %v", err)
+		return
+	}
+
+	// Changes are collected in a draft and stored at once
+	draft := &editTask{
+		trid:     trid,
+		callerId: callerId,
+		title:    tr.title,
+		amount:   tr.amount,
+		ts:       tr.time,
+		owner:    tr.owner,
+		err:      make(chan error),
+	}
+	participants := func() []int64 {
+		var ids []int64
+		for _, uid := range sortedMemberIds(allMembers) {
+			if draft.shares != nil && draft.shares[uid] > 0 || draft.shares == nil && tr.shares[uid] > 0 {
+				ids = append(ids, uid)
+			}
+		}
+		return ids
+	}
+
+	const (
+		fieldTitle        = "Title"
+		fieldAmount       = "Amount"
+		fieldPayer        = "Payer"
+		fieldParticipants = "Participants"
+		fieldDate         = "Date"
+		actionSave        = "Save"
+		actionCancel      = "Cancel"
+	)
+	menuKb := tgbotapi2.NewInlineKeyboardMarkup(
+		tgbotapi2.NewInlineKeyboardRow(
+			tgbotapi2.NewInlineKeyboardButtonData(fieldTitle, fieldTitle),
+			tgbotapi2.NewInlineKeyboardButtonData(fieldAmount, fieldAmount),
+			tgbotapi2.NewInlineKeyboardButtonData(fieldPayer, fieldPayer),
+		),
+		tgbotapi2.NewInlineKeyboardRow(
+			tgbotapi2.NewInlineKeyboardButtonData(fieldParticipants, fieldParticipants),
+			tgbotapi2.NewInlineKeyboardButtonData(fieldDate, fieldDate),
+		),
+		tgbotapi2.NewInlineKeyboardRow(
+			tgbotapi2.NewInlineKeyboardButtonData("✅ "+actionSave, actionSave),
+			tgbotapi2.NewInlineKeyboardButtonData("✖ "+actionCancel, actionCancel),
+		),
+	)
+	showMenu := func() int {
+		text := fmt.Sprintf("tr #%d: %s\n%s: %s\n%s: %s\n%s: %s\n%s: %s",
+			trid, draft.title,
+			fieldAmount, settings.money(draft.amount),
+			fieldPayer, allMembers[draft.owner],
+			fieldParticipants, joinNames(participants(), allMembers, settings),
+			fieldDate, settings.formatTime(draft.ts))
+		msg := tgbotapi2.NewMessage(chatId, text)
+		msg.ReplyMarkup = menuKb
+		sent, _ := bot.Send(msg)
+		return sent.MessageID
+	}
+	askText := func(prompt string) (string, bool) {
+		bot.Send(newAbortableMsg(chatId, prompt))
+		for r := range replyChan {
+			if isAbort(r) {
+				return "", false
+			}
+			if r.msg != nil && len(strings.TrimSpace(r.msg.Text)) != 0 {
+				return strings.TrimSpace(r.msg.Text), true
+			}
+		}
+		return "", false
+	}
+	abort := func(menuId int) {
+		bot.Send(tgbotapi2.NewEditMessageText(chatId, menuId, "^C"))
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+	}
+
+	menuId := showMenu()
+	for r := range replyChan {
+		if isAbort(r) {
+			abort(menuId)
+			return
+		}
+		if r.cb == nil {
+			continue
+		}
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+
+		switch r.cb.Data {
+		case fieldTitle:
+			title, ok := askText("Enter new title.")
+			if !ok {
+				abort(menuId)
+				return
+			}
+			draft.title = title
+		case fieldAmount:
+			for {
+				text, ok := askText(fmt.Sprintf(settings.tr("How much %s did you %s?"), settings.currency, settings.tr("pay")))
+				if !ok {
+					abort(menuId)
+					return
+				}
+				amount, err := parsePositiveAmount(text, settings)
+				if err == nil {
+					draft.amount = amount
+					break
+				}
+				bot.Send(wrongAmountMsg(chatId, err, settings))
+			}
+		case fieldPayer:
+			var rows [][]tgbotapi2.InlineKeyboardButton
+			for _, uid := range sortedMemberIds(groupMembers) {
+				rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(groupMembers[uid], strconv.FormatInt(uid, 10))))
+			}
+			msg := newAbortableMsg(chatId, "Who paid?")
+			msg.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(rows...)
+			sent, _ := bot.Send(msg)
+			pr := <-replyChan
+			if isAbort(pr) || pr.cb == nil {
+				abort(sent.MessageID)
+				return
+			}
+			if owner, err := strconv.ParseInt(pr.cb.Data, 10, 64); err == nil {
+				draft.owner = owner
+			}
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, settings.tr("Okay, I got it.")))
+		case fieldParticipants:
+			selected := make(map[int64]bool)
+			composeKb := func() tgbotapi2.InlineKeyboardMarkup {
+				var rows [][]tgbotapi2.InlineKeyboardButton
+				for _, uid := range sortedMemberIds(groupMembers) {
+					text := groupMembers[uid]
+					if selected[uid] {
+						text = "✓ " + text
+					}
+					rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(text, strconv.FormatInt(uid, 10))))
+				}
+				rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData("⏎", "⏎")))
+				return tgbotapi2.NewInlineKeyboardMarkup(rows...)
+			}
+			msg := newAbortableMsg(chatId, "Who took part?")
+			msg.ReplyMarkup = composeKb()
+			sent, _ := bot.Send(msg)
+			for pr := range replyChan {
+				if isAbort(pr) {
+					abort(sent.MessageID)
+					return
+				}
+				if pr.cb == nil {
+					continue
+				}
+				bot.AnswerCallbackQuery(tgbotapi2.NewCallback(pr.cb.ID, ""))
+				if pr.cb.Data == "⏎" {
+					if len(selected) > 0 {
+						break
+					}
+					continue
+				}
+				if uid, err := strconv.ParseInt(pr.cb.Data, 10, 64); err == nil {
+					selected[uid] = !selected[uid]
+					if !selected[uid] {
+						delete(selected, uid)
+					}
+				}
+				bot.Send(tgbotapi2.NewEditMessageReplyMarkup(chatId, sent.MessageID, composeKb()))
+			}
+			var ids []int64
+			for _, uid := range sortedMemberIds(groupMembers) {
+				if selected[uid] {
+					ids = append(ids, uid)
+				}
+			}
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, settings.tr("Okay, I got it.")))
+			shares, ok := askShares(chatId, ids, joinNames(ids, groupMembers, settings), settings, bot, replyChan)
+			if !ok {
+				return
+			}
+			draft.shares = shares
+		case fieldDate:
+			ts, ok := askDate(chatId, time.Now(), settings, bot, replyChan)
+			if !ok {
+				bot.Send(tgbotapi2.NewEditMessageReplyMarkup(chatId, menuId, tgbotapi2.NewInlineKeyboardMarkup()))
+				return
+			}
+			draft.ts = ts
+		case actionCancel:
+			abort(menuId)
+			return
+		case actionSave:
+			bot.Send(tgbotapi2.NewEditMessageReplyMarkup(chatId, menuId, tgbotapi2.NewInlineKeyboardMarkup()))
+			tasksChan <- draft
+			if err := <-draft.err; err != nil {
+				if _, ok := err.(*errorNotAllowed); ok {
+					bot.Send(tgbotapi2.NewMessage(chatId, "You are not allowed to edit this transaction."))
+					return
+				}
+				logE.Printf(logPrefix+"execute edit task: %v", err)
+				bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf("Failed to edit transaction %d", trid)))
+				return
+			}
+
+			// Tell everyone involved about their new balance
+			for _, uid := range draft.affected {
+				if isPlaceholder(uid) {
+					continue
+				}
+				var debt float64
+				if err := calcDebt(int(uid), &debt); err != nil {
+					logE.Printf(logPrefix+"calculate debt of %d: %v", uid, err)
+					continue
+				}
+				bot.Send(tgbotapi2.NewMessage(uid, fmt.Sprintf(settings.tr("tr #%d %q was edited by %s. %s"),
+					trid, draft.title, allMembers[int64(callerId)], debtMessage(settings, debt))))
+			}
+			requestShareConfirmations(trid, "Changed expense", bot)
+			checkTransactionBudgets(trid, bot, tasksChan)
+			return
+		default:
+			continue
+		}
+		menuId = showMenu()
+	}
+}
+
 func handleNotAllowed(update tgbotapi2.Update, bot *tgbotapi2.BotAPI) {
 	logD.Printf("handle not allowed from %s", update.Message.From.UserName)
 
@@ -537,25 +1816,31 @@ func handleNotAllowed(update tgbotapi2.Update, bot *tgbotapi2.BotAPI) {
 	bot.Send(msg)
 }
 
-func retrieveAmount(chatId int64, replyTo int, action string, bot *tgbotapi2.BotAPI, replyChan <-chan reply) (amount float64, replyMsgId int) {
+func retrieveAmount(chatId int64, replyTo int, action string, settings *groupSettings, bot *tgbotapi2.BotAPI, replyChan <-chan reply) (amount float64, replyMsgId int) {
 	// Ask for price
-	msg := newAbortableMsg(chatId, fmt.Sprintf("How much € did you %s?", action))
+	msg := newAbortableMsg(chatId, fmt.Sprintf(settings.tr("How much %s did you %s?"), settings.currency, settings.tr(action)))
 	msg.ReplyToMessageID = replyTo
 
 	bot.Send(msg)
 
-	// Parse price
-	r := <-replyChan
-	if isAbort(r) {
-		bot.Send(tgbotapi2.NewMessage(chatId, "Aborted."))
-		amount = -1
-		return
+	// Parse price, ask again until it makes sense
+	var r reply
+	for r = range replyChan {
+		if isAbort(r) {
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			amount = -1
+			return
+		}
+		if r.msg == nil {
+			continue
+		}
+		var err error
+		if amount, err = parsePositiveAmount(r.msg.Text, settings); err == nil {
+			break
+		}
+		bot.Send(wrongAmountMsg(chatId, err, settings))
 	}
-
-	amount, err := strconv.ParseFloat(r.msg.Text, 64)
-	log.Printf("parsed: %.2f", amount)
-	if err != nil {
-		logE.Printf("parse amount from msg %q: %v", r.msg.Text, err)
+	if r.msg == nil {
 		amount = -1
 		return
 	}
@@ -566,7 +1851,3 @@ func retrieveAmount(chatId int64, replyTo int, action string, bot *tgbotapi2.Bot
 	replyMsgId = r.msg.MessageID
 	return
 }
-
-func createTables() error {
-	return nil
-}
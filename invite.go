@@ -3,14 +3,26 @@ package main
 import "strings"
 
 const invitationPrefix = "MBI"
+const claimPrefix = "MBC"
 const inviteCodeLen = 36
 
 func parseInviteCode(text string) string {
-	start := strings.Index(text, invitationPrefix)
+	return parseCode(text, invitationPrefix)
+}
+
+func parseClaimCode(text string) string {
+	return parseCode(text, claimPrefix)
+}
+
+func parseCode(text, prefix string) string {
+	start := strings.Index(text, prefix+"-")
 	if start == -1 {
 		return ""
 	}
-	start += 4
+	start += len(prefix) + 1
 	end := start + inviteCodeLen
+	if end > len(text) {
+		return ""
+	}
 	return text[start:end]
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Line of an itemised receipt; extras like tax and tip are shared by everyone
+// in proportion to what they had
+type receiptItem struct {
+	name    string
+	amount  float64
+	extra   bool
+	members []int64
+}
+
+// Item names treated as extras without "+" prefix
+var extraItemNames = map[string]bool{
+	"tax": true, "vat": true, "tip": true, "tips": true, "service": true, "service charge": true,
+	"налог": true, "ндс": true, "чаевые": true, "обслуживание": true,
+}
+
+// Parses "name amount" lines; extras are marked with "+" or known names and
+// may be given in percent of the items, e.g. "tip 10%"
+func parseItems(text string, settings *groupSettings) (items []receiptItem, err error) {
+	var subtotal float64
+	var percents []int
+	for _, line := range strings.Split(text, "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		item, isPercent, err := parseItemLine(line, settings)
+		if err != nil {
+			return nil, err
+		}
+		if isPercent {
+			percents = append(percents, len(items))
+		} else if !item.extra {
+			subtotal += item.amount
+		}
+		items = append(items, item)
+	}
+	if subtotal == 0 {
+		return nil, fmt.Errorf("no items")
+	}
+	for _, i := range percents {
+		items[i].amount = subtotal * items[i].amount / 100
+	}
+	return items, nil
+}
+
+func parseItemLine(line string, settings *groupSettings) (item receiptItem, isPercent bool, err error) {
+	line = strings.TrimSpace(line)
+	// The amount is the longest positive tail of whole words the amount
+	// parser reads, so "pizza - 12.50" costs 12.50 and "coffee 2 350" is two
+	// coffees for 350
+	value := ""
+	for i, r := range line {
+		if !unicode.IsSpace(r) || len(strings.TrimSpace(line[:i])) == 0 {
+			continue
+		}
+		tail := strings.TrimSpace(line[i:])
+		if startsWithLoneNumber(tail) {
+			continue
+		}
+		if amount, err := parseAmount(strings.TrimSuffix(tail, "%"), settings); err == nil && amount > 0 {
+			item.name, value = strings.TrimRight(line[:i], " \t-–—:"), tail
+			break
+		}
+	}
+	if len(value) == 0 {
+		return item, false, fmt.Errorf("no amount in %q", line)
+	}
+	if strings.HasPrefix(item.name, "+") {
+		item.name = strings.TrimSpace(item.name[1:])
+		item.extra = true
+	}
+	item.extra = item.extra || extraItemNames[strings.ToLower(item.name)]
+	isPercent = strings.HasSuffix(value, "%")
+	if isPercent && !item.extra {
+		return item, false, fmt.Errorf("only extras may be given in percent: %q", line)
+	}
+	if item.amount, err = parsePositiveAmount(strings.TrimSuffix(value, "%"), settings); err != nil || len(item.name) == 0 {
+		return item, false, fmt.Errorf("wrong item %q", line)
+	}
+	return item, isPercent, nil
+}
+
+// Reports whether text starts with a number followed by a plain space and
+// more digits, which in an item line is a quantity rather than thousands
+func startsWithLoneNumber(text string) bool {
+	digits := strings.IndexFunc(text, func(r rune) bool { return !unicode.IsDigit(r) })
+	if digits <= 0 || text[digits] != ' ' {
+		return false
+	}
+	rest := strings.TrimLeft(text[digits:], " ")
+	return len(rest) != 0 && unicode.IsDigit(rune(rest[0]))
+}
+
+// Returns total of the receipt and amount charged to every member: own items
+// are split equally between the people sharing them, extras follow in
+// proportion
+func splitItems(items []receiptItem) (total float64, amounts map[int64]float64) {
+	amounts = make(map[int64]float64)
+	var subtotal, extras float64
+	for _, item := range items {
+		if item.extra {
+			extras += item.amount
+			continue
+		}
+		subtotal += item.amount
+		for _, uid := range item.members {
+			amounts[uid] += item.amount / float64(len(item.members))
+		}
+	}
+	for uid := range amounts {
+		amounts[uid] += amounts[uid] * extras / subtotal
+	}
+	return subtotal + extras, amounts
+}
+
+// Asks for the amount paid; a pasted list of "item amount" lines or the
+// Itemise button switch to an itemised receipt
+func askAmountOrItems(chatId int64, replyTo int, settings *groupSettings, bot *tgbotapi2.BotAPI, replyChan <-chan reply) (amount float64, items []receiptItem, replyMsgId int, ok bool) {
+	const (
+		itemise = "itemise"
+		done    = "⏎"
+	)
+	msg := newAbortableMsg(chatId, fmt.Sprintf(settings.tr("How much %s did you %s?"), settings.currency, settings.tr("pay"))+
+		"\n"+settings.tr(`To split by items send "item amount" lines or press Itemise.`))
+	msg.ReplyToMessageID = replyTo
+	msg.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(tgbotapi2.NewInlineKeyboardRow(
+		tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Itemise"), itemise)))
+	sent, _ := bot.Send(msg)
+	clearKb := func() {
+		bot.Send(tgbotapi2.NewEditMessageReplyMarkup(chatId, sent.MessageID, tgbotapi2.NewInlineKeyboardMarkup()))
+	}
+
+	oneByOne := false
+	var lines []string
+	for r := range replyChan {
+		if isAbort(r) {
+			clearKb()
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return 0, nil, 0, false
+		}
+		if r.cb != nil {
+			bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+			switch {
+			case r.cb.Data == itemise && !oneByOne:
+				oneByOne = true
+				kb := tgbotapi2.NewInlineKeyboardMarkup(tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(done, done)))
+				edit := newAbortableEditMsg(chatId, sent.MessageID, settings.tr(`Send items as "item amount", one per line or one per message. Mark shared extras with "+", e.g. "+tip 10%". Press ⏎ when done.`))
+				edit.ReplyMarkup = &kb
+				bot.Send(edit)
+			case r.cb.Data == done && oneByOne:
+				items, err := parseItems(strings.Join(lines, "\n"), settings)
+				if err != nil {
+					bot.Send(tgbotapi2.NewMessage(chatId, err.Error()))
+					continue
+				}
+				clearKb()
+				return 0, items, sent.MessageID, true
+			}
+			continue
+		}
+		if r.msg == nil {
+			continue
+		}
+
+		text := strings.TrimSpace(r.msg.Text)
+		if oneByOne {
+			for _, line := range strings.Split(text, "\n") {
+				if _, _, err := parseItemLine(line, settings); err != nil {
+					bot.Send(tgbotapi2.NewMessage(chatId, err.Error()))
+					continue
+				}
+				lines = append(lines, line)
+			}
+			continue
+		}
+		if strings.Contains(text, "\n") {
+			items, err := parseItems(text, settings)
+			if err != nil {
+				bot.Send(tgbotapi2.NewMessage(chatId, err.Error()))
+				continue
+			}
+			clearKb()
+			return 0, items, r.msg.MessageID, true
+		}
+		amount, err := parsePositiveAmount(text, settings)
+		if err != nil {
+			bot.Send(wrongAmountMsg(chatId, err, settings))
+			continue
+		}
+		clearKb()
+		return amount, nil, r.msg.MessageID, true
+	}
+	return 0, nil, 0, false
+}
+
+// Asks who shared every item of the receipt
+func askItemMembers(chatId int64, replyTo int, items []receiptItem, groupMembers map[int64]string, settings *groupSettings, bot *tgbotapi2.BotAPI, replyChan <-chan reply) (lastCb *tgbotapi2.CallbackQuery, ok bool) {
+	for i := range items {
+		if items[i].extra {
+			continue
+		}
+		question := fmt.Sprintf(settings.tr("Who had %s (%s)?"), items[i].name, settings.money(items[i].amount))
+		if items[i].members, lastCb, ok = askParticipants(chatId, replyTo, question, groupMembers, settings, bot, replyChan); !ok {
+			return nil, false
+		}
+		bot.Send(tgbotapi2.NewEditMessageText(chatId, lastCb.Message.MessageID,
+			fmt.Sprintf("%s — %s", items[i].name, joinNames(items[i].members, groupMembers, settings))))
+	}
+	return lastCb, true
+}
+
+func formatItems(items []receiptItem, names map[int64]string, settings *groupSettings) string {
+	var lines []string
+	for _, item := range items {
+		line := fmt.Sprintf("%s — %s", item.name, settings.money(item.amount))
+		if item.extra {
+			line += " (" + settings.tr("shared extra") + ")"
+		} else {
+			line += "\n    " + joinNames(item.members, names, settings)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func selectTransactionItems(trid int64) (items []receiptItem, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT I.name, I.amount, I.extra, IFNULL(GROUP_CONCAT(S.member_id), '')
+FROM transaction_items I LEFT JOIN transaction_item_shares S ON S.item_id=I.id
+WHERE I.transaction_id=? GROUP BY I.id ORDER BY I.id`, trid)
+	if err != nil {
+		err = fmt.Errorf("select transaction items: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item receiptItem
+		var members string
+		if err = rows.Scan(&item.name, &item.amount, &item.extra, &members); err != nil {
+			err = fmt.Errorf("scan transaction item: %v", err)
+			return
+		}
+		for _, m := range strings.Split(members, ",") {
+			if uid, err := strconv.ParseInt(m, 10, 64); err == nil {
+				item.members = append(item.members, uid)
+			}
+		}
+		items = append(items, item)
+	}
+	return
+}
+
+func itemsHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI) {
+	logPrefix := "items handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	itemsCommand := "items"
+	trid, err := strconv.ParseInt(update.Message.Text[1+len(itemsCommand):], 10, 64)
+	if err != nil {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Invalid transaction index.")))
+		return
+	}
+	groupMembers, err := selectAllGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+	tr, err := selectTransaction(trid)
+	if err != nil {
+		logE.Printf(logPrefix+"select transaction: %v", err)
+		return
+	}
+	var items []receiptItem
+	if tr != nil {
+		if _, ok := groupMembers[tr.owner]; ok {
+			if items, err = selectTransactionItems(trid); err != nil {
+				logE.Printf(logPrefix+"%v", err)
+				return
+			}
+		}
+	}
+	if len(items) == 0 {
+		bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Transaction %d has no items."), trid)))
+		return
+	}
+	bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf("tr #%d: %s, %s\n\n%s",
+		trid, tr.title, settings.money(tr.amount), formatItems(items, groupMembers, settings))))
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestParseItemLine(t *testing.T) {
+	en := &groupSettings{language: "en"}
+	tests := []struct {
+		line      string
+		name      string
+		amount    float64
+		extra     bool
+		isPercent bool
+		wantErr   bool
+	}{
+		{line: "steak 1'500", name: "steak", amount: 1500},
+		{line: "steak 1\u00a0500", name: "steak", amount: 1500},
+		{line: "coffee 2 350", name: "coffee 2", amount: 350},
+		{line: "pizza - 12.50", name: "pizza", amount: 12.5},
+		{line: "set 1 - 15", name: "set 1", amount: 15},
+		{line: "lunch: 2*6", name: "lunch", amount: 12},
+		{line: "steak 15", name: "steak", amount: 15},
+		{line: "2 beers 12,50", name: "2 beers", amount: 12.5},
+		{line: "pizza 4 cheese 12", name: "pizza 4 cheese", amount: 12},
+		{line: "room 3 12", name: "room 3", amount: 12},
+		{line: "wine 2*8.5", name: "wine", amount: 17},
+		{line: "soup € 4.90", name: "soup", amount: 4.9},
+		{line: "+delivery 5", name: "delivery", amount: 5, extra: true},
+		{line: "tip 10%", name: "tip", amount: 10, extra: true, isPercent: true},
+		{line: "bread 10%", wantErr: true},
+		{line: "steak", wantErr: true},
+		{line: "steak medium", wantErr: true},
+		{line: "steak -5", wantErr: true},
+	}
+	for _, tt := range tests {
+		item, isPercent, err := parseItemLine(tt.line, en)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseItemLine(%q) error = %v, want error %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if item.name != tt.name || item.amount != tt.amount || item.extra != tt.extra || isPercent != tt.isPercent {
+			t.Errorf("parseItemLine(%q) = %q %v extra %v percent %v, want %q %v extra %v percent %v",
+				tt.line, item.name, item.amount, item.extra, isPercent, tt.name, tt.amount, tt.extra, tt.isPercent)
+		}
+	}
+}
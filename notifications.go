@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// How a member hears about expenses and repayments entered by others
+const (
+	notifyOn     = "on"
+	notifyMuted  = "muted"  // delivered without a sound
+	notifyDigest = "digest" // collected and sent once a day
+	notifyOff    = "off"
+)
+
+var notifyModeChoices = []string{notifyOn, notifyMuted, notifyDigest, notifyOff}
+
+var notifyModeTitles = map[string]string{
+	notifyOn:     "On",
+	notifyMuted:  "Muted",
+	notifyDigest: "Daily digest",
+	notifyOff:    "Off",
+}
+
+// Hour of the day in group timezone when digests are sent
+const digestHour = 20
+
+// Telegram rejects messages longer than 4096 characters
+const maxMessageLen = 4000
+
+func selectNotifyMode(uid int64, groupId int) (mode string, err error) {
+	err = db.QueryRow(`SELECT mode FROM notification_prefs WHERE member_id=? AND group_id=?`, uid, groupId).Scan(&mode)
+	if err == sql.ErrNoRows {
+		return notifyOn, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("select notification mode: %v", err)
+	}
+	return
+}
+
+// Delivers notice to the member as they chose; must not be called from a
+// task since digests are queued through tasksChan
+func notifyMember(uid int64, text string, settings *groupSettings, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "notify member: "
+
+	if isPlaceholder(uid) {
+		return
+	}
+	mode, err := selectNotifyMode(uid, settings.groupId)
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		mode = notifyOn
+	}
+	switch mode {
+	case notifyOff:
+	case notifyDigest:
+		qt := &queueNotificationTask{uid, settings.groupId, text, time.Now(), make(chan error)}
+		tasksChan <- qt
+		if err := <-qt.err; err != nil {
+			logE.Printf(logPrefix+"execute queue-notification task: %v", err)
+		}
+	default:
+		msg := tgbotapi2.NewMessage(uid, text)
+		msg.DisableNotification = mode == notifyMuted
+		if _, err := bot.Send(msg); err != nil {
+			// Members who never opened a private chat with the bot cannot
+			// be reached
+			logW.Printf(logPrefix+"send to %d: %v", uid, err)
+		}
+	}
+}
+
+// Tells payer and participants, except the one who entered it, about the
+// expense, their share and their new balance; pending shares are asked about
+func notifyTransaction(trid int64, heading string, skipId int64, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "notify transaction: "
+
+	tr, err := selectTransaction(trid)
+	if err != nil || tr == nil {
+		logE.Printf(logPrefix+"select transaction %d: %v", trid, err)
+		return
+	}
+	settings, err := getUserSettings(int(tr.owner))
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	groupMembers, err := selectAllGroupMembers(int(tr.owner))
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+
+	text := describeTransaction(tr, heading, groupMembers, settings)
+
+	recipients := []int64{tr.owner}
+	for _, uid := range sortedMemberIds(groupMembers) {
+		if _, ok := tr.shares[uid]; ok {
+			recipients = append(recipients, uid)
+		}
+	}
+	notified := make(map[int64]bool)
+	for _, uid := range recipients {
+		if notified[uid] {
+			continue
+		}
+		notified[uid] = true
+
+		msgText := text
+		if share, ok := tr.shares[uid]; ok {
+			msgText += "\n" + fmt.Sprintf(settings.tr("Your share: %s"), settings.money(share))
+		}
+		// Pending share is asked about even if the member entered it
+		state, err := selectShareState(trid, uid)
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+		}
+		if state == sharePending {
+			sendSharePrompt(uid, tr, msgText, settings, bot)
+			continue
+		}
+		if uid == skipId {
+			continue
+		}
+		var debt float64
+		if err := calcDebt(int(uid), &debt); err != nil {
+			logE.Printf(logPrefix+"calculate debt: %v", err)
+		} else {
+			msgText += "\n" + debtMessage(settings, debt)
+		}
+		if uid == tr.owner {
+			msgText += fmt.Sprintf("\n/undo%d /edit%d", tr.id, tr.id)
+		}
+		notifyMember(uid, msgText, settings, bot, tasksChan)
+	}
+}
+
+type queuedDigest struct {
+	member  int64
+	groupId int
+	oldest  time.Time
+}
+
+func selectQueuedDigests() (digests []queuedDigest, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT member_id, group_id, created_ts FROM queued_notifications Q
+WHERE id=(SELECT MIN(id) FROM queued_notifications WHERE member_id=Q.member_id AND group_id=Q.group_id)`)
+	if err != nil {
+		err = fmt.Errorf("select queued notifications: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d queuedDigest
+		if err = rows.Scan(&d.member, &d.groupId, &d.oldest); err != nil {
+			err = fmt.Errorf("scan queued notifications: %v", err)
+			return
+		}
+		digests = append(digests, d)
+	}
+	return
+}
+
+func selectQueuedNotifications(uid int64, groupId int) (ids []int64, texts []string, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT id, text FROM queued_notifications WHERE member_id=? AND group_id=? ORDER BY id`, uid, groupId)
+	if err != nil {
+		err = fmt.Errorf("select queued notifications: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var text string
+		if err = rows.Scan(&id, &text); err != nil {
+			err = fmt.Errorf("scan queued notification: %v", err)
+			return
+		}
+		ids = append(ids, id)
+		texts = append(texts, text)
+	}
+	return
+}
+
+// Returns the latest digest time not after now
+func lastDigestTime(now time.Time, loc *time.Location) time.Time {
+	now = now.In(loc)
+	t := time.Date(now.Year(), now.Month(), now.Day(), digestHour, 0, 0, 0, loc)
+	if now.Before(t) {
+		t = t.AddDate(0, 0, -1)
+	}
+	return t
+}
+
+// Sends queued notices once a day; notices which waited through downtime go
+// out on the first run
+func runDigestScheduler(bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "digest scheduler: "
+
+	for ; ; time.Sleep(time.Minute) {
+		digests, err := selectQueuedDigests()
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			continue
+		}
+		for _, d := range digests {
+			settings, err := getUserSettings(int(d.member))
+			if err != nil {
+				logE.Printf(logPrefix+"get settings: %v", err)
+				continue
+			}
+			if !d.oldest.Before(lastDigestTime(time.Now(), settings.location())) {
+				continue
+			}
+			sendDigest(d.member, d.groupId, settings, bot, tasksChan)
+		}
+	}
+}
+
+func sendDigest(uid int64, groupId int, settings *groupSettings, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "send digest: "
+
+	ids, texts, err := selectQueuedNotifications(uid, groupId)
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+	chunk := fmt.Sprintf(settings.tr("Digest of %d notifications:"), len(texts))
+	for _, text := range texts {
+		if len(chunk)+len(text) > maxMessageLen {
+			bot.Send(tgbotapi2.NewMessage(uid, strings.TrimSpace(chunk)))
+			chunk = ""
+		}
+		chunk += "\n\n" + text
+	}
+	if _, err := bot.Send(tgbotapi2.NewMessage(uid, strings.TrimSpace(chunk))); err != nil {
+		logW.Printf(logPrefix+"send to %d: %v", uid, err)
+	}
+
+	ft := &flushNotificationsTask{uid, groupId, ids[len(ids)-1], make(chan error)}
+	tasksChan <- ft
+	if err := <-ft.err; err != nil {
+		logE.Printf(logPrefix+"execute flush-notifications task: %v", err)
+	}
+}
+
+// Lets a member choose how they are told about entries of others
+func notificationsHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "notifications handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	if settings.groupId == 0 {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr(notInGroupMessage)))
+		return
+	}
+	mode, err := selectNotifyMode(int64(callerId), settings.groupId)
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+
+	var rows [][]tgbotapi2.InlineKeyboardButton
+	for _, choice := range notifyModeChoices {
+		title := settings.tr(notifyModeTitles[choice])
+		if choice == mode {
+			title = "✓ " + title
+		}
+		rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(title, choice)))
+	}
+	msg := newAbortableMsg(chatId, fmt.Sprintf(settings.tr("Notifications about expenses and repayments involving you in %s:"), settings.name))
+	msg.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(rows...)
+	sent, _ := bot.Send(msg)
+
+	for r := range replyChan {
+		if isAbort(r) {
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return
+		}
+		if r.cb == nil {
+			continue
+		}
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+		if _, ok := notifyModeTitles[r.cb.Data]; !ok {
+			continue
+		}
+
+		errChan := make(chan error)
+		tasksChan <- &setNotifyModeTask{callerId, settings.groupId, r.cb.Data, errChan}
+		if err := <-errChan; err != nil {
+			logE.Printf(logPrefix+"execute set-notify-mode task: %v", err)
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, settings.tr("Failed to save the setting.")))
+			return
+		}
+		bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID,
+			fmt.Sprintf(settings.tr("Notifications: %s"), settings.tr(notifyModeTitles[r.cb.Data]))))
+		return
+	}
+}
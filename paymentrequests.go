@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// States of a payment request sent with /request
+const (
+	requestOpen      = "open"
+	requestPaid      = "paid"
+	requestCancelled = "cancelled" // replaced by a newer request
+)
+
+// Callback data of the debtor's "I paid" button, followed by request id; it
+// is pressed outside of any conversation
+const paidRequestPrefix = "paidreq:"
+
+type paymentRequest struct {
+	id       int64
+	creditor int64
+	debtor   int64
+	amount   float64
+	state    string
+	created  time.Time
+	paying   bool // repayment waits for the creditor to confirm it
+}
+
+func scanPaymentRequests(rows *sql.Rows) (requests []paymentRequest, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var pr paymentRequest
+		var repaymentId sql.NullInt64
+		if err = rows.Scan(&pr.id, &pr.creditor, &pr.debtor, &pr.amount, &pr.state, &pr.created, &repaymentId); err != nil {
+			return nil, fmt.Errorf("scan payment request: %v", err)
+		}
+		pr.paying = repaymentId.Valid
+		requests = append(requests, pr)
+	}
+	return
+}
+
+func selectPaymentRequest(id int64) (*paymentRequest, error) {
+	rows, err := db.Query(`SELECT id, creditor_id, debtor_id, amount, state, created_ts, repayment_id FROM payment_requests WHERE id=?`, id)
+	if err != nil {
+		return nil, fmt.Errorf("select payment request: %v", err)
+	}
+	requests, err := scanPaymentRequests(rows)
+	if err != nil || len(requests) == 0 {
+		return nil, err
+	}
+	return &requests[0], nil
+}
+
+// Returns open requests sent or received by the member
+func selectOpenPaymentRequests(uid int) ([]paymentRequest, error) {
+	rows, err := db.Query(`SELECT id, creditor_id, debtor_id, amount, state, created_ts, repayment_id FROM payment_requests
+WHERE (creditor_id=? OR debtor_id=?) AND state=? ORDER BY id`, uid, uid, requestOpen)
+	if err != nil {
+		return nil, fmt.Errorf("select open payment requests: %v", err)
+	}
+	return scanPaymentRequests(rows)
+}
+
+// Describes pair balance from the debtor's side
+func pairDebtMessage(settings *groupSettings, name string, debt float64) string {
+	if debt > 0 {
+		return fmt.Sprintf(settings.tr("You owe %s %s."), name, settings.money(debt))
+	} else if debt < 0 {
+		return fmt.Sprintf(settings.tr("%s owes you %s."), name, settings.money(-debt))
+	}
+	return fmt.Sprintf(settings.tr("You and %s are even."), name)
+}
+
+func paidRequestKb(pr *paymentRequest, title string) tgbotapi2.InlineKeyboardMarkup {
+	return tgbotapi2.NewInlineKeyboardMarkup(tgbotapi2.NewInlineKeyboardRow(
+		tgbotapi2.NewInlineKeyboardButtonData(title, fmt.Sprintf("%s%d", paidRequestPrefix, pr.id))))
+}
+
+// Requests are closed when the debtor pays the debt off in any way
+func closeSettledRequests(creditor, debtor int64, tasksChan chan<- task) {
+	logPrefix := "close settled requests: "
+
+	var debt float64
+	if err := calcPairDebt(int(debtor), int(creditor), &debt); err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+	if debt > 0 {
+		return
+	}
+	ct := &closePaymentRequestsTask{creditor, debtor, make(chan error)}
+	tasksChan <- ct
+	if err := <-ct.err; err != nil {
+		logE.Printf(logPrefix+"execute close-payment-requests task: %v", err)
+	}
+}
+
+// Asks member for money they owe; the amount defaults to their pair balance
+func requestHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "request handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	if settings.groupId == 0 {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr(notInGroupMessage)))
+		return
+	}
+	if isReadOnly(settings, chatId, bot) {
+		return
+	}
+
+	// One-line form like "/request @alice 20"
+	argsText := commandArguments(update.Message.Text)
+	args, err := parseCommandLine(argsText, true, callerId, settings)
+	if err != nil {
+		if _, ok := err.(*errorBadToken); !ok {
+			logE.Printf(logPrefix+"parse arguments: %v", err)
+			return
+		}
+		bot.Send(tgbotapi2.NewMessage(chatId, describeBadToken(argsText, err, settings)))
+		return
+	}
+
+	groupMembers, err := selectGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+
+	var debtorId int64
+	if len(args.participants) == 1 {
+		debtorId = args.participants[0]
+	} else {
+		// Offer members who owe the caller
+		var rows [][]tgbotapi2.InlineKeyboardButton
+		for _, uid := range sortedMemberIds(groupMembers) {
+			if uid == int64(callerId) || isPlaceholder(uid) {
+				continue
+			}
+			var debt float64
+			if err := calcPairDebt(int(uid), callerId, &debt); err != nil {
+				logE.Printf(logPrefix+"%v", err)
+				return
+			}
+			if debt <= 0 {
+				continue
+			}
+			title := fmt.Sprintf("%s: %s", groupMembers[uid], settings.money(debt))
+			rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(title, strconv.FormatInt(uid, 10))))
+		}
+		if len(rows) == 0 {
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Nobody owes you anything.")))
+			return
+		}
+		msgWho := newAbortableMsg(chatId, settings.tr("Who should pay you back?"))
+		msgWho.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(rows...)
+		sent, _ := bot.Send(msgWho)
+
+		for debtorId == 0 {
+			r := <-replyChan
+			if isAbort(r) {
+				bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
+				bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+				return
+			}
+			if r.cb == nil {
+				continue
+			}
+			bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+			if debtorId, err = strconv.ParseInt(r.cb.Data, 10, 64); err != nil {
+				logI.Printf(logPrefix+"selected: %q", r.cb.Data)
+				return
+			}
+		}
+		bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, settings.tr("Okay, I got it.")))
+	}
+
+	debtorName := groupMembers[debtorId]
+	if debtorId == int64(callerId) {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("You cannot request money from yourself.")))
+		return
+	}
+	if isPlaceholder(debtorId) {
+		bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("%s has no Telegram account to send the request to."), debtorName)))
+		return
+	}
+
+	var debt float64
+	if err := calcPairDebt(int(debtorId), callerId, &debt); err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+	amount := args.amount
+	if amount == 0 {
+		if debt <= 0 {
+			bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("%s owes you nothing."), debtorName)))
+			return
+		}
+		amount = debt
+	}
+
+	rt := &requestPaymentTask{creditor: callerId, debtor: int(debtorId), amount: amount, err: make(chan error)}
+	tasksChan <- rt
+	if err := <-rt.err; err != nil {
+		logE.Printf(logPrefix+"execute request-payment task: %v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Failed to register operation")))
+		return
+	}
+
+	creditorName := groupMembers[int64(callerId)]
+	pr := &paymentRequest{id: rt.id, creditor: int64(callerId), debtor: debtorId, amount: amount}
+	msgText := fmt.Sprintf(settings.tr("%s asks you to pay back %s."), creditorName, settings.money(amount)) +
+		"\n" + pairDebtMessage(settings, creditorName, debt)
+	msg := tgbotapi2.NewMessage(debtorId, msgText)
+	msg.ReplyMarkup = paidRequestKb(pr, settings.tr("I paid"))
+	if _, err := bot.Send(msg); err != nil {
+		logW.Printf(logPrefix+"send to %d: %v", debtorId, err)
+		bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Could not reach %s, the request is kept in /requests."), debtorName)))
+		return
+	}
+	bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Asked %s to pay back %s."), debtorName, settings.money(amount))))
+}
+
+// Lists open requests sent and received by the caller; received ones can be
+// paid from here
+func requestsHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI) {
+	logPrefix := "requests handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	requests, err := selectOpenPaymentRequests(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+	if len(requests) == 0 {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("No open payment requests.")))
+		return
+	}
+	names, err := selectAllGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+
+	var sentLines, receivedLines []string
+	var rows [][]tgbotapi2.InlineKeyboardButton
+	for i := range requests {
+		pr := &requests[i]
+		status := ""
+		if pr.paying {
+			status = " (" + settings.tr("waiting for confirmation") + ")"
+		}
+		if pr.creditor == int64(callerId) {
+			sentLines = append(sentLines, fmt.Sprintf(settings.tr("%s from %s since %s"),
+				settings.money(pr.amount), names[pr.debtor], settings.formatTime(pr.created))+status)
+			continue
+		}
+		receivedLines = append(receivedLines, fmt.Sprintf(settings.tr("%s to %s since %s"),
+			settings.money(pr.amount), names[pr.creditor], settings.formatTime(pr.created))+status)
+		if !pr.paying {
+			title := fmt.Sprintf(settings.tr("I paid %s to %s"), settings.money(pr.amount), names[pr.creditor])
+			rows = append(rows, paidRequestKb(pr, title).InlineKeyboard...)
+		}
+	}
+
+	var sections []string
+	if len(sentLines) != 0 {
+		sections = append(sections, settings.tr("You asked for:")+"\n"+strings.Join(sentLines, "\n"))
+	}
+	if len(receivedLines) != 0 {
+		sections = append(sections, settings.tr("You were asked for:")+"\n"+strings.Join(receivedLines, "\n"))
+	}
+	msg := tgbotapi2.NewMessage(chatId, strings.Join(sections, "\n\n"))
+	if len(rows) != 0 {
+		msg.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(rows...)
+	}
+	bot.Send(msg)
+}
+
+// Handles "I paid" button: gives the requested amount back to the creditor,
+// who is asked to confirm it as any other repayment
+func paidRequestHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "paid request handler: "
+
+	cb := update.CallbackQuery
+	if cb.Message == nil {
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, ""))
+		return
+	}
+	callerId := cb.From.ID
+	chatId := cb.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(cb.Data, paidRequestPrefix), 10, 64)
+	if err != nil {
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, ""))
+		return
+	}
+	pr, err := selectPaymentRequest(id)
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+	groupMembers, err := selectGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+	if pr == nil || pr.debtor != int64(callerId) || pr.state != requestOpen || pr.paying {
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, settings.tr("Nothing to pay.")))
+		return
+	}
+	if _, ok := groupMembers[pr.creditor]; !ok {
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, settings.tr("Nothing to pay.")))
+		return
+	}
+	if isReadOnly(settings, chatId, bot) {
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, ""))
+		return
+	}
+	bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, ""))
+
+	// Drop the button so that the request is not paid twice
+	bot.Send(tgbotapi2.NewEditMessageText(chatId, cb.Message.MessageID, cb.Message.Text))
+	giveBack(chatId, pr.amount, callerId, int(pr.creditor), pr.id, groupMembers, settings, bot, tasksChan)
+}
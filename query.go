@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Parses /find arguments: free text plus optional from:, to:, by:@member,
+// for:@member, >amount and <amount filters
+func parseFindQuery(text string, settings *groupSettings, members []member) (filter transactionFilter, err error) {
+	var words []string
+	for _, token := range strings.Fields(text) {
+		lower := strings.ToLower(token)
+		switch {
+		case strings.HasPrefix(lower, "from:"):
+			var day time.Time
+			if day, err = parseDay(token[len("from:"):], settings); err != nil {
+				return
+			}
+			filter.from = day
+		case strings.HasPrefix(lower, "to:"):
+			var day time.Time
+			if day, err = parseDay(token[len("to:"):], settings); err != nil {
+				return
+			}
+			filter.to = day.AddDate(0, 0, 1)
+		case strings.HasPrefix(lower, "by:"):
+			if filter.payer, err = resolveMember(token[len("by:"):], members); err != nil {
+				return
+			}
+		case strings.HasPrefix(lower, "for:"):
+			if filter.participant, err = resolveMember(token[len("for:"):], members); err != nil {
+				return
+			}
+		case strings.HasPrefix(token, ">") || strings.HasPrefix(token, "<"):
+			var amount float64
+			if amount, err = parseAmount(token[1:], settings); err != nil || amount < 0 {
+				err = fmt.Errorf("wrong amount %q", token)
+				return
+			}
+			if token[0] == '>' {
+				filter.minAmount, filter.hasMinAmount = amount, true
+			} else {
+				filter.maxAmount, filter.hasMaxAmount = amount, true
+			}
+		default:
+			words = append(words, token)
+		}
+	}
+	filter.text = strings.Join(words, " ")
+	return
+}
+
+// Returns start of the day typed in group date format
+func parseDay(text string, settings *groupSettings) (time.Time, error) {
+	t, err := settings.parseDate(text)
+	if err != nil {
+		return t, fmt.Errorf("wrong date %q: %v", text, err)
+	}
+	t = t.In(settings.location())
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, settings.location()), nil
+}
+
+// Finds group member referenced as @username, nickname or name; spaces may
+// be omitted and a unique prefix is enough
+func resolveMember(token string, members []member) (int64, error) {
+	needle := normalizeMemberRef(strings.TrimPrefix(token, "@"))
+	if len(needle) == 0 {
+		return 0, fmt.Errorf("empty member reference %q", token)
+	}
+
+	names := displayNames(members)
+	var exact, prefix []int64
+	for _, m := range members {
+		refs := []string{m.username, m.nickname, m.name, names[m.id]}
+		matched := false
+		for _, ref := range refs {
+			if len(ref) != 0 && normalizeMemberRef(ref) == needle {
+				exact = append(exact, m.id)
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		for _, ref := range refs {
+			if len(ref) != 0 && strings.HasPrefix(normalizeMemberRef(ref), needle) {
+				prefix = append(prefix, m.id)
+				break
+			}
+		}
+	}
+
+	switch {
+	case len(exact) == 1:
+		return exact[0], nil
+	case len(exact) == 0 && len(prefix) == 1:
+		return prefix[0], nil
+	case len(exact) > 1 || len(prefix) > 1:
+		return 0, fmt.Errorf("ambiguous member %q", token)
+	}
+	return 0, fmt.Errorf("unknown member %q", token)
+}
+
+func normalizeMemberRef(ref string) string {
+	return strings.ToLower(strings.Join(strings.Fields(ref), ""))
+}
+
+// Arguments of one-line /ipay and /igive, zero values are asked for in the
+// conversation
+type commandArgs struct {
+	amount       float64
+	title        string
+	payer        int64
+	participants []int64
+	categoryId   int64
+	ts           time.Time
+}
+
+// Parses "/ipay 25.50 pizza @alice @bob" style arguments: the first number is
+// the amount, @member, "all" and "except @member" pick participants, by:@member
+// sets the payer, #category, on:date, "today" and "yesterday" are recognised
+// as well and the remaining words make the title. Bare keywords followed by a
+// title word are part of the title, so "all you can eat" stays a title.
+// Repayments take only the amount and the recipient.
+func parseCommandArgs(text string, repayment bool, settings *groupSettings, members []member, categories []category) (args commandArgs, err error) {
+	var active []member
+	for _, m := range members {
+		if m.active {
+			active = append(active, m)
+		}
+	}
+
+	var words []string
+	var included, excluded []int64
+	all, except := false, false
+	tokens := strings.Fields(text)
+	for pos, token := range tokens {
+		bad := func(reason string) error {
+			return &errorBadToken{pos, token, reason}
+		}
+		lower := strings.ToLower(token)
+		next := ""
+		if pos+1 < len(tokens) {
+			next = tokens[pos+1]
+		}
+		keyword := !args.isTitleWord(next)
+		switch {
+		case args.amount == 0 && isAmountToken(token):
+			if args.amount, err = parseAmount(token, settings); err != nil {
+				return args, bad(err.Error())
+			}
+			if args.amount <= 0 {
+				return args, bad("amount must be positive")
+			}
+		case strings.HasPrefix(token, "@"):
+			uid, err := resolveMember(token, active)
+			if err != nil {
+				return args, bad("no such member in the group")
+			}
+			if except {
+				excluded = append(excluded, uid)
+			} else {
+				included = append(included, uid)
+			}
+		case repayment:
+			return args, bad("expected amount or @member")
+		case (lower == "all" || lower == "everyone") && keyword:
+			all = true
+		case (lower == "except" || lower == "but") && strings.HasPrefix(next, "@"):
+			if !all {
+				return args, bad(`use it after "all"`)
+			}
+			except = true
+		case strings.HasPrefix(lower, "by:"):
+			if args.payer, err = resolveMember(token[len("by:"):], active); err != nil {
+				return args, bad("no such member in the group")
+			}
+		case strings.HasPrefix(lower, "on:"):
+			if args.ts, err = settings.parseDate(token[len("on:"):]); err != nil {
+				return args, bad(err.Error())
+			}
+		case lower == "today" && keyword:
+			args.ts = settings.now()
+		case lower == "yesterday" && keyword:
+			args.ts = settings.now().AddDate(0, 0, -1)
+		case strings.HasPrefix(token, "#") && len(token) > 1:
+			if args.categoryId, err = resolveCategory(token[1:], categories); err != nil {
+				return args, bad(err.Error())
+			}
+		default:
+			except = false
+			words = append(words, token)
+		}
+	}
+	if repayment && len(included) > 1 {
+		return args, &errorBadToken{-1, text, "name only one member"}
+	}
+
+	args.title = strings.Join(words, " ")
+	skip := make(map[int64]bool)
+	for _, uid := range excluded {
+		skip[uid] = true
+	}
+	if all {
+		for _, m := range active {
+			if !skip[m.id] {
+				args.participants = append(args.participants, m.id)
+			}
+		}
+	} else {
+		for _, uid := range included {
+			if !skip[uid] {
+				args.participants = append(args.participants, uid)
+				skip[uid] = true
+			}
+		}
+	}
+	return args, nil
+}
+
+// Reports whether token would be taken as a word of the title, empty token
+// is the end of arguments
+func (args *commandArgs) isTitleWord(token string) bool {
+	lower := strings.ToLower(token)
+	switch {
+	case len(token) == 0:
+		return false
+	case args.amount == 0 && isAmountToken(token):
+		return false
+	case strings.HasPrefix(token, "@"), strings.HasPrefix(token, "#") && len(token) > 1:
+		return false
+	case strings.HasPrefix(lower, "by:"), strings.HasPrefix(lower, "on:"):
+		return false
+	}
+	switch lower {
+	case "all", "everyone", "except", "but", "today", "yesterday":
+		return false
+	}
+	return true
+}
+
+// Numbers, possibly with a currency sign, start an amount
+func isAmountToken(token string) bool {
+	r, _ := utf8.DecodeRuneInString(token)
+	return unicode.IsDigit(r) || strings.ContainsRune(currencySigns, r)
+}
+
+// Finds category by case-insensitive name or unique prefix
+func resolveCategory(name string, categories []category) (int64, error) {
+	needle := normalizeMemberRef(name)
+	var prefix []int64
+	for _, c := range categories {
+		ref := normalizeMemberRef(c.name)
+		if ref == needle {
+			return c.id, nil
+		}
+		if strings.HasPrefix(ref, needle) {
+			prefix = append(prefix, c.id)
+		}
+	}
+	if len(prefix) == 1 {
+		return prefix[0], nil
+	}
+	if len(prefix) > 1 {
+		return 0, fmt.Errorf("ambiguous category")
+	}
+	return 0, fmt.Errorf("no such category")
+}
+
+// Repeats command arguments marking the one which could not be parsed
+func describeBadToken(text string, err error, settings *groupSettings) string {
+	ebt, ok := err.(*errorBadToken)
+	if !ok {
+		return err.Error()
+	}
+	if ebt.pos < 0 {
+		return fmt.Sprintf(settings.tr("Cannot parse %q: %s."), ebt.token, ebt.reason)
+	}
+	tokens := strings.Fields(text)
+	if ebt.pos < len(tokens) {
+		tokens[ebt.pos] = "👉" + tokens[ebt.pos]
+	}
+	return fmt.Sprintf(settings.tr("Cannot parse %q: %s.")+"\n%s", ebt.token, ebt.reason, strings.Join(tokens, " "))
+}
+
+// Returns text following the command name, empty for a bare command
+func commandArguments(text string) string {
+	if idx := strings.IndexAny(text, " \t\n"); idx != -1 {
+		return strings.TrimSpace(text[idx:])
+	}
+	return ""
+}
+
+// Parses one-line command arguments against members and categories of
+// user's group
+func parseCommandLine(text string, repayment bool, uid int, settings *groupSettings) (args commandArgs, err error) {
+	if len(text) == 0 {
+		return
+	}
+	members, err := selectGroupMemberList(uid)
+	if err != nil {
+		return
+	}
+	var categories []category
+	if !repayment {
+		if categories, err = selectGroupCategories(uid); err != nil {
+			return
+		}
+	}
+	return parseCommandArgs(text, repayment, settings, members, categories)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCommandArgs(t *testing.T) {
+	settings := &groupSettings{language: "en", dateFormat: "02/01/2006 15:04", timezone: "UTC"}
+	members := []member{
+		{id: 1, name: "Alice", active: true},
+		{id: 2, name: "Bob", active: true},
+		{id: 3, name: "Carol", active: true},
+		{id: 4, name: "Dave"},
+	}
+	categories := []category{{10, "Food"}, {11, "Transport"}}
+	fixed := time.Date(2024, 3, 10, 23, 30, 0, 0, time.UTC)
+	clock = func() time.Time { return fixed }
+	defer func() { clock = time.Now }()
+	today := "2024-03-10"
+	yesterday := "2024-03-09"
+
+	tests := []struct {
+		text         string
+		repayment    bool
+		amount       float64
+		title        string
+		payer        int64
+		participants []int64
+		categoryId   int64
+		date         string // day of ts, empty for zero ts
+		err          string // describeBadToken of the error
+	}{
+		{text: "25.50 pizza @alice @bob", amount: 25.5, title: "pizza", participants: []int64{1, 2}},
+		{text: "pizza 25.50", amount: 25.5, title: "pizza"},
+		{text: "30 all you can eat", amount: 30, title: "all you can eat"},
+		{text: "30 all you can eat all", amount: 30, title: "all you can eat", participants: []int64{1, 2, 3}},
+		{text: "30 dinner for everyone", amount: 30, title: "dinner for", participants: []int64{1, 2, 3}},
+		{text: "30 everyone loves pizza @carol", amount: 30, title: "everyone loves pizza", participants: []int64{3}},
+		{text: "30 pizza all except @bob", amount: 30, title: "pizza", participants: []int64{1, 3}},
+		{text: "30 pizza all but @bob @carol", amount: 30, title: "pizza", participants: []int64{1}},
+		{text: "12 fish but no chips", amount: 12, title: "fish but no chips"},
+		{text: "12 all except pizza", amount: 12, title: "except pizza", participants: []int64{1, 2, 3}},
+		{text: "12 today special", amount: 12, title: "today special"},
+		{text: "12 taxi today", amount: 12, title: "taxi", date: today},
+		{text: "12 taxi yesterday #transport", amount: 12, title: "taxi", categoryId: 11, date: yesterday},
+		{text: "12 yesterday once more", amount: 12, title: "yesterday once more"},
+		{text: "12 taxi by:bob on:05/03/2024", amount: 12, title: "taxi", payer: 2, date: "2024-03-05"},
+		{text: "12 taxi on:2024-03-05 by:@carol", amount: 12, title: "taxi", payer: 3, date: "2024-03-05"},
+		{text: "12 lunch #fo", amount: 12, title: "lunch", categoryId: 10},
+		{text: "10 @bob", repayment: true, amount: 10, participants: []int64{2}},
+
+		{text: "12 taxi except @bob", err: "Cannot parse \"except\": use it after \"all\".\n12 taxi 👉except @bob"},
+		{text: "12 taxi by:dave", err: "Cannot parse \"by:dave\": no such member in the group.\n12 taxi 👉by:dave"},
+		{text: "12 taxi on:tomorrow", err: "Cannot parse \"on:tomorrow\": use format 10/03/2024 23:30.\n12 taxi 👉on:tomorrow"},
+		{text: "12 taxi #x", err: "Cannot parse \"#x\": no such category.\n12 taxi 👉#x"},
+		{text: "0 taxi", err: "Cannot parse \"0\": amount must be positive.\n👉0 taxi"},
+		{text: "10 @bob thanks", repayment: true, err: "Cannot parse \"thanks\": expected amount or @member.\n10 @bob 👉thanks"},
+		{text: "10 @bob @carol", repayment: true, err: "Cannot parse \"10 @bob @carol\": name only one member."},
+	}
+	for _, tt := range tests {
+		args, err := parseCommandArgs(tt.text, tt.repayment, settings, members, categories)
+		if err != nil || len(tt.err) != 0 {
+			got := ""
+			if err != nil {
+				got = describeBadToken(tt.text, err, settings)
+			}
+			if got != tt.err {
+				t.Errorf("parseCommandArgs(%q) error = %q, want %q", tt.text, got, tt.err)
+			}
+			continue
+		}
+		if args.amount != tt.amount || args.title != tt.title || args.payer != tt.payer || args.categoryId != tt.categoryId {
+			t.Errorf("parseCommandArgs(%q) = amount %v, title %q, payer %d, category %d, want %v, %q, %d, %d",
+				tt.text, args.amount, args.title, args.payer, args.categoryId, tt.amount, tt.title, tt.payer, tt.categoryId)
+		}
+		if !reflect.DeepEqual(args.participants, tt.participants) {
+			t.Errorf("parseCommandArgs(%q) participants = %v, want %v", tt.text, args.participants, tt.participants)
+		}
+		date := ""
+		if !args.ts.IsZero() {
+			date = args.ts.Format("2006-01-02")
+		}
+		if date != tt.date {
+			t.Errorf("parseCommandArgs(%q) date = %q, want %q", tt.text, date, tt.date)
+		}
+	}
+}
+
+func TestParseCommandArgsGroupDay(t *testing.T) {
+	settings := &groupSettings{language: "en", dateFormat: "02/01/2006 15:04", timezone: "Asia/Tokyo"}
+	fixed := time.Date(2024, 3, 10, 23, 30, 0, 0, time.UTC)
+	clock = func() time.Time { return fixed }
+	defer func() { clock = time.Now }()
+
+	for text, want := range map[string]string{"12 taxi today": "2024-03-11", "12 taxi yesterday": "2024-03-10"} {
+		args, err := parseCommandArgs(text, false, settings, nil, nil)
+		if err != nil {
+			t.Fatalf("parseCommandArgs(%q) error = %v", text, err)
+		}
+		if date := args.ts.Format("2006-01-02"); date != want {
+			t.Errorf("parseCommandArgs(%q) date = %q, want %q", text, date, want)
+		}
+	}
+}
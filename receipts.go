@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Directory keeping local copies of receipt photos, empty to keep only
+// Telegram file ids
+var receiptsDir string
+
+// Returns id of the largest size of the photo, empty if message has no photo
+func largestPhoto(msg *tgbotapi2.Message) string {
+	if msg == nil || msg.Photo == nil || len(*msg.Photo) == 0 {
+		return ""
+	}
+	photos := *msg.Photo
+	return photos[len(photos)-1].FileID
+}
+
+// Returns id of the transaction announced by the bot in "tr #N" message or
+// photo caption
+func parseTransactionRef(msg *tgbotapi2.Message) (trid int64, ok bool) {
+	if msg == nil {
+		return 0, false
+	}
+	text := msg.Text
+	if len(text) == 0 {
+		text = msg.Caption
+	}
+	_, err := fmt.Sscanf(text, "tr #%d", &trid)
+	return trid, err == nil
+}
+
+// Downloads receipt photo into a temporary file of receiptsDir; returns it
+// along with the path it should be renamed to once the receipt is stored
+func saveReceiptCopy(trid int64, fileId string, bot *tgbotapi2.BotAPI) (tmpPath, path string, err error) {
+	if len(receiptsDir) == 0 {
+		return "", "", nil
+	}
+	url, err := bot.GetFileDirectURL(fileId)
+	if err != nil {
+		return "", "", fmt.Errorf("get file url: %v", err)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", "", fmt.Errorf("download file: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("download file: %s", resp.Status)
+	}
+
+	f, err := ioutil.TempFile(receiptsDir, fmt.Sprintf("receipt-%d-*.part", trid))
+	if err != nil {
+		return "", "", fmt.Errorf("create file: %v", err)
+	}
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", "", fmt.Errorf("write file: %v", err)
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", "", fmt.Errorf("close file: %v", err)
+	}
+	return f.Name(), filepath.Join(receiptsDir, fmt.Sprintf("receipt-%d%s", trid, filepath.Ext(url))), nil
+}
+
+// Stores photo as the receipt of the transaction, replacing a previous one
+func attachReceipt(callerId int, trid int64, fileId string, bot *tgbotapi2.BotAPI, tasksChan chan<- task) error {
+	// Local copy of the current receipt must stay intact when the caller
+	// cannot replace it
+	allowed, err := canModifyTransaction(trid, callerId)
+	if err != nil {
+		return fmt.Errorf("check access: %v", err)
+	}
+	if !allowed {
+		return &errorNotAllowed{}
+	}
+	tmpPath, path, err := saveReceiptCopy(trid, fileId, bot)
+	if err != nil {
+		logW.Printf("save local copy of receipt for transaction %d: %v", trid, err)
+	}
+	errChan := make(chan error)
+	tasksChan <- &attachReceiptTask{callerId, trid, fileId, path, errChan}
+	if err = <-errChan; err != nil {
+		if len(tmpPath) != 0 {
+			os.Remove(tmpPath)
+		}
+		return err
+	}
+	if len(tmpPath) != 0 {
+		if err := os.Rename(tmpPath, path); err != nil {
+			logW.Printf("rename local copy of receipt for transaction %d: %v", trid, err)
+		}
+	}
+	return nil
+}
+
+// Handles photo sent as a reply to the "tr #N" message of the bot
+func attachReceiptHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "attach receipt handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+	trid, _ := parseTransactionRef(update.Message.ReplyToMessage)
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	if isReadOnly(settings, chatId, bot) {
+		return
+	}
+	if err = attachReceipt(callerId, trid, largestPhoto(update.Message), bot, tasksChan); err != nil {
+		if _, ok := err.(*errorNotAllowed); ok {
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("You are not allowed to change this transaction.")))
+			return
+		}
+		logE.Printf(logPrefix+"attach receipt: %v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Failed to attach the receipt.")))
+		return
+	}
+	bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Receipt attached to transaction %d. /receipt%d"), trid, trid)))
+}
+
+func receiptHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI) {
+	logPrefix := "receipt handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	receiptCommand := "receipt"
+	trid, err := strconv.ParseInt(update.Message.Text[1+len(receiptCommand):], 10, 64)
+	if err != nil {
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Invalid transaction index.")))
+		return
+	}
+	fileId, path, err := selectReceipt(trid, callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+	if len(fileId) == 0 {
+		bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Transaction %d has no receipt."), trid)))
+		return
+	}
+
+	photo := tgbotapi2.NewPhotoShare(chatId, fileId)
+	photo.Caption = fmt.Sprintf("tr #%d", trid)
+	if _, err = bot.Send(photo); err != nil && len(path) != 0 {
+		// File ids may expire, local copy is the fallback
+		logW.Printf(logPrefix+"send receipt by file id: %v", err)
+		photo = tgbotapi2.NewPhotoUpload(chatId, path)
+		photo.Caption = fmt.Sprintf("tr #%d", trid)
+		_, err = bot.Send(photo)
+	}
+	if err != nil {
+		logE.Printf(logPrefix+"send receipt: %v", err)
+	}
+}
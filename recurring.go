@@ -0,0 +1,470 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	scheduleMonthly = "monthly"
+	scheduleWeekly  = "weekly"
+	scheduleYearly  = "yearly"
+)
+
+var scheduleChoices = []string{scheduleMonthly, scheduleWeekly, scheduleYearly}
+
+var scheduleTitles = map[string]string{
+	scheduleMonthly: "Monthly",
+	scheduleWeekly:  "Weekly",
+	scheduleYearly:  "Yearly",
+}
+
+// Expense template which the scheduler turns into a transaction whenever it
+// is due
+type recurringExpense struct {
+	id         int64
+	owner      int64
+	title      string
+	amount     float64
+	categoryId int64
+	schedule   string
+	day        int // day of month, or weekday for weekly schedule
+	month      int // month of yearly schedule
+	next       time.Time
+	nextAmount float64           // replaces amount of the next occurrence only, zero if unset
+	shares     map[int64]float64 // weight of every participant
+}
+
+// Returns the first occurrence strictly after t; occurrences are dated noon in
+// group timezone and days past the end of a month fall on its last day
+func (re *recurringExpense) nextAfter(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	noon := func(y int, m time.Month, d int) time.Time {
+		if last := time.Date(y, m+1, 0, 0, 0, 0, 0, loc).Day(); d > last {
+			d = last
+		}
+		return time.Date(y, m, d, 12, 0, 0, 0, loc)
+	}
+	switch re.schedule {
+	case scheduleWeekly:
+		next := time.Date(t.Year(), t.Month(), t.Day()+(re.day-int(t.Weekday())+7)%7, 12, 0, 0, 0, loc)
+		if !next.After(t) {
+			next = next.AddDate(0, 0, 7)
+		}
+		return next
+	case scheduleYearly:
+		for y := t.Year(); ; y++ {
+			if next := noon(y, time.Month(re.month), re.day); next.After(t) {
+				return next
+			}
+		}
+	default:
+		for first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc); ; first = first.AddDate(0, 1, 0) {
+			if next := noon(first.Year(), first.Month(), re.day); next.After(t) {
+				return next
+			}
+		}
+	}
+}
+
+func (re *recurringExpense) describeSchedule(settings *groupSettings) string {
+	switch re.schedule {
+	case scheduleWeekly:
+		return fmt.Sprintf(settings.tr("weekly on %s"), settings.tr(time.Weekday(re.day).String()))
+	case scheduleYearly:
+		return fmt.Sprintf(settings.tr("yearly on %d %s"), re.day, settings.tr(time.Month(re.month).String()))
+	}
+	return fmt.Sprintf(settings.tr("monthly on day %d"), re.day)
+}
+
+const recurringColumns = `R.id, R.owner_id, R.title, R.amount, IFNULL(R.category_id, 0), R.schedule, R.schedule_day, R.schedule_month,
+R.next_ts, IFNULL(R.next_amount, 0)`
+
+func scanRecurring(rows interface {
+	Scan(dest ...interface{}) error
+}) (re recurringExpense, err error) {
+	err = rows.Scan(&re.id, &re.owner, &re.title, &re.amount, &re.categoryId, &re.schedule, &re.day, &re.month, &re.next, &re.nextAmount)
+	return
+}
+
+func selectRecurringShares(id int64) (shares map[int64]float64, err error) {
+	shares = make(map[int64]float64)
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT member_id, weight FROM recurring_shares WHERE recurring_id=?`, id)
+	if err != nil {
+		err = fmt.Errorf("select recurring shares: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid int64
+		var weight float64
+		if err = rows.Scan(&uid, &weight); err != nil {
+			err = fmt.Errorf("scan recurring share: %v", err)
+			return
+		}
+		shares[uid] = weight
+	}
+	return
+}
+
+func selectRecurring(id int64) (re *recurringExpense, err error) {
+	var e recurringExpense
+	e, err = scanRecurring(db.QueryRow(`SELECT `+recurringColumns+` FROM recurring R WHERE R.id=?`, id))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			err = fmt.Errorf("select recurring expense %d: %v", id, err)
+		}
+		return
+	}
+	if e.shares, err = selectRecurringShares(id); err != nil {
+		return
+	}
+	return &e, nil
+}
+
+func selectGroupRecurring(uid int) (entries []recurringExpense, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT `+recurringColumns+` FROM recurring R
+WHERE R.owner_id IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?))
+ORDER BY R.next_ts, R.id`, uid)
+	if err != nil {
+		err = fmt.Errorf("select group recurring expenses: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e recurringExpense
+		if e, err = scanRecurring(rows); err != nil {
+			err = fmt.Errorf("scan recurring expense: %v", err)
+			return
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+
+	for i := range entries {
+		if entries[i].shares, err = selectRecurringShares(entries[i].id); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func selectDueRecurring(now time.Time) (ids []int64, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT id FROM recurring WHERE next_ts<=? ORDER BY next_ts`, now.UTC())
+	if err != nil {
+		err = fmt.Errorf("select due recurring expenses: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			err = fmt.Errorf("scan due recurring expense: %v", err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+// Creates due recurring expenses once a minute; occurrences missed while the
+// bot was down are created on the first run, each with its own date
+func runRecurringScheduler(bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "recurring scheduler: "
+
+	for ; ; time.Sleep(time.Minute) {
+		ids, err := selectDueRecurring(time.Now())
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			continue
+		}
+		for _, id := range ids {
+			rt := &runRecurringTask{id: id, now: time.Now(), err: make(chan error)}
+			tasksChan <- rt
+			if err := <-rt.err; err != nil {
+				logE.Printf(logPrefix+"execute run-recurring task %d: %v", id, err)
+				continue
+			}
+			for _, trid := range rt.created {
+				notifyTransaction(trid, "Recurring expense", 0, bot, tasksChan)
+				checkTransactionBudgets(trid, bot, tasksChan)
+			}
+		}
+	}
+}
+
+func formatRecurring(entries []recurringExpense, names map[int64]string, settings *groupSettings) string {
+	var lines []string
+	for _, e := range entries {
+		var participants []int64
+		for _, uid := range sortedMemberIds(names) {
+			if _, ok := e.shares[uid]; ok {
+				participants = append(participants, uid)
+			}
+		}
+		next := settings.money(e.amount)
+		if e.nextAmount != 0 {
+			next = fmt.Sprintf(settings.tr("%s (next time %s)"), next, settings.money(e.nextAmount))
+		}
+		lines = append(lines, fmt.Sprintf(settings.tr("#%d · %s pays %s for %s, %s\n    %s · next on %s"),
+			e.id, names[e.owner], next, e.title, e.describeSchedule(settings),
+			joinNames(participants, names, settings), settings.formatTime(e.next)))
+	}
+	return strings.Join(lines, "\n\n")
+}
+
+func recurringHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "recurring handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	groupMembers, err := selectAllGroupMembers(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+	isLeader, err := isGroupLeader(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"check leader: %v", err)
+		return
+	}
+	entries, err := selectGroupRecurring(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+
+	const (
+		done      = "⏎"
+		back      = "◀"
+		create    = "new"
+		skip      = "skip"
+		setAmount = "amount"
+		remove    = "delete"
+	)
+	text := formatRecurring(entries, groupMembers, settings)
+	if len(entries) == 0 {
+		text = settings.tr("There are no recurring expenses yet.")
+	}
+	var rows [][]tgbotapi2.InlineKeyboardButton
+	if !settings.archived {
+		for _, e := range entries {
+			if e.owner == int64(callerId) || isLeader {
+				label := fmt.Sprintf("#%d %s", e.id, e.title)
+				rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(label, strconv.FormatInt(e.id, 10))))
+			}
+		}
+		rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(settings.tr("+ New"), create)))
+	}
+	rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(done, done)))
+	msg := newAbortableMsg(chatId, text)
+	msg.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(rows...)
+	sent, _ := bot.Send(msg)
+
+	closeMenu := func() {
+		bot.Send(tgbotapi2.NewEditMessageReplyMarkup(chatId, sent.MessageID, tgbotapi2.NewInlineKeyboardMarkup()))
+	}
+
+	choice := nextMenuChoice(chatId, sent.MessageID, bot, replyChan)
+	switch choice {
+	case "", done:
+		closeMenu()
+		return
+	case create:
+		closeMenu()
+		createRecurring(chatId, callerId, settings, bot, replyChan, tasksChan)
+		return
+	}
+
+	id, err := strconv.ParseInt(choice, 10, 64)
+	if err != nil {
+		closeMenu()
+		return
+	}
+	var selected *recurringExpense
+	for i := range entries {
+		if entries[i].id == id {
+			selected = &entries[i]
+		}
+	}
+	if selected == nil {
+		closeMenu()
+		return
+	}
+
+	edit := newAbortableEditMsg(chatId, sent.MessageID, formatRecurring([]recurringExpense{*selected}, groupMembers, settings))
+	kb := tgbotapi2.NewInlineKeyboardMarkup(
+		tgbotapi2.NewInlineKeyboardRow(
+			tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Skip next"), skip),
+			tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Change next amount"), setAmount),
+		),
+		tgbotapi2.NewInlineKeyboardRow(
+			tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Delete"), remove),
+			tgbotapi2.NewInlineKeyboardButtonData(back, back),
+		),
+	)
+	edit.ReplyMarkup = &kb
+	bot.Send(edit)
+
+	change := &changeRecurringTask{callerId: callerId, id: id, err: make(chan error)}
+	switch nextMenuChoice(chatId, sent.MessageID, bot, replyChan) {
+	case skip:
+		change.action = recurringSkip
+	case setAmount:
+		change.action = recurringSetAmount
+		if change.amount, _ = retrieveAmount(chatId, sent.MessageID, "pay", settings, bot, replyChan); change.amount <= 0 {
+			closeMenu()
+			return
+		}
+	case remove:
+		change.action = recurringDelete
+	default:
+		closeMenu()
+		return
+	}
+	closeMenu()
+
+	tasksChan <- change
+	if err = <-change.err; err != nil {
+		if _, ok := err.(*errorNotAllowed); ok {
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("You are not allowed to change this recurring expense.")))
+			return
+		}
+		logE.Printf(logPrefix+"execute change-recurring task: %v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Failed to change the recurring expense.")))
+		return
+	}
+	bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Done.")))
+}
+
+// Asks for a new template step by step, the first payment date defines the
+// day of the schedule
+func createRecurring(chatId int64, ownerId int, settings *groupSettings, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "create recurring: "
+
+	bot.Send(newAbortableMsg(chatId, settings.tr("What is the recurring expense for?")))
+	var r reply
+	for ok := false; r.msg == nil; {
+		if r, ok = nextReply(replyChan); !ok {
+			return
+		}
+		if isAbort(r) {
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return
+		}
+	}
+	re := &recurringExpense{owner: int64(ownerId), title: r.msg.Text}
+
+	var ok bool
+	if re.categoryId, ok = askCategory(chatId, ownerId, re.title, settings, bot, replyChan); !ok {
+		return
+	}
+	var rplMsgId int
+	if re.amount, rplMsgId = retrieveAmount(chatId, r.msg.MessageID, "pay", settings, bot, replyChan); re.amount <= 0 {
+		return
+	}
+
+	groupMembers, err := selectGroupMembers(ownerId)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+	selectedIds, _, ok := askParticipants(chatId, rplMsgId, settings.tr("Who did you pay for?"), groupMembers, settings, bot, replyChan)
+	if !ok {
+		return
+	}
+	if re.shares, ok = askShares(chatId, selectedIds, joinNames(selectedIds, groupMembers, settings), settings, bot, replyChan); !ok {
+		return
+	}
+
+	// Ask for schedule
+	var buttons []tgbotapi2.InlineKeyboardButton
+	for _, choice := range scheduleChoices {
+		buttons = append(buttons, tgbotapi2.NewInlineKeyboardButtonData(settings.tr(scheduleTitles[choice]), choice))
+	}
+	msg := newAbortableMsg(chatId, settings.tr("How often is it paid?"))
+	msg.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(buttons)
+	sent, _ := bot.Send(msg)
+	for re.schedule == "" {
+		if r, ok = nextReply(replyChan); !ok || isAbort(r) {
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return
+		}
+		if r.cb != nil {
+			bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+			for _, choice := range scheduleChoices {
+				if r.cb.Data == choice {
+					re.schedule = choice
+				}
+			}
+		}
+	}
+	bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, settings.tr(scheduleTitles[re.schedule])))
+
+	// First payment date defines the schedule day
+	loc := settings.location()
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	bot.Send(newAbortableMsg(chatId, fmt.Sprintf(settings.tr(`When is the first payment? Type "today" or a date like %s.`), now.Format(settings.dateFormat))))
+	for re.next.IsZero() {
+		if r, ok = nextReply(replyChan); !ok {
+			return
+		}
+		if isAbort(r) {
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return
+		}
+		if r.msg == nil {
+			continue
+		}
+		first := today
+		if answer := strings.ToLower(strings.TrimSpace(r.msg.Text)); answer != "today" && answer != settings.tr("today") {
+			if first, err = parseDay(r.msg.Text, settings); err != nil {
+				bot.Send(tgbotapi2.NewMessage(chatId, err.Error()))
+				continue
+			}
+			if first.Before(today) {
+				bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("The first payment cannot be in the past.")))
+				continue
+			}
+		}
+		re.next = time.Date(first.Year(), first.Month(), first.Day(), 12, 0, 0, 0, loc)
+	}
+	switch re.schedule {
+	case scheduleWeekly:
+		re.day = int(re.next.Weekday())
+	case scheduleYearly:
+		re.day, re.month = re.next.Day(), int(re.next.Month())
+	default:
+		re.day = re.next.Day()
+	}
+
+	add := &addRecurringTask{callerId: ownerId, expense: re, err: make(chan error)}
+	tasksChan <- add
+	if err = <-add.err; err != nil {
+		if _, ok := err.(*errorNotAllowed); ok {
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("This group is archived and read-only.")))
+			return
+		}
+		logE.Printf(logPrefix+"execute add-recurring task: %v", err)
+		bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Failed to create the recurring expense.")))
+		return
+	}
+	bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf(settings.tr("Recurring expense #%d created: %s %s, first on %s."),
+		re.id, settings.money(re.amount), re.describeSchedule(settings), settings.formatTime(re.next))))
+}
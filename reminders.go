@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Schedules of balance reminders; weekly ones are named by weekday
+const (
+	remindersOff     = "off"
+	remindersDaily   = "daily"
+	remindersMonthly = "monthly"
+)
+
+var reminderWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Callback data of the snooze buttons, followed by hours
+const snoozeReminderPrefix = "snooze:"
+
+// Snooze periods offered with a reminder, in hours
+var snoozeChoices = []int{24, 72, 168}
+
+// Returns start of the latest scheduled day not after now, zero time when
+// reminders are off
+func lastReminderTime(now time.Time, schedule string, loc *time.Location) time.Time {
+	now = now.In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	switch schedule {
+	case remindersDaily:
+		return today
+	case remindersMonthly:
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	}
+	for day, name := range reminderWeekdays {
+		if name == schedule {
+			return today.AddDate(0, 0, -((int(now.Weekday()) - day + 7) % 7))
+		}
+	}
+	return time.Time{}
+}
+
+// Parses quiet hours like "22-8" meaning from 22:00 till 8:00, "off" for none
+func parseQuietHours(text string) (from, till int, err error) {
+	if text == remindersOff {
+		return 0, 0, nil
+	}
+	parts := strings.Split(text, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected hours like 22-8")
+	}
+	if from, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil || from < 0 || from > 23 {
+		return 0, 0, fmt.Errorf("expected hours like 22-8")
+	}
+	if till, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil || till < 0 || till > 23 {
+		return 0, 0, fmt.Errorf("expected hours like 22-8")
+	}
+	return from, till, nil
+}
+
+func isQuietTime(now time.Time, quietHours string, loc *time.Location) bool {
+	from, till, err := parseQuietHours(quietHours)
+	if err != nil || from == till {
+		return false
+	}
+	hour := now.In(loc).Hour()
+	if from < till {
+		return hour >= from && hour < till
+	}
+	return hour >= from || hour < till
+}
+
+type transfer struct {
+	src    int64
+	dst    int64
+	amount float64
+}
+
+// Pairs largest debtors with largest creditors, which settles the group in
+// at most one transfer less than there are members with open balance
+func settleUpPlan(balances map[int64]float64) (plan []transfer) {
+	type balance struct {
+		uid    int64
+		amount float64
+	}
+	var debtors, creditors []balance
+	for uid, debt := range balances {
+		if debt >= balanceEpsilon {
+			debtors = append(debtors, balance{uid, debt})
+		} else if debt <= -balanceEpsilon {
+			creditors = append(creditors, balance{uid, -debt})
+		}
+	}
+	byAmount := func(b []balance) func(i, j int) bool {
+		return func(i, j int) bool {
+			if b[i].amount != b[j].amount {
+				return b[i].amount > b[j].amount
+			}
+			return b[i].uid < b[j].uid
+		}
+	}
+	sort.Slice(debtors, byAmount(debtors))
+	sort.Slice(creditors, byAmount(creditors))
+
+	for i, j := 0, 0; i < len(debtors) && j < len(creditors); {
+		amount := math.Min(debtors[i].amount, creditors[j].amount)
+		plan = append(plan, transfer{debtors[i].uid, creditors[j].uid, math.Round(amount*100) / 100})
+		debtors[i].amount -= amount
+		creditors[j].amount -= amount
+		if debtors[i].amount < balanceEpsilon {
+			i++
+		}
+		if creditors[j].amount < balanceEpsilon {
+			j++
+		}
+	}
+	return
+}
+
+type reminderState struct {
+	member       int64
+	checked      sql.NullTime // when the balance was last checked on schedule
+	snoozedUntil sql.NullTime
+}
+
+// Returns members with a Telegram account in groups which have reminders on
+func selectReminderStates() (states []reminderState, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT U.id, R.checked_ts, R.snoozed_until FROM users U
+JOIN groups G ON U.group_id=G.id
+LEFT JOIN balance_reminders R ON R.member_id=U.id AND R.group_id=G.id
+WHERE G.reminder_schedule!=? AND G.archived_ts IS NULL AND U.is_active=1 AND U.id>0`, remindersOff)
+	if err != nil {
+		err = fmt.Errorf("select reminder states: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rs reminderState
+		if err = rows.Scan(&rs.member, &rs.checked, &rs.snoozedUntil); err != nil {
+			err = fmt.Errorf("scan reminder state: %v", err)
+			return
+		}
+		states = append(states, rs)
+	}
+	return
+}
+
+// Snoozed reminder is due when snooze ends, others on every scheduled day
+func (rs *reminderState) isDue(now time.Time, settings *groupSettings) bool {
+	if rs.snoozedUntil.Valid {
+		return !now.Before(rs.snoozedUntil.Time)
+	}
+	last := lastReminderTime(now, settings.reminderSchedule, settings.location())
+	return !last.IsZero() && (!rs.checked.Valid || rs.checked.Time.Before(last))
+}
+
+// Checks balances on the group schedule and reminds members owing more than
+// the threshold; runs missed during downtime or quiet hours are caught up
+func runBalanceReminders(bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "balance reminders: "
+
+	for ; ; time.Sleep(time.Minute) {
+		states, err := selectReminderStates()
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			continue
+		}
+		for i := range states {
+			rs := &states[i]
+			settings, err := getUserSettings(int(rs.member))
+			if err != nil {
+				logE.Printf(logPrefix+"get settings: %v", err)
+				continue
+			}
+			now := time.Now()
+			if !rs.isDue(now, settings) || isQuietTime(now, settings.quietHours, settings.location()) {
+				continue
+			}
+			sendBalanceReminder(rs.member, settings, bot)
+
+			mt := &markBalanceCheckedTask{rs.member, settings.groupId, now, make(chan error)}
+			tasksChan <- mt
+			if err := <-mt.err; err != nil {
+				logE.Printf(logPrefix+"execute mark-balance-checked task: %v", err)
+			}
+		}
+	}
+}
+
+// Sends the reminder with suggested transfers when the member's debt is over
+// the threshold of the group
+func sendBalanceReminder(uid int64, settings *groupSettings, bot *tgbotapi2.BotAPI) {
+	logPrefix := "send balance reminder: "
+
+	var debt float64
+	if err := calcDebt(int(uid), &debt); err != nil {
+		logE.Printf(logPrefix+"%v", err)
+		return
+	}
+	if debt <= settings.reminderThreshold {
+		return
+	}
+	groupMembers, err := selectGroupMembers(int(uid))
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+	balances := make(map[int64]float64)
+	for member := range groupMembers {
+		var balance float64
+		if err := calcDebt(int(member), &balance); err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			return
+		}
+		balances[member] = balance
+	}
+
+	lines := []string{fmt.Sprintf(settings.tr("Balance reminder from %s"), settings.name), debtMessage(settings, debt)}
+	var suggested []string
+	for _, t := range settleUpPlan(balances) {
+		if t.src == uid {
+			suggested = append(suggested, fmt.Sprintf(settings.tr("%s to %s"), settings.money(t.amount), groupMembers[t.dst]))
+		}
+	}
+	if len(suggested) != 0 {
+		lines = append(lines, "", settings.tr("To settle up, give back:"))
+		lines = append(lines, suggested...)
+		lines = append(lines, "", settings.tr("Use /igive once you have paid."))
+	}
+
+	var buttons []tgbotapi2.InlineKeyboardButton
+	for _, hours := range snoozeChoices {
+		title := fmt.Sprintf(settings.tr("Snooze %dd"), hours/24)
+		buttons = append(buttons, tgbotapi2.NewInlineKeyboardButtonData(title, fmt.Sprintf("%s%d", snoozeReminderPrefix, hours)))
+	}
+	msg := tgbotapi2.NewMessage(uid, strings.Join(lines, "\n"))
+	msg.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(buttons)
+	if _, err := bot.Send(msg); err != nil {
+		logW.Printf(logPrefix+"send to %d: %v", uid, err)
+	}
+}
+
+// Handles snooze buttons of a reminder
+func snoozeReminderHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "snooze reminder handler: "
+
+	cb := update.CallbackQuery
+	settings, err := getUserSettings(cb.From.ID)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	hours, err := strconv.Atoi(strings.TrimPrefix(cb.Data, snoozeReminderPrefix))
+	if err != nil || hours <= 0 {
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, ""))
+		return
+	}
+
+	until := time.Now().Add(time.Duration(hours) * time.Hour)
+	st := &snoozeReminderTask{int64(cb.From.ID), settings.groupId, until, make(chan error)}
+	tasksChan <- st
+	if err := <-st.err; err != nil {
+		logE.Printf(logPrefix+"execute snooze-reminder task: %v", err)
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, settings.tr("Failed to register operation")))
+		return
+	}
+	answer := fmt.Sprintf(settings.tr("Snoozed until %s."), settings.formatTime(until))
+	bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, answer))
+	if cb.Message != nil {
+		bot.Send(tgbotapi2.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, cb.Message.Text+"\n\n"+answer))
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Dimensions of rendered images in pixels
+const (
+	renderFontSize      = 24
+	tablePadding        = 12
+	tableMaxColumnWidth = 480
+	tableMaxPageHeight  = 2400
+)
+
+var (
+	tableHeaderColor = color.RGBA{0xC2, 0xD4, 0xFF, 0xFF}
+	tableCellColor   = color.RGBA{0xF5, 0xF8, 0xFF, 0xFF}
+	tableTextColor   = color.RGBA{0x2A, 0x3F, 0x5F, 0xFF}
+	tableMutedColor  = color.RGBA{0x8A, 0x94, 0xA6, 0xFF}
+)
+
+type rowStyle int
+
+const (
+	rowNormal rowStyle = iota
+	rowMuted           // voided entries
+	rowBold            // totals
+)
+
+type tableRow struct {
+	cells []string
+	style rowStyle
+}
+
+// Go fonts cover Latin, Cyrillic and Greek; parsed fonts are shared while
+// faces are not safe for concurrent use and are made per image
+var renderFonts struct {
+	once          sync.Once
+	regular, bold *opentype.Font
+	err           error
+}
+
+func newRenderFaces() (regular, bold font.Face, err error) {
+	renderFonts.once.Do(func() {
+		if renderFonts.regular, renderFonts.err = opentype.Parse(goregular.TTF); renderFonts.err != nil {
+			return
+		}
+		renderFonts.bold, renderFonts.err = opentype.Parse(gobold.TTF)
+	})
+	if renderFonts.err != nil {
+		return nil, nil, fmt.Errorf("parse font: %v", renderFonts.err)
+	}
+	opts := &opentype.FaceOptions{Size: renderFontSize, DPI: 72, Hinting: font.HintingFull}
+	if regular, err = opentype.NewFace(renderFonts.regular, opts); err != nil {
+		return nil, nil, fmt.Errorf("create font face: %v", err)
+	}
+	if bold, err = opentype.NewFace(renderFonts.bold, opts); err != nil {
+		return nil, nil, fmt.Errorf("create font face: %v", err)
+	}
+	return
+}
+
+func textWidth(face font.Face, text string) int {
+	return font.MeasureString(face, text).Ceil()
+}
+
+// Splits text into lines not wider than width, breaking words which do not
+// fit on a line of their own
+func wrapText(face font.Face, text string, width int) (lines []string) {
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if len(line) != 0 {
+				candidate = line + " " + word
+			}
+			if textWidth(face, candidate) <= width {
+				line = candidate
+				continue
+			}
+			if len(line) != 0 {
+				lines = append(lines, line)
+			}
+			for textWidth(face, word) > width {
+				n := fittingPrefix(face, word, width)
+				lines = append(lines, word[:n])
+				word = word[n:]
+			}
+			line = word
+		}
+		lines = append(lines, line)
+	}
+	return
+}
+
+// Returns length in bytes of the longest prefix not wider than width, at
+// least one rune
+func fittingPrefix(face font.Face, word string, width int) int {
+	_, n := utf8.DecodeRuneInString(word)
+	for i := range word {
+		if i <= n {
+			continue
+		}
+		if textWidth(face, word[:i]) > width {
+			break
+		}
+		n = i
+	}
+	return n
+}
+
+type tableLayout struct {
+	widths  []int
+	lines   [][][]string // wrapped text of every cell
+	heights []int
+}
+
+func layoutTable(rows []tableRow, faces map[rowStyle]font.Face) (l tableLayout) {
+	for _, row := range rows {
+		for col, cell := range row.cells {
+			if col == len(l.widths) {
+				l.widths = append(l.widths, 0)
+			}
+			for _, line := range strings.Split(cell, "\n") {
+				if w := textWidth(faces[row.style], line) + 2*tablePadding; w > l.widths[col] {
+					l.widths[col] = w
+				}
+			}
+		}
+	}
+	for col := range l.widths {
+		if l.widths[col] > tableMaxColumnWidth {
+			l.widths[col] = tableMaxColumnWidth
+		}
+	}
+
+	lineHeight := faces[rowNormal].Metrics().Height.Ceil()
+	for _, row := range rows {
+		cells := make([][]string, len(row.cells))
+		maxLines := 1
+		for col, cell := range row.cells {
+			cells[col] = wrapText(faces[row.style], cell, l.widths[col]-2*tablePadding)
+			if len(cells[col]) > maxLines {
+				maxLines = len(cells[col])
+			}
+		}
+		l.lines = append(l.lines, cells)
+		l.heights = append(l.heights, maxLines*lineHeight+2*tablePadding)
+	}
+	return
+}
+
+// Renders rows into PNG pages in dir repeating the header on every page;
+// returns paths of the pages
+func renderTable(header []string, rows []tableRow, dir, name string) (paths []string, err error) {
+	regular, bold, err := newRenderFaces()
+	if err != nil {
+		return nil, err
+	}
+	defer regular.Close()
+	defer bold.Close()
+	faces := map[rowStyle]font.Face{rowNormal: regular, rowMuted: regular, rowBold: bold}
+
+	l := layoutTable(append([]tableRow{{header, rowBold}}, rows...), faces)
+	width := 1
+	for _, w := range l.widths {
+		width += w
+	}
+
+	// Every page holds the header and as many rows as fit, at least one
+	var pages [][]int
+	for i, height := 1, l.heights[0]; i < len(l.heights); i++ {
+		if len(pages) == 0 || height+l.heights[i] > tableMaxPageHeight && len(pages[len(pages)-1]) > 1 {
+			pages = append(pages, []int{0})
+			height = l.heights[0]
+		}
+		pages[len(pages)-1] = append(pages[len(pages)-1], i)
+		height += l.heights[i]
+	}
+	if len(pages) == 0 {
+		pages = append(pages, []int{0})
+	}
+
+	ascent := regular.Metrics().Ascent.Ceil()
+	lineHeight := regular.Metrics().Height.Ceil()
+	for n, page := range pages {
+		height := 1
+		for _, i := range page {
+			height += l.heights[i]
+		}
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+		y := 0
+		for _, i := range page {
+			style, fill := rowNormal, tableCellColor
+			if i == 0 {
+				style, fill = rowBold, tableHeaderColor
+			} else {
+				style = rows[i-1].style
+			}
+			text := tableTextColor
+			if style == rowMuted {
+				text = tableMutedColor
+			}
+			x := 0
+			for col, w := range l.widths {
+				// One pixel gap between cells draws the white grid
+				cell := image.Rect(x+1, y+1, x+w, y+l.heights[i])
+				draw.Draw(img, cell, image.NewUniform(fill), image.Point{}, draw.Src)
+				if col < len(l.lines[i]) {
+					d := font.Drawer{Dst: img, Src: image.NewUniform(text), Face: faces[style]}
+					for k, line := range l.lines[i][col] {
+						d.Dot = fixed.P(x+tablePadding, y+tablePadding+ascent+k*lineHeight)
+						d.DrawString(line)
+					}
+				}
+				x += w
+			}
+			y += l.heights[i]
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("%s-%d.png", name, n+1))
+		if err = savePNG(img, path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return
+}
+
+func savePNG(img image.Image, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create image file: %v", err)
+	}
+	if err = png.Encode(f, img); err != nil {
+		f.Close()
+		return fmt.Errorf("encode png: %v", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// States of a repayment entered with /igive
+const (
+	repaymentPending   = "pending"
+	repaymentConfirmed = "confirmed"
+	repaymentRejected  = "rejected"
+)
+
+// Callback data of the recipient's buttons, followed by repayment id
+const (
+	confirmRepaymentPrefix = "repaid:"
+	rejectRepaymentPrefix  = "notrepaid:"
+)
+
+// Payer is reminded and recipient asked again once when the recipient stays
+// silent for so long
+const repaymentReminderDelay = 24 * time.Hour
+
+type repayment struct {
+	id      int64
+	src     int64
+	dst     int64
+	amount  float64
+	created time.Time
+}
+
+func scanRepayments(rows *sql.Rows) (repayments []repayment, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var rp repayment
+		if err = rows.Scan(&rp.id, &rp.src, &rp.dst, &rp.amount, &rp.created); err != nil {
+			return nil, fmt.Errorf("scan repayment: %v", err)
+		}
+		repayments = append(repayments, rp)
+	}
+	return
+}
+
+func selectRepayment(id int64) (*repayment, error) {
+	rows, err := db.Query(`SELECT id, src, dst, amount, created_ts FROM repayments WHERE id=?`, id)
+	if err != nil {
+		return nil, fmt.Errorf("select repayment: %v", err)
+	}
+	repayments, err := scanRepayments(rows)
+	if err != nil || len(repayments) == 0 {
+		return nil, err
+	}
+	return &repayments[0], nil
+}
+
+// Returns repayments given by the member which recipients have not confirmed
+func selectPendingRepayments(uid int) ([]repayment, error) {
+	rows, err := db.Query(`SELECT id, src, dst, amount, created_ts FROM repayments WHERE src=? AND state=? ORDER BY id`,
+		uid, repaymentPending)
+	if err != nil {
+		return nil, fmt.Errorf("select pending repayments: %v", err)
+	}
+	return scanRepayments(rows)
+}
+
+// Returns pending repayments whose payer has not been reminded about yet
+func selectUnremindedRepayments() ([]repayment, error) {
+	rows, err := db.Query(`SELECT id, src, dst, amount, created_ts FROM repayments WHERE state=? AND reminded_ts IS NULL ORDER BY id`,
+		repaymentPending)
+	if err != nil {
+		return nil, fmt.Errorf("select unreminded repayments: %v", err)
+	}
+	return scanRepayments(rows)
+}
+
+// Asks the recipient whether the money has arrived
+func sendRepaymentPrompt(rp *repayment, names map[int64]string, settings *groupSettings, bot *tgbotapi2.BotAPI) error {
+	msg := tgbotapi2.NewMessage(rp.dst, fmt.Sprintf(settings.tr("Did you receive %s from %s?"), settings.money(rp.amount), names[rp.src]))
+	msg.ReplyMarkup = tgbotapi2.NewInlineKeyboardMarkup(tgbotapi2.NewInlineKeyboardRow(
+		tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Confirm"), fmt.Sprintf("%s%d", confirmRepaymentPrefix, rp.id)),
+		tgbotapi2.NewInlineKeyboardButtonData(settings.tr("Reject"), fmt.Sprintf("%s%d", rejectRepaymentPrefix, rp.id)),
+	))
+	_, err := bot.Send(msg)
+	return err
+}
+
+func formatPendingRepayments(repayments []repayment, names map[int64]string, settings *groupSettings) string {
+	lines := []string{settings.tr("Waiting for confirmation:")}
+	for _, rp := range repayments {
+		lines = append(lines, fmt.Sprintf(settings.tr("%s to %s since %s"), settings.money(rp.amount), names[rp.dst], settings.formatTime(rp.created)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Reminds payers of repayments which stay unconfirmed and asks recipients
+// again
+func runRepaymentReminders(bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "repayment reminders: "
+
+	for ; ; time.Sleep(time.Minute) {
+		repayments, err := selectUnremindedRepayments()
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			continue
+		}
+		for _, rp := range repayments {
+			if time.Since(rp.created) < repaymentReminderDelay {
+				continue
+			}
+			settings, err := getUserSettings(int(rp.src))
+			if err != nil {
+				logE.Printf(logPrefix+"get settings: %v", err)
+				continue
+			}
+			names, err := selectAllGroupMembers(int(rp.src))
+			if err != nil {
+				logE.Printf(logPrefix+"select group members: %v", err)
+				continue
+			}
+			bot.Send(tgbotapi2.NewMessage(rp.src, fmt.Sprintf(settings.tr("%s has not confirmed receiving %s from you yet."),
+				names[rp.dst], settings.money(rp.amount))))
+			// The first prompt may have been lost, nobody else can confirm
+			if err := sendRepaymentPrompt(&rp, names, settings, bot); err != nil {
+				logW.Printf(logPrefix+"send repayment prompt to %d: %v", rp.dst, err)
+			}
+
+			mt := &markRepaymentRemindedTask{rp.id, time.Now(), make(chan error)}
+			tasksChan <- mt
+			if err := <-mt.err; err != nil {
+				logE.Printf(logPrefix+"execute mark-repayment-reminded task: %v", err)
+			}
+		}
+	}
+}
+
+// Handles Confirm and Reject buttons of a repayment prompt
+func answerRepaymentHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "answer repayment handler: "
+
+	cb := update.CallbackQuery
+	settings, err := getUserSettings(cb.From.ID)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	confirmed := strings.HasPrefix(cb.Data, confirmRepaymentPrefix)
+	id, err := strconv.ParseInt(cb.Data[strings.Index(cb.Data, ":")+1:], 10, 64)
+	if err != nil {
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, ""))
+		return
+	}
+
+	at := &answerRepaymentTask{id: id, callerId: cb.From.ID, confirmed: confirmed, err: make(chan error)}
+	tasksChan <- at
+	if err := <-at.err; err != nil {
+		if _, ok := err.(*errorNotAllowed); ok {
+			bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, settings.tr("Nothing to confirm.")))
+			return
+		}
+		logE.Printf(logPrefix+"execute answer-repayment task: %v", err)
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, settings.tr("Failed to register operation")))
+		return
+	}
+	bot.AnswerCallbackQuery(tgbotapi2.NewCallback(cb.ID, ""))
+
+	rp, err := selectRepayment(id)
+	if err != nil || rp == nil {
+		logE.Printf(logPrefix+"select repayment %d: %v", id, err)
+		return
+	}
+	names, err := selectAllGroupMembers(cb.From.ID)
+	if err != nil {
+		logE.Printf(logPrefix+"select group members: %v", err)
+		return
+	}
+
+	answer := "✗ " + settings.tr("Rejected.")
+	payerMsg := tgbotapi2.NewMessage(rp.src, fmt.Sprintf(settings.tr("%s says they did not receive %s from you."), names[rp.dst], settings.money(rp.amount)))
+	if at.requestId != 0 {
+		// Request is open again and may be paid once more
+		payerMsg.ReplyMarkup = paidRequestKb(&paymentRequest{id: at.requestId}, settings.tr("I paid"))
+	}
+	if confirmed {
+		answer = "✓ " + settings.tr("Confirmed.")
+		payerMsg.Text = fmt.Sprintf(settings.tr("%s confirmed receiving %s from you."), names[rp.dst], settings.money(rp.amount))
+		var debt float64
+		if err := calcDebt(int(rp.src), &debt); err != nil {
+			logE.Printf(logPrefix+"calculate debt: %v", err)
+		} else {
+			payerMsg.Text += "\n" + debtMessage(settings, debt)
+		}
+		closeSettledRequests(rp.dst, rp.src, tasksChan)
+	}
+	if cb.Message != nil {
+		bot.Send(tgbotapi2.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, cb.Message.Text+"\n\n"+answer))
+	}
+	bot.Send(payerMsg)
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	splitEqual  = "equal"
+	splitShares = "shares"
+
+	editPolicyPayer         = "payer"
+	editPolicyPayerOrLeader = "payer_or_leader"
+	editPolicyAnyone        = "anyone"
+
+	resetPolicyLeader = "leader"
+	resetPolicyOff    = remindersOff
+
+	approvalNone         = "none"
+	approvalParticipants = "participants"
+)
+
+// Per-group configuration stored in groups table
+type groupSettings struct {
+	groupId    int
+	name       string
+	currency   string
+	timezone   string
+	language   string
+	dateFormat string
+	splitMode  string
+	editPolicy string
+	approval   string // whether participants confirm their shares of new expenses
+	autoAccept int    // hours after which unanswered shares are accepted, 0 for never
+
+	reminderSchedule  string  // when members owing money are reminded
+	reminderThreshold float64 // debt which members are reminded about
+	quietHours        string  // hours when no reminders are sent, e.g. "22-8"
+
+	summarySchedule string // how often members get spending summary
+	summarySections string // comma separated sections of the summary
+	archived        bool
+
+	resetPolicy string // who may wipe group ledger with /reset
+}
+
+var defaultSettings = groupSettings{
+	currency:   "€",
+	timezone:   "Local",
+	language:   "en",
+	dateFormat: "02/01/2006 15:04:05",
+	splitMode:  splitEqual,
+	editPolicy: editPolicyPayerOrLeader,
+	approval:   approvalNone,
+	autoAccept: 48,
+
+	reminderSchedule:  remindersOff,
+	reminderThreshold: 10,
+	quietHours:        "22-9",
+
+	summarySchedule: summaryOff,
+	summarySections: strings.Join(summarySectionChoices, ","),
+
+	resetPolicy: resetPolicyLeader,
+}
+
+var (
+	currencyChoices    = []string{"€", "$", "£", "₽"}
+	languageChoices    = []string{"en", "ru"}
+	dateFormatChoices  = []string{"02/01/2006 15:04:05", "02.01.2006 15:04", "01/02/2006 3:04PM", "2006-01-02 15:04"}
+	splitModeChoices   = []string{splitEqual, splitShares}
+	editPolicyChoices  = []string{editPolicyPayer, editPolicyPayerOrLeader, editPolicyAnyone}
+	resetPolicyChoices = []string{resetPolicyLeader, resetPolicyOff}
+	approvalChoices    = []string{approvalNone, approvalParticipants}
+	autoAcceptChoices  = []string{"24", "48", "72", "168", "0"}
+	reminderChoices    = append(append([]string{remindersOff, remindersDaily}, reminderWeekdays...), remindersMonthly)
+	thresholdChoices   = []string{"1", "10", "50", "100"}
+	quietHoursChoices  = []string{"22-9", "21-8", "23-10", remindersOff}
+	summaryChoices     = []string{summaryOff, summaryWeekly, summaryMonthly}
+	sectionsChoices    = []string{
+		strings.Join(summarySectionChoices, ","),
+		strings.Join([]string{summaryTotal, summaryCategories, summaryBiggest}, ","),
+		strings.Join([]string{summaryMembers, summaryBalances, summarySettleUp}, ","),
+	}
+)
+
+// Returns settings of user's group or defaults if user has no group
+func getUserSettings(uid int) (s *groupSettings, err error) {
+	s = &groupSettings{}
+	*s = defaultSettings
+	err = db.QueryRow(`SELECT G.id, G.name, G.currency, G.timezone, G.language, G.date_format, G.split_mode, G.edit_policy,
+G.reset_policy, G.approval, G.auto_accept_hours, G.reminder_schedule, G.reminder_threshold, G.quiet_hours,
+G.summary_schedule, G.summary_sections, G.archived_ts IS NOT NULL
+FROM groups G, users U
+WHERE U.group_id=G.id AND U.id=?`, uid).
+		Scan(&s.groupId, &s.name, &s.currency, &s.timezone, &s.language, &s.dateFormat, &s.splitMode, &s.editPolicy,
+			&s.resetPolicy, &s.approval, &s.autoAccept, &s.reminderSchedule, &s.reminderThreshold, &s.quietHours,
+			&s.summarySchedule, &s.summarySections, &s.archived)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("select group settings: %v", err)
+	}
+	return
+}
+
+// Source of current time, tests replace it with a fixed one
+var clock = time.Now
+
+// Returns current time in group timezone
+func (s *groupSettings) now() time.Time {
+	return clock().In(s.location())
+}
+
+func (s *groupSettings) location() *time.Location {
+	loc, err := time.LoadLocation(s.timezone)
+	if err != nil {
+		logW.Printf("load location %q: %v", s.timezone, err)
+		return time.Local
+	}
+	return loc
+}
+
+func (s *groupSettings) formatTime(t time.Time) string {
+	return t.In(s.location()).Format(s.dateFormat)
+}
+
+// Formats date without time of day
+func (s *groupSettings) formatDay(t time.Time) string {
+	layout := s.dateFormat
+	if i := strings.Index(layout, " "); i != -1 {
+		layout = layout[:i]
+	}
+	return t.In(s.location()).Format(layout)
+}
+
+// Parses date typed in group date format or as ISO date, missing time of day
+// defaults to noon so that timezone shifts keep the day
+func (s *groupSettings) parseDate(text string) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	layouts := []string{s.dateFormat, "2006-01-02 15:04", "2006-01-02"}
+	if i := strings.Index(s.dateFormat, " "); i != -1 {
+		layouts = append(layouts, s.dateFormat[:i])
+	}
+	for _, layout := range layouts {
+		t, err := time.ParseInLocation(layout, text, s.location())
+		if err != nil {
+			continue
+		}
+		if !strings.Contains(layout, ":") {
+			t = t.Add(12 * time.Hour)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("use format %s", s.now().Format(s.dateFormat))
+}
+
+// Returns separator of decimals in numbers written in the group language
+func (s *groupSettings) decimalSeparator() string {
+	if s.language == "ru" {
+		return ","
+	}
+	return "."
+}
+
+func (s *groupSettings) money(amount float64) string {
+	return fmt.Sprintf("%s%.2f", s.currency, amount)
+}
+
+// Checks whether caller may undo or edit a transaction paid by owner
+func (s *groupSettings) canModify(callerId, ownerId int64, callerIsLeader bool) bool {
+	switch s.editPolicy {
+	case editPolicyAnyone:
+		return true
+	case editPolicyPayer:
+		return callerId == ownerId
+	default:
+		return callerId == ownerId || callerIsLeader
+	}
+}
+
+// Shown to users who ask for group data before joining any group
+const notInGroupMessage = "You do not belong to any group. Use /start first."
+
+// Translates message into group language; untranslated messages are left as is
+func (s *groupSettings) tr(text string) string {
+	if translated, ok := translations[s.language][text]; ok {
+		return translated
+	}
+	return text
+}
+
+func describeSetting(value string) string {
+	switch value {
+	case splitEqual:
+		return "split equally"
+	case splitShares:
+		return "split by shares"
+	case editPolicyPayer:
+		return "payer only"
+	case editPolicyPayerOrLeader:
+		return "payer or leader"
+	case editPolicyAnyone:
+		return "anyone"
+	case resetPolicyLeader:
+		return "leader only"
+	case approvalNone:
+		return "not required"
+	case approvalParticipants:
+		return "by participants"
+	case "0":
+		return "never"
+	case remindersOff:
+		return "off"
+	case remindersDaily:
+		return "daily"
+	case remindersMonthly:
+		return "on the 1st of month"
+	case "sun", "mon", "tue", "wed", "thu", "fri", "sat":
+		for day, name := range reminderWeekdays {
+			if name == value {
+				return "every " + time.Weekday(day).String()
+			}
+		}
+	case "en":
+		return "English"
+	case "ru":
+		return "Русский"
+	}
+	return value
+}
+
+var translations = map[string]map[string]string{
+	"ru": {
+		"Aborted.":                            "Отменено.",
+		notInGroupMessage:                     "Вы не состоите ни в одной группе. Сначала используйте /start.",
+		"Done.":                               "Готово.",
+		"Okay, I got it.":                     "Хорошо, записал.",
+		"You owe nothing":                     "Вы никому не должны",
+		"You owe %s":                          "Вы должны %s",
+		"You are owed %s":                     "Вам должны %s",
+		"What did you pay for?":               "За что вы заплатили?",
+		"How much %s did you %s?":             "Сколько %s вы %s?",
+		"pay":                                 "заплатили",
+		"give back":                           "вернули",
+		"Who did you pay for?":                "За кого вы заплатили?",
+		"Who else did you pay for?":           "За кого ещё вы заплатили?",
+		"Who did you give money back?":        "Кому вы вернули деньги?",
+		"You paid ":                           "Вы заплатили ",
+		"You gave back %s to %s":              "Вы вернули %s участнику %s",
+		"%s for %s (%s)":                      "%s за %s (%s)",
+		" and ":                               " и ",
+		"Failed to create transaction for %q": "Не удалось создать транзакцию %q",
+		"Failed to register operation":        "Не удалось записать операцию",
+		"Failed to undo transaction %d":       "Не удалось отменить транзакцию %d",
+		"Transaction %d voided. /redo%d":      "Транзакция %d отменена. /redo%d",
+		"Failed to redo transaction %d":       "Не удалось восстановить транзакцию %d",
+		"Transaction %d restored.":            "Транзакция %d восстановлена.",
+		"Invalid transaction index.":          "Неверный номер транзакции.",
+		"Enter shares for %s separated by spaces, e.g. \"2 1 1\".": "Введите доли для %s через пробел, например \"2 1 1\".",
+		"Wrong shares.":         "Неверные доли.",
+		"Which category is it?": "К какой категории это относится?",
+		"No category":           "Без категории",
+		"Category: %s":          "Категория: %s",
+		"When was it? Pick a day or type a date like %s.": "Когда это было? Выберите день или введите дату, например %s.",
+		"Today":                                "Сегодня",
+		"Yesterday":                            "Вчера",
+		"Wrong date: %v.":                      "Неверная дата: %v.",
+		"Date: %s":                             "Дата: %s",
+		"Receipt saved. What did you pay for?": "Чек сохранён. За что вы заплатили?",
+		"%s paid ":                             "%s заплатил(а) ",
+		"You cannot give money back to yourself.": "Нельзя вернуть деньги самому себе.",
+		"Cannot parse %q: %s.":                    "Не удалось разобрать %q: %s.",
+		"Cannot read the amount: %v. Type a number like 12,50 or a sum like 30+12.5.": "Не удалось прочитать сумму: %v. Введите число вроде 12,50 или сумму вроде 30+12.5.",
+		"New expense":       "Новый расход",
+		"Recurring expense": "Регулярный расход",
+		"weekly on %s":      "еженедельно, %s",
+		"yearly on %d %s":   "ежегодно %d %s",
+		"monthly on day %d": "ежемесячно %d-го числа",
+		"Sunday":            "воскресенье",
+		"Monday":            "понедельник",
+		"Tuesday":           "вторник",
+		"Wednesday":         "среда",
+		"Thursday":          "четверг",
+		"Friday":            "пятница",
+		"Saturday":          "суббота",
+		"January":           "января",
+		"February":          "февраля",
+		"March":             "марта",
+		"April":             "апреля",
+		"May":               "мая",
+		"June":              "июня",
+		"July":              "июля",
+		"August":            "августа",
+		"September":         "сентября",
+		"October":           "октября",
+		"November":          "ноября",
+		"December":          "декабря",
+		"%s (next time %s)": "%s (в следующий раз %s)",
+		"#%d · %s pays %s for %s, %s\n    %s · next on %s": "#%d · %s платит %s за %s, %s\n    %s · следующий платёж %s",
+		"There are no recurring expenses yet.":             "Регулярных расходов пока нет.",
+		"+ New":                                            "+ Новый",
+		"Skip next":                                        "Пропустить следующий",
+		"Change next amount":                               "Изменить следующую сумму",
+		"You are not allowed to change this recurring expense.": "Вам нельзя изменять этот регулярный расход.",
+		"Failed to change the recurring expense.":               "Не удалось изменить регулярный расход.",
+		"What is the recurring expense for?":                    "За что регулярный расход?",
+		"How often is it paid?":                                 "Как часто он оплачивается?",
+		"Weekly":                                                "Еженедельно",
+		"Yearly":                                                "Ежегодно",
+		"When is the first payment? Type \"today\" or a date like %s.": "Когда первый платёж? Введите «сегодня» или дату, например %s.",
+		"today": "сегодня",
+		"The first payment cannot be in the past.":           "Первый платёж не может быть в прошлом.",
+		"Failed to create the recurring expense.":            "Не удалось создать регулярный расход.",
+		"Recurring expense #%d created: %s %s, first on %s.": "Регулярный расход #%d создан: %s %s, первый платёж %s.",
+		"%s #%d on %s: %s paid %s":                           "%s #%d от %s: %s заплатил(а) %s",
+		"Your share: %s":                                     "Ваша доля: %s",
+		"Digest of %d notifications:":                        "Сводка уведомлений: %d",
+		"On":                                                 "Включены",
+		"Muted":                                              "Без звука",
+		"Daily digest":                                       "Ежедневная сводка",
+		"Off":                                                "Выключены",
+		"Notifications about expenses and repayments involving you in %s:": "Уведомления о расходах и возвратах с вашим участием в %s:",
+		"Notifications: %s":             "Уведомления: %s",
+		"Failed to save the setting.":   "Не удалось сохранить настройку.",
+		"Changed expense":               "Изменённый расход",
+		"Did you receive %s from %s?":   "Вы получили %s от %s?",
+		"Confirm":                       "Подтвердить",
+		"Reject":                        "Отклонить",
+		"Confirmed.":                    "Подтверждено.",
+		"Rejected.":                     "Отклонено.",
+		"Waiting for %s to confirm it.": "Ждём подтверждения от %s.",
+		"Waiting for confirmation:":     "Ждут подтверждения:",
+		"%s to %s since %s":             "%s участнику %s с %s",
+		"%s has not confirmed receiving %s from you yet.":       "%s пока не подтвердил(а) получение %s от вас.",
+		"%s says they did not receive %s from you.":             "%s сообщает, что не получал(а) %s от вас.",
+		"%s confirmed receiving %s from you.":                   "%s подтвердил(а) получение %s от вас.",
+		"name only one member":                                  "укажите только одного участника",
+		"You owe %s %s.":                                        "Вы должны участнику %s %s.",
+		"%s owes you %s.":                                       "%s должен(на) вам %s.",
+		"You and %s are even.":                                  "Вы с участником %s в расчёте.",
+		"Nobody owes you anything.":                             "Вам никто не должен.",
+		"Who should pay you back?":                              "Кто должен вам вернуть деньги?",
+		"You cannot request money from yourself.":               "Нельзя запросить деньги у самого себя.",
+		"%s has no Telegram account to send the request to.":    "У участника %s нет аккаунта Telegram, запрос некуда отправить.",
+		"%s owes you nothing.":                                  "%s вам ничего не должен(на).",
+		"%s asks you to pay back %s.":                           "%s просит вас вернуть %s.",
+		"I paid":                                                "Я заплатил(а)",
+		"Could not reach %s, the request is kept in /requests.": "Не удалось написать участнику %s, запрос сохранён в /requests.",
+		"Asked %s to pay back %s.":                              "Участник %s получил запрос вернуть %s.",
+		"No open payment requests.":                             "Открытых запросов на оплату нет.",
+		"waiting for confirmation":                              "ждёт подтверждения",
+		"%s from %s since %s":                                   "%s от %s с %s",
+		"I paid %s to %s":                                       "Я заплатил(а) %s участнику %s",
+		"You asked for:":                                        "Вы запросили:",
+		"You were asked for:":                                   "У вас запросили:",
+		"Nothing to pay.":                                       "Нечего оплачивать.",
+		"Balance reminder from %s":                              "Напоминание о балансе от %s",
+		"%s to %s":                                              "%s участнику %s",
+		"To settle up, give back:":                              "Чтобы рассчитаться, верните:",
+		"Use /igive once you have paid.":                        "Когда заплатите, используйте /igive.",
+		"Snooze %dd":                                            "Отложить на %dд",
+		"Snoozed until %s.":                                     "Отложено до %s.",
+		"All expenses":                                          "Все расходы",
+		"%s, monthly":                                           "%s, ежемесячно",
+		"Budget %s is %d%% used: %s of %s, %s left.":            "Бюджет %s использован на %d%%: %s из %s, осталось %s.",
+		"Budget %s is exceeded: %s of %s used.":                 "Бюджет %s превышен: потрачено %s из %s.",
+		"No budgets yet.":                                       "Бюджетов пока нет.",
+		"Not active now":                                        "Сейчас не действует",
+		"%s of %s used (%d%%), %s left":                         "Потрачено %s из %s (%d%%), осталось %s",
+		"%s of %s used (%d%%), %s over":                         "Потрачено %s из %s (%d%%), превышение %s",
+		"Projected by %s: %s":                                   "Прогноз на %s: %s",
+		"over by %s":                                            "превышение на %s",
+		"Budgets":                                               "Бюджеты",
+		"+ Add":                                                 "+ Добавить",
+		"Delete":                                                "Удалить",
+		"Failed to update budgets.":                             "Не удалось изменить бюджеты.",
+		"Which budget to delete?":                               "Какой бюджет удалить?",
+		"Which expenses does the budget limit?":                 "Какие расходы ограничивает бюджет?",
+		"Select the budget period.":                             "Выберите период бюджета.",
+		"Monthly":                                               "Ежемесячно",
+		"Custom period":                                         "Свой период",
+		"Type the first and the last day like %s.":              "Введите первый и последний день, например %s.",
+		"Cannot read the period: %v.":                           "Не удалось прочитать период: %v.",
+		"Type the budget amount.":                               "Введите сумму бюджета.",
+		"%s: summary for %s – %s":                               "%s: сводка за %s – %s",
+		"Spent %s in %d expenses.":                              "Потрачено %s, расходов: %d.",
+		"Top categories:":                                       "Основные категории:",
+		"Biggest expenses:":                                     "Крупнейшие расходы:",
+		"Paid and consumed:":                                    "Заплатили и потребили:",
+		"%s: paid %s, consumed %s":                              "%s: заплатил(а) %s, потребил(а) %s",
+		"Balances:":                                             "Балансы:",
+		"%s: %s (%s this period)":                               "%s: %s (%s за период)",
+		"Everybody is settled up.":                              "Все в расчёте.",
+		"To settle up:":                                         "Чтобы рассчитаться:",
+		"%s gives %s to %s":                                     "%s отдаёт %s участнику %s",
+		"Title":                                                 "Название",
+		"Amount":                                                "Сумма",
+		"Payer":                                                 "Плательщик",
+		"Date":                                                  "Дата",
+		"Total":                                                 "Итого",
+		"%s (voided)":                                           "%s (отменён)",
+		"Page %d of %d":                                         "Страница %d из %d",
+		"No transactions found.":                                "Транзакции не найдены.",
+		"Found %d transactions, %s in total.":                   "Найдено транзакций: %d, всего %s.",
+		"This month":                                            "Этот месяц",
+		"Last month":                                            "Прошлый месяц",
+		"This year":                                             "Этот год",
+		"All time":                                              "Всё время",
+		"Spending charts":                                       "Графики расходов",
+		"Choose the period of the charts.":                      "Выберите период для графиков.",
+		"Split the pie chart by payer or by category?":          "Разделить круговую диаграмму по плательщикам или по категориям?",
+		"By payer":                                              "По плательщикам",
+		"By category":                                           "По категориям",
+		"Spending by month":                                     "Расходы по месяцам",
+		"Spending by payer":                                     "Расходы по плательщикам",
+		"Spending by category":                                  "Расходы по категориям",
+		"Balances (positive when owed to the member)":           "Балансы (положительный — должны участнику)",
+		"Other":                              "Прочее",
+		"Failed to draw the charts.":         "Не удалось нарисовать графики.",
+		"Failed to send the charts.":         "Не удалось отправить графики.",
+		"No expenses in %s.":                 "Нет расходов за %s.",
+		"Spending charts for %s":             "Графики расходов за %s",
+		"Uncategorized":                      "Без категории",
+		"No expenses, %s.":                   "Нет расходов, %s.",
+		"Spending by category, %s:":          "Расходы по категориям, %s:",
+		"Total — %s":                         "Итого — %s",
+		"Manage categories":                  "Управлять категориями",
+		"Failed to update categories.":       "Не удалось изменить категории.",
+		"Categories of the group":            "Категории группы",
+		"Type the name of the new category.": "Введите название новой категории.",
+		"Category %q":                        "Категория %q",
+		"Rename":                             "Переименовать",
+		"Type the new name of %q.":           "Введите новое название для %q.",
+		"Accept":                             "Принять",
+		"Dispute":                            "Оспорить",
+		"Accepted.":                          "Принято.",
+		"Nothing to confirm.":                "Нечего подтверждать.",
+		"Please accept or dispute your share, until then it does not count in balances.": "Примите или оспорьте свою долю, до тех пор она не учитывается в балансе.",
+		"Unanswered shares are accepted in %d hours.":                                    "Доли без ответа принимаются через %d ч.",
+		"Your share of transaction %d was accepted automatically.":                       "Ваша доля в транзакции %d принята автоматически.",
+		"What is wrong with it? Reply to this message, your comment goes to %s.":         "Что не так? Ответьте на это сообщение, ваш комментарий получит %s.",
+		"Disputed: %s": "Оспорено: %s",
+		"Sent to %s.":  "Отправлено: %s.",
+		"%s disputes their share %s of tr #%d %q: %s\n/edit%d /undo%d":   "%s оспаривает свою долю %s в tr #%d %q: %s\n/edit%d /undo%d",
+		"tr #%d %q was edited by %s. %s":                                 "tr #%d %q изменена участником %s. %s",
+		"Receipt attached to transaction %d. /receipt%d":                 "Чек прикреплён к транзакции %d. /receipt%d",
+		"You are not allowed to change this transaction.":                "Вам нельзя изменять эту транзакцию.",
+		"Failed to attach the receipt.":                                  "Не удалось прикрепить чек.",
+		"Transaction %d has no receipt.":                                 "У транзакции %d нет чека.",
+		"To split by items send \"item amount\" lines or press Itemise.": "Чтобы разделить по позициям, пришлите строки \"позиция сумма\" или нажмите «По позициям».",
+		"Itemise": "По позициям",
+		"Send items as \"item amount\", one per line or one per message. Mark shared extras with \"+\", e.g. \"+tip 10%\". Press ⏎ when done.": "Присылайте позиции в виде \"позиция сумма\", по одной в строке или сообщении. Общие надбавки отметьте \"+\", например \"+чаевые 10%\". Нажмите ⏎, когда закончите.",
+		"Who had %s (%s)?":                      "Кто взял %s (%s)?",
+		"shared extra":                          "общая надбавка",
+		"Transaction %d has no items.":          "В транзакции %d нет позиций.",
+		"This group is archived and read-only.": "Группа в архиве и доступна только для чтения.",
+	},
+}
+
+type settingItem struct {
+	column   string
+	title    string
+	value    func(s *groupSettings) string
+	choices  []string
+	freeText bool
+	validate func(v string) error
+}
+
+var settingItems = []settingItem{
+	{"name", "Name", func(s *groupSettings) string { return s.name }, nil, true, nil},
+	{"currency", "Currency", func(s *groupSettings) string { return s.currency }, currencyChoices, true,
+		func(v string) error {
+			if utf8.RuneCountInString(v) > 3 || strings.ContainsAny(v, " \t0123456789.,-") {
+				return fmt.Errorf("expected symbol or code like € or USD")
+			}
+			return nil
+		}},
+	{"timezone", "Timezone", func(s *groupSettings) string { return s.timezone }, []string{"Local", "UTC"}, true,
+		func(v string) error {
+			_, err := time.LoadLocation(v)
+			return err
+		}},
+	{"language", "Language", func(s *groupSettings) string { return s.language }, languageChoices, false, nil},
+	{"date_format", "Date format", func(s *groupSettings) string { return s.dateFormat }, dateFormatChoices, false, nil},
+	{"split_mode", "Default split", func(s *groupSettings) string { return s.splitMode }, splitModeChoices, false, nil},
+	{"edit_policy", "Who may undo or edit", func(s *groupSettings) string { return s.editPolicy }, editPolicyChoices, false, nil},
+	{"reset_policy", "Who may reset balances", func(s *groupSettings) string { return s.resetPolicy }, resetPolicyChoices, false, nil},
+	{"approval", "Expense approval", func(s *groupSettings) string { return s.approval }, approvalChoices, false, nil},
+	{"auto_accept_hours", "Auto-accept after hours", func(s *groupSettings) string { return strconv.Itoa(s.autoAccept) }, autoAcceptChoices, true,
+		func(v string) error {
+			if hours, err := strconv.Atoi(v); err != nil || hours < 0 {
+				return fmt.Errorf("expected number of hours")
+			}
+			return nil
+		}},
+	{"reminder_schedule", "Balance reminders", func(s *groupSettings) string { return s.reminderSchedule }, reminderChoices, false, nil},
+	{"reminder_threshold", "Remind when owing over", func(s *groupSettings) string { return strconv.FormatFloat(s.reminderThreshold, 'f', -1, 64) }, thresholdChoices, true,
+		func(v string) error {
+			if threshold, err := strconv.ParseFloat(v, 64); err != nil || threshold <= 0 {
+				return fmt.Errorf("expected positive number like 25.50")
+			}
+			return nil
+		}},
+	{"quiet_hours", "Quiet hours", func(s *groupSettings) string { return s.quietHours }, quietHoursChoices, true,
+		func(v string) error {
+			_, _, err := parseQuietHours(v)
+			return err
+		}},
+	{"summary_schedule", "Spending summary", func(s *groupSettings) string { return s.summarySchedule }, summaryChoices, false, nil},
+	{"summary_sections", "Summary sections", func(s *groupSettings) string { return s.summarySections }, sectionsChoices, true,
+		func(v string) error {
+			_, err := parseSummarySections(v)
+			return err
+		}},
+}
+
+func settingsHandler(update *tgbotapi2.Update, bot *tgbotapi2.BotAPI, replyChan <-chan reply, tasksChan chan<- task) {
+	logPrefix := "settings handler: "
+
+	callerId := update.Message.From.ID
+	chatId := update.Message.Chat.ID
+
+	isLeader, err := isGroupLeader(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"check leader: %v", err)
+		return
+	}
+	if !isLeader {
+		bot.Send(tgbotapi2.NewMessage(chatId, "Only group leader can change settings."))
+		return
+	}
+
+	const done = "⏎"
+	const back = "◀"
+	composeMenuKb := func(s *groupSettings) tgbotapi2.InlineKeyboardMarkup {
+		var rows [][]tgbotapi2.InlineKeyboardButton
+		for _, item := range settingItems {
+			text := fmt.Sprintf("%s: %s", item.title, describeSetting(item.value(s)))
+			rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(text, item.column)))
+		}
+		rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(done, done)))
+		return tgbotapi2.NewInlineKeyboardMarkup(rows...)
+	}
+
+	settings, err := getUserSettings(callerId)
+	if err != nil {
+		logE.Printf(logPrefix+"get settings: %v", err)
+		return
+	}
+	menuMsg := newAbortableMsg(chatId, "Group settings")
+	menuMsg.ReplyMarkup = composeMenuKb(settings)
+	sent, _ := bot.Send(menuMsg)
+
+	showMenu := func() bool {
+		if settings, err = getUserSettings(callerId); err != nil {
+			logE.Printf(logPrefix+"get settings: %v", err)
+			return false
+		}
+		edit := newAbortableEditMsg(chatId, sent.MessageID, "Group settings")
+		kb := composeMenuKb(settings)
+		edit.ReplyMarkup = &kb
+		bot.Send(edit)
+		return true
+	}
+
+	for r := range replyChan {
+		if isAbort(r) {
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
+			bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+			return
+		}
+		if r.cb == nil {
+			continue
+		}
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+		if r.cb.Data == done {
+			bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, settings.tr("Done.")))
+			return
+		}
+
+		var item *settingItem
+		for i := range settingItems {
+			if settingItems[i].column == r.cb.Data {
+				item = &settingItems[i]
+			}
+		}
+		if item == nil {
+			continue
+		}
+
+		// Ask for new value
+		var rows [][]tgbotapi2.InlineKeyboardButton
+		for _, choice := range item.choices {
+			rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(describeSetting(choice), choice)))
+		}
+		rows = append(rows, tgbotapi2.NewInlineKeyboardRow(tgbotapi2.NewInlineKeyboardButtonData(back, back)))
+		text := fmt.Sprintf("Select %s.", strings.ToLower(item.title))
+		if item.freeText {
+			text = fmt.Sprintf("Select or type %s.", strings.ToLower(item.title))
+		}
+		edit := newAbortableEditMsg(chatId, sent.MessageID, text)
+		kb := tgbotapi2.NewInlineKeyboardMarkup(rows...)
+		edit.ReplyMarkup = &kb
+		bot.Send(edit)
+
+		var value string
+		for value == "" {
+			vr := <-replyChan
+			if isAbort(vr) {
+				bot.Send(tgbotapi2.NewEditMessageText(chatId, sent.MessageID, "^C"))
+				bot.Send(tgbotapi2.NewMessage(chatId, settings.tr("Aborted.")))
+				return
+			}
+			if vr.cb != nil {
+				bot.AnswerCallbackQuery(tgbotapi2.NewCallback(vr.cb.ID, ""))
+				value = vr.cb.Data
+			} else if vr.msg != nil && item.freeText {
+				value = strings.TrimSpace(vr.msg.Text)
+			}
+			if value != "" && value != back && item.validate != nil {
+				if err := item.validate(value); err != nil {
+					bot.Send(tgbotapi2.NewMessage(chatId, fmt.Sprintf("Invalid %s: %v", strings.ToLower(item.title), err)))
+					value = ""
+				}
+			}
+		}
+
+		if value != back {
+			errChan := make(chan error)
+			tasksChan <- &updateSettingTask{callerId, item.column, value, errChan}
+			if err := <-errChan; err != nil {
+				logE.Printf(logPrefix+"execute update-setting task: %v", err)
+				bot.Send(tgbotapi2.NewMessage(chatId, "Failed to update setting."))
+			}
+		}
+		if !showMenu() {
+			return
+		}
+	}
+}
+
+// Parses whitespace separated positive weights, returns nil on mismatch
+func parseShares(text string, n int) []float64 {
+	fields := strings.Fields(text)
+	if len(fields) != n {
+		return nil
+	}
+	var shares []float64
+	for _, f := range fields {
+		share, err := strconv.ParseFloat(strings.Replace(f, ",", ".", 1), 64)
+		if err != nil || share <= 0 {
+			return nil
+		}
+		shares = append(shares, share)
+	}
+	return shares
+}
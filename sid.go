@@ -12,22 +12,38 @@ import (
 
 	"time"
 
-	"encoding/csv"
-
-	"os/exec"
-
 	"strings"
 
+	"sync"
+
 	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 // commands list:
-//ipay - create new transaction
+//ipay - create new transaction, e.g. /ipay 25.50 pizza @alice @bob
 //iowe - find out how much you need to give back
-//igive - give back a debt
+//igive - give back a debt, e.g. /igive 20 @alice
+//request - ask a member to pay you back, e.g. /request @alice 20
+//requests - list open payment requests
 //stat - display all balances
+//history - browse transactions of the group
+//find - search transactions by text, date, member and amount
+//categories - spending by category and category list
+//charts - spending charts by month, member and category
+//budget - spending limits of the group and its categories
+//recurring - expenses created automatically on schedule
+//receipt - show receipt photo of a transaction, e.g. /receipt12
+//items - show item breakdown of a transaction, e.g. /items12
+//notifications - choose how you hear about entries involving you
 //leavegroup - leave current group
+//addmember - add a member without Telegram account
+//claim - take over a member added by someone else
+//nick - set a nickname shown in this group
+//settings - change group settings
+//export - download group history as csv
+//archivegroup - make group read-only
+//deletegroup - remove group with all its history
 
 var (
 	logD *log.Logger
@@ -38,6 +54,12 @@ var (
 
 var db *sql.DB
 
+// Last stored profile of every user seen since start
+var knownProfiles = struct {
+	sync.Mutex
+	m map[int]string
+}{m: make(map[int]string)}
+
 func initLoggers(debugMode bool) {
 	debugHandle := ioutil.Discard
 	if debugMode {
@@ -64,6 +86,7 @@ type userExpense struct {
 	amount float64
 	payer  string
 	time   time.Time
+	voided bool
 }
 
 func processQueue(tasksChan <-chan task) {
@@ -108,6 +131,14 @@ func main() {
 			log.Fatalf("ping db: %v", err)
 		}
 	}
+	if err = migrateTables(); err != nil {
+		log.Fatalf("migrate tables: %v", err)
+	}
+	if receiptsDir = conf.params.ReceiptsDir; len(receiptsDir) != 0 {
+		if err = os.MkdirAll(receiptsDir, 0755); err != nil {
+			log.Fatalf("create receipts dir: %v", err)
+		}
+	}
 
 	// Set up bot
 	api, err := tgbotapi2.NewBotAPI(conf.params.Token)
@@ -124,6 +155,14 @@ func main() {
 	tasksChan := make(chan task)
 	go processQueue(tasksChan)
 
+	// Set up goroutine creating recurring expenses
+	go runRecurringScheduler(api, tasksChan)
+	go runDigestScheduler(api, tasksChan)
+	go runAutoAcceptScheduler(api, tasksChan)
+	go runRepaymentReminders(api, tasksChan)
+	go runBalanceReminders(api, tasksChan)
+	go runSummaryScheduler(api, tasksChan)
+
 	updatesChan, err := api.GetUpdatesChan(u)
 	clients := make(map[int]chan reply)
 
@@ -137,10 +176,37 @@ func processUpdate(
 	update tgbotapi2.Update, clients map[int]chan reply, api *tgbotapi2.BotAPI, botName string, tasksChan chan<- task,
 ) {
 	logPrefix := "process update: "
+	if update.CallbackQuery != nil {
+		refreshProfile(update.CallbackQuery.From, tasksChan)
+	} else if update.Message != nil {
+		refreshProfile(update.Message.From, tasksChan)
+	}
+
 	if update.CallbackQuery != nil {
 		// Got new callback
 		logD.Printf(logPrefix+"callback from user %d", update.CallbackQuery.From.ID)
-		clients[update.CallbackQuery.From.ID] <- reply{update.CallbackQuery, nil}
+		if strings.HasPrefix(update.CallbackQuery.Data, acceptSharePrefix) {
+			go acceptShareHandler(&update, api, tasksChan)
+		} else if strings.HasPrefix(update.CallbackQuery.Data, confirmRepaymentPrefix) ||
+			strings.HasPrefix(update.CallbackQuery.Data, rejectRepaymentPrefix) {
+			go answerRepaymentHandler(&update, api, tasksChan)
+		} else if strings.HasPrefix(update.CallbackQuery.Data, paidRequestPrefix) {
+			go paidRequestHandler(&update, api, tasksChan)
+		} else if strings.HasPrefix(update.CallbackQuery.Data, snoozeReminderPrefix) {
+			go snoozeReminderHandler(&update, api, tasksChan)
+		} else if strings.HasPrefix(update.CallbackQuery.Data, disputeSharePrefix) {
+			go disputeShareHandler(&update, api)
+		} else if clientChan, ok := clients[update.CallbackQuery.From.ID]; ok {
+			// Buttons of a finished conversation must not block the loop
+			select {
+			case clientChan <- reply{update.CallbackQuery, nil}:
+			default:
+				logW.Printf(logPrefix+"nobody waits for callback from user %d", update.CallbackQuery.From.ID)
+				api.AnswerCallbackQuery(tgbotapi2.NewCallback(update.CallbackQuery.ID, ""))
+			}
+		} else {
+			api.AnswerCallbackQuery(tgbotapi2.NewCallback(update.CallbackQuery.ID, ""))
+		}
 	} else if update.Message != nil {
 		// Got new message
 		if len(update.Message.Text) > 0 {
@@ -172,8 +238,90 @@ func processUpdate(
 					clients[update.Message.From.ID] = clientChan
 
 					go igiveHandler(&update, api, clientChan, tasksChan)
+				case "addmember":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go addMemberHandler(&update, api, botName, clientChan, tasksChan)
+				case "claim":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go claimHandler(&update, api, clientChan, tasksChan)
+				case "nick":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go nickHandler(&update, api, clientChan, tasksChan)
+				case "settings":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go settingsHandler(&update, api, clientChan, tasksChan)
+				case "categories":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go categoriesHandler(&update, api, clientChan, tasksChan)
+				case "charts":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go chartsHandler(&update, api, clientChan)
+				case "budget":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go budgetHandler(&update, api, clientChan, tasksChan)
+				case "recurring":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go recurringHandler(&update, api, clientChan, tasksChan)
+				case "notifications":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go notificationsHandler(&update, api, clientChan, tasksChan)
+				case "archivegroup":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go archiveGroupHandler(&update, api, clientChan, tasksChan)
+				case "deletegroup":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go deleteGroupHandler(&update, api, clientChan, tasksChan)
+				case "export":
+					go exportHandler(&update, api)
+				case "history":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go historyHandler(&update, api, clientChan)
 				case "iowe":
 					go ioweHandler(&update, api)
+				case "request":
+					logD.Printf("add channel with user %d", update.Message.From.ID)
+					clientChan := make(chan reply, 10)
+					clients[update.Message.From.ID] = clientChan
+
+					go requestHandler(&update, api, clientChan, tasksChan)
+				case "requests":
+					go requestsHandler(&update, api)
 				case "abort":
 					clients[update.Message.From.ID] <- reply{nil, update.Message}
 				case "reset":
@@ -181,22 +329,69 @@ func processUpdate(
 				case "stat":
 					go statHandler(&update, api)
 				default:
-					if strings.HasPrefix(update.Message.Text[1:], "undo") {
+					if strings.HasPrefix(update.Message.Text[1:], "ipay ") {
+						logD.Printf("add channel with user %d", update.Message.From.ID)
+						clientChan := make(chan reply, 10)
+						clients[update.Message.From.ID] = clientChan
+
+						go ipayHandler(&update, api, clientChan, tasksChan)
+					} else if strings.HasPrefix(update.Message.Text[1:], "igive ") {
+						logD.Printf("add channel with user %d", update.Message.From.ID)
+						clientChan := make(chan reply, 10)
+						clients[update.Message.From.ID] = clientChan
+
+						go igiveHandler(&update, api, clientChan, tasksChan)
+					} else if strings.HasPrefix(update.Message.Text[1:], "request ") {
+						logD.Printf("add channel with user %d", update.Message.From.ID)
+						clientChan := make(chan reply, 10)
+						clients[update.Message.From.ID] = clientChan
+
+						go requestHandler(&update, api, clientChan, tasksChan)
+					} else if strings.HasPrefix(update.Message.Text[1:], "undo") || strings.HasPrefix(update.Message.Text[1:], "redo") {
 						logD.Printf("add channel with user %d", update.Message.From.ID)
 						clientChan := make(chan reply, 10)
 						clients[update.Message.From.ID] = clientChan
 
 						go undoHandler(&update, api, clientChan, tasksChan)
+					} else if strings.HasPrefix(update.Message.Text[1:], "find") {
+						logD.Printf("add channel with user %d", update.Message.From.ID)
+						clientChan := make(chan reply, 10)
+						clients[update.Message.From.ID] = clientChan
+
+						go findHandler(&update, api, clientChan)
+					} else if strings.HasPrefix(update.Message.Text[1:], "edit") {
+						logD.Printf("add channel with user %d", update.Message.From.ID)
+						clientChan := make(chan reply, 10)
+						clients[update.Message.From.ID] = clientChan
+
+						go editHandler(&update, api, clientChan, tasksChan)
+					} else if strings.HasPrefix(update.Message.Text[1:], "items") {
+						go itemsHandler(&update, api)
+					} else if strings.HasPrefix(update.Message.Text[1:], "receipt") {
+						go receiptHandler(&update, api)
+					} else if strings.HasPrefix(update.Message.Text[1:], "approveleave") {
+						go approveLeaveHandler(&update, api, tasksChan)
 					} else {
 						logI.Printf("unknown command: %q", update.Message.Text[1:])
 						handleNotAllowed(update, api)
 					}
 				}
+			} else if _, ok := parseDisputePrompt(update.Message.ReplyToMessage); ok && update.Message.ReplyToMessage.From != nil && update.Message.ReplyToMessage.From.ID == api.Self.ID {
+				// Comment on a disputed share comes outside of any conversation
+				go disputeCommentHandler(&update, api, tasksChan)
 			} else {
 				// Got new text message
 				logD.Printf("got new message from %d", update.Message.From.ID)
 				clients[update.Message.From.ID] <- reply{nil, update.Message}
 			}
+		} else if update.Message.Photo != nil {
+			// Got new photo, either a receipt for a recorded transaction or
+			// a part of conversation
+			if _, ok := parseTransactionRef(update.Message.ReplyToMessage); ok && update.Message.ReplyToMessage.From != nil && update.Message.ReplyToMessage.From.ID == api.Self.ID {
+				go attachReceiptHandler(&update, api, tasksChan)
+			} else if clientChan, ok := clients[update.Message.From.ID]; ok {
+				clientChan <- reply{nil, update.Message}
+			}
 		} else {
 			logD.Println("no text in message; skipping")
 		}
@@ -205,6 +400,52 @@ func processUpdate(
 	}
 }
 
+// Queues update of the stored name when user's Telegram profile changed
+func refreshProfile(u *tgbotapi2.User, tasksChan chan<- task) {
+	if u == nil {
+		return
+	}
+	name := username(u)
+	if len(name) == 0 {
+		return
+	}
+	profile := name + "\x00" + u.UserName
+
+	knownProfiles.Lock()
+	known := knownProfiles.m[u.ID] == profile
+	knownProfiles.Unlock()
+	if known {
+		return
+	}
+
+	// Users without a group have nothing to update until they join one
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id=?)`, u.ID).Scan(&exists); err != nil {
+		logE.Printf("refresh profile: select user %d: %v", u.ID, err)
+		return
+	}
+	if !exists {
+		rememberProfile(u.ID, profile)
+		return
+	}
+
+	logD.Printf("refresh profile of user %d", u.ID)
+	go func() {
+		tasksChan <- &refreshUserTask{u.ID, name, u.UserName, profile}
+	}()
+}
+
+// Records profile as stored; empty profile makes the next update refresh it
+func rememberProfile(uid int, profile string) {
+	knownProfiles.Lock()
+	if len(profile) == 0 {
+		delete(knownProfiles.m, uid)
+	} else {
+		knownProfiles.m[uid] = profile
+	}
+	knownProfiles.Unlock()
+}
+
 func username(u *tgbotapi2.User) string {
 	if len(u.FirstName) != 0 {
 		if len(u.LastName) != 0 {
@@ -233,79 +474,104 @@ func isAbort(r reply) bool {
 	return r.msg != nil && r.msg.Text == "/abort"
 }
 
-func debtMessage(debt float64) string {
+// Menus left untouched for so long lose their buttons, which also ends the
+// conversation
+const menuIdleTimeout = 15 * time.Minute
+
+// Waits for the next reply, returns false when none came in menuIdleTimeout
+func nextReply(replyChan <-chan reply) (reply, bool) {
+	idle := time.NewTimer(menuIdleTimeout)
+	defer idle.Stop()
+	select {
+	case r := <-replyChan:
+		return r, true
+	case <-idle.C:
+		return reply{}, false
+	}
+}
+
+// Waits for a button of the menu message, returns empty string on abort or
+// timeout
+func nextMenuChoice(chatId int64, menuId int, bot *tgbotapi2.BotAPI, replyChan <-chan reply) string {
+	for {
+		r, ok := nextReply(replyChan)
+		if !ok || isAbort(r) {
+			bot.Send(tgbotapi2.NewEditMessageReplyMarkup(chatId, menuId, tgbotapi2.NewInlineKeyboardMarkup()))
+			return ""
+		}
+		if r.cb == nil || r.cb.Message == nil || r.cb.Message.MessageID != menuId {
+			continue
+		}
+		bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+		return r.cb.Data
+	}
+}
+
+// Waits for text typed by user while the menu shows the back button, empty
+// text means going back; returns false on abort or timeout
+func nextMenuText(chatId int64, menuId int, back string, bot *tgbotapi2.BotAPI, replyChan <-chan reply) (text string, ok bool) {
+	for {
+		r, ok := nextReply(replyChan)
+		if !ok || isAbort(r) {
+			bot.Send(tgbotapi2.NewEditMessageReplyMarkup(chatId, menuId, tgbotapi2.NewInlineKeyboardMarkup()))
+			return "", false
+		}
+		if r.cb != nil && r.cb.Data == back {
+			bot.AnswerCallbackQuery(tgbotapi2.NewCallback(r.cb.ID, ""))
+			return "", true
+		}
+		if r.msg != nil {
+			if text = strings.TrimSpace(r.msg.Text); len(text) != 0 {
+				return text, true
+			}
+		}
+	}
+}
+
+func debtMessage(settings *groupSettings, debt float64) string {
 	if debt == 0 {
-		return "You owe nothing"
+		return settings.tr("You owe nothing")
 	} else if debt > 0 {
-		return fmt.Sprintf("You owe €%.2f", debt)
+		return fmt.Sprintf(settings.tr("You owe %s"), settings.money(debt))
 	} else {
-		return fmt.Sprintf("You are owed €%.2f", -debt)
+		return fmt.Sprintf(settings.tr("You are owed %s"), settings.money(-debt))
 	}
 }
 
-func createExpensesImage(user int64, users map[int64]string) (imgPath string, err error) {
+// Renders expenses of the user into table pages in a new temporary directory,
+// which the caller removes once the pages are sent
+func createExpensesImages(user int64, users map[int64]string, settings *groupSettings) (dir string, pages []string, err error) {
 	expenses, err := selectExpensesFromDB(user, users)
 	if err != nil {
 		err = fmt.Errorf("select all user expenses: %v", err)
 		return
 	}
 
-	// Create csv file
 	var total float64
-	var records [][]string
-	records = append(records, []string{"Title", "Amount", "Payer", "Date"})
+	var rows []tableRow
 	for _, e := range expenses {
-		var record []string
-		record = append(record, e.title)
-		record = append(record, fmt.Sprintf("€%.2f", e.amount))
-		record = append(record, e.payer)
-		record = append(record, e.time.Format("02/01/2006 15:04:05"))
-
-		total += e.amount
-		records = append(records, record)
-	}
-
-	var summary []string
-	summary = append(summary, "<b>Total</b>")
-	summary = append(summary, fmt.Sprintf("€<b>%.2f</b>", total))
-	summary = append(summary, "-")
-	summary = append(summary, "-")
-
-	records = append(records, summary)
-
-	csvFilename := fmt.Sprintf("%s-%d.csv", users[user], int32(time.Now().Unix()))
-	csvFile, err := os.Create(csvFilename)
-	if err != nil {
-		err = fmt.Errorf("open csv file: %v", err)
-		return
-	}
-
-	csvWriter := csv.NewWriter(csvFile)
-	for _, record := range records {
-		if err = csvWriter.Write(record); err != nil {
-			err = fmt.Errorf("error writing record to csv: %v", err)
-			return
+		row := tableRow{[]string{e.title, settings.money(e.amount), e.payer, settings.formatTime(e.time)}, rowNormal}
+		if e.voided {
+			// Voided expenses stay in history but do not count
+			row.cells[0] = fmt.Sprintf(settings.tr("%s (voided)"), e.title)
+			row.style = rowMuted
+		} else {
+			total += e.amount
 		}
+		rows = append(rows, row)
 	}
-	csvWriter.Flush()
-	csvFile.Close()
-	if err = csvWriter.Error(); err != nil {
-		return
-	}
+	rows = append(rows, tableRow{[]string{settings.tr("Total"), settings.money(total), "-", "-"}, rowBold})
 
-	// Call table renderer script to create the image
-	var output []byte
-	if output, err = exec.Command("./venv/bin/python", "table_renderer.py", csvFilename).CombinedOutput(); err != nil {
-		err = fmt.Errorf("calling table renderer script: %v; output: %s", err, string(output))
+	if dir, err = ioutil.TempDir("", "sid-expenses-"); err != nil {
+		err = fmt.Errorf("create temporary directory: %v", err)
 		return
 	}
-
-	imgPath = csvFilename[:len(csvFilename)-3] + "png"
-	if _, err = os.Stat(imgPath); os.IsNotExist(err) {
-		err = fmt.Errorf("convert table into image: %v", err)
-		return
+	header := []string{settings.tr("Title"), settings.tr("Amount"), settings.tr("Payer"), settings.tr("Date")}
+	if pages, err = renderTable(header, rows, dir, "expenses"); err != nil {
+		os.RemoveAll(dir)
+		dir = ""
+		err = fmt.Errorf("render expenses table: %v", err)
 	}
-
 	return
 }
 
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi2 "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Schedules of the spending summary sent to every member
+const (
+	summaryOff     = "off"
+	summaryWeekly  = "weekly"
+	summaryMonthly = "monthly"
+)
+
+// Sections of the spending summary
+const (
+	summaryTotal      = "total"
+	summaryCategories = "categories"
+	summaryBiggest    = "biggest"
+	summaryMembers    = "members"
+	summaryBalances   = "balances"
+	summarySettleUp   = "settleup"
+)
+
+var summarySectionChoices = []string{summaryTotal, summaryCategories, summaryBiggest, summaryMembers, summaryBalances, summarySettleUp}
+
+// Hour of the day in group timezone when summaries of the finished period are
+// sent
+const summaryHour = 9
+
+// Number of categories and expenses listed in the summary
+const summaryTopCount = 3
+
+// Checks comma separated list of summary sections
+func parseSummarySections(text string) (sections []string, err error) {
+	for _, s := range strings.Split(text, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if len(s) == 0 {
+			continue
+		}
+		known := false
+		for _, choice := range summarySectionChoices {
+			known = known || choice == s
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown section %q, use %s", s, strings.Join(summarySectionChoices, ","))
+		}
+		sections = append(sections, s)
+	}
+	if len(sections) == 0 {
+		return nil, fmt.Errorf("expected sections like %s", strings.Join(summarySectionChoices, ","))
+	}
+	return
+}
+
+// Returns the latest summarized period, which ended by summaryHour of the day
+// before now; zero times when summaries are off
+func lastSummaryPeriod(now time.Time, schedule string, loc *time.Location) (from, to time.Time) {
+	t := now.In(loc).Add(-summaryHour * time.Hour)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	switch schedule {
+	case summaryWeekly:
+		// Weeks start on Monday
+		to = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return to.AddDate(0, 0, -7), to
+	case summaryMonthly:
+		to = time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, loc)
+		return to.AddDate(0, -1, 0), to
+	}
+	return
+}
+
+type summaryDue struct {
+	groupId int
+	member  int          // any active member to look up the group by
+	sent    sql.NullTime // end of the period summarized last
+}
+
+func selectSummaryGroups() (groups []summaryDue, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT G.id, G.summary_sent_ts,
+(SELECT U.id FROM users U WHERE U.group_id=G.id AND U.is_active=1 AND U.id>0 LIMIT 1)
+FROM groups G WHERE G.summary_schedule!=? AND G.archived_ts IS NULL`, summaryOff)
+	if err != nil {
+		err = fmt.Errorf("select summary groups: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sd summaryDue
+		var member sql.NullInt64
+		if err = rows.Scan(&sd.groupId, &sd.sent, &member); err != nil {
+			err = fmt.Errorf("scan summary group: %v", err)
+			return
+		}
+		if member.Valid {
+			sd.member = int(member.Int64)
+			groups = append(groups, sd)
+		}
+	}
+	return
+}
+
+// Sends summary of the finished period to every member of groups which have
+// it on; a summary missed during downtime is sent on the first run
+func runSummaryScheduler(bot *tgbotapi2.BotAPI, tasksChan chan<- task) {
+	logPrefix := "summary scheduler: "
+
+	for ; ; time.Sleep(time.Minute) {
+		groups, err := selectSummaryGroups()
+		if err != nil {
+			logE.Printf(logPrefix+"%v", err)
+			continue
+		}
+		for _, sd := range groups {
+			settings, err := getUserSettings(sd.member)
+			if err != nil {
+				logE.Printf(logPrefix+"get settings: %v", err)
+				continue
+			}
+			from, to := lastSummaryPeriod(time.Now(), settings.summarySchedule, settings.location())
+			if to.IsZero() || (sd.sent.Valid && !sd.sent.Time.Before(to)) {
+				continue
+			}
+			text, err := formatSummary(sd.member, from, to, settings)
+			if err != nil {
+				logE.Printf(logPrefix+"%v", err)
+				continue
+			}
+			members, err := selectGroupMembers(sd.member)
+			if err != nil {
+				logE.Printf(logPrefix+"select group members: %v", err)
+				continue
+			}
+			for _, uid := range sortedMemberIds(members) {
+				if isPlaceholder(uid) {
+					continue
+				}
+				if _, err := bot.Send(tgbotapi2.NewMessage(uid, text)); err != nil {
+					logW.Printf(logPrefix+"send to %d: %v", uid, err)
+				}
+			}
+
+			mt := &markSummarySentTask{sd.groupId, to, make(chan error)}
+			tasksChan <- mt
+			if err := <-mt.err; err != nil {
+				logE.Printf(logPrefix+"execute mark-summary-sent task: %v", err)
+			}
+		}
+	}
+}
+
+func selectSpentTotal(uid int, from, to time.Time) (count int, total float64, err error) {
+	err = db.QueryRow(`SELECT COUNT(*), IFNULL(SUM(T.amount), 0) FROM transactions T
+WHERE T.owner_id IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?))
+AND T.voided_ts IS NULL AND T.ts>=? AND T.ts<?`, uid, from.UTC(), to.UTC()).Scan(&count, &total)
+	if err != nil {
+		err = fmt.Errorf("select spent total: %v", err)
+	}
+	return
+}
+
+// Returns the most expensive group transactions of the period
+func selectBiggestExpenses(uid int, from, to time.Time, limit int) (entries []transactionInfo, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT T.id, T.title, T.amount, T.ts, T.owner_id FROM transactions T
+WHERE T.owner_id IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?))
+AND T.voided_ts IS NULL AND T.ts>=? AND T.ts<?
+ORDER BY T.amount DESC, T.id LIMIT ?`, uid, from.UTC(), to.UTC(), limit)
+	if err != nil {
+		err = fmt.Errorf("select biggest expenses: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e transactionInfo
+		if err = rows.Scan(&e.id, &e.title, &e.amount, &e.time, &e.owner); err != nil {
+			err = fmt.Errorf("scan expense: %v", err)
+			return
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+// Sums up what every member paid in the period
+func selectPaidByMember(uid int, from, to time.Time) (paid map[int64]float64, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT T.owner_id, SUM(T.amount) FROM transactions T
+WHERE T.owner_id IN (SELECT id FROM users WHERE group_id=(SELECT group_id FROM users WHERE id=?))
+AND T.voided_ts IS NULL AND T.ts>=? AND T.ts<?
+GROUP BY T.owner_id`, uid, from.UTC(), to.UTC())
+	if err != nil {
+		err = fmt.Errorf("select paid by member: %v", err)
+		return
+	}
+	defer rows.Close()
+	paid = make(map[int64]float64)
+	for rows.Next() {
+		var owner int64
+		var amount float64
+		if err = rows.Scan(&owner, &amount); err != nil {
+			err = fmt.Errorf("scan paid by member: %v", err)
+			return
+		}
+		paid[owner] = amount
+	}
+	return
+}
+
+// Composes the summary of [from, to) out of the sections chosen by the group
+func formatSummary(uid int, from, to time.Time, settings *groupSettings) (string, error) {
+	names, err := selectAllGroupMembers(uid)
+	if err != nil {
+		return "", fmt.Errorf("select group members: %v", err)
+	}
+	members, err := selectGroupMembers(uid)
+	if err != nil {
+		return "", fmt.Errorf("select group members: %v", err)
+	}
+	sections, err := parseSummarySections(settings.summarySections)
+	if err != nil {
+		sections = summarySectionChoices
+	}
+
+	parts := []string{fmt.Sprintf(settings.tr("%s: summary for %s – %s"),
+		settings.name, settings.formatDay(from), settings.formatDay(to.AddDate(0, 0, -1)))}
+	for _, section := range sections {
+		var lines []string
+		switch section {
+		case summaryTotal:
+			count, total, err := selectSpentTotal(uid, from, to)
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, fmt.Sprintf(settings.tr("Spent %s in %d expenses."), settings.money(total), count))
+		case summaryCategories:
+			spending, err := selectCategorySpending(uid, from, to)
+			if err != nil {
+				return "", err
+			}
+			if len(spending) == 0 {
+				continue
+			}
+			lines = append(lines, settings.tr("Top categories:"))
+			for i, s := range spending {
+				if i == summaryTopCount {
+					break
+				}
+				name := s.name
+				if len(name) == 0 {
+					name = settings.tr("Uncategorized")
+				}
+				lines = append(lines, fmt.Sprintf("%s — %s", name, settings.money(s.total)))
+			}
+		case summaryBiggest:
+			entries, err := selectBiggestExpenses(uid, from, to, summaryTopCount)
+			if err != nil {
+				return "", err
+			}
+			if len(entries) == 0 {
+				continue
+			}
+			lines = append(lines, settings.tr("Biggest expenses:"))
+			for _, e := range entries {
+				lines = append(lines, fmt.Sprintf("%s %q — %s, %s", settings.formatDay(e.time), e.title, settings.money(e.amount), names[e.owner]))
+			}
+		case summaryMembers:
+			paid, err := selectPaidByMember(uid, from, to)
+			if err != nil {
+				return "", err
+			}
+			spending, err := selectCategorySpending(uid, from, to)
+			if err != nil {
+				return "", err
+			}
+			consumed := make(map[int64]float64)
+			for _, s := range spending {
+				for member, amount := range s.members {
+					consumed[member] += amount
+				}
+			}
+			lines = append(lines, settings.tr("Paid and consumed:"))
+			for _, member := range sortedMemberIds(members) {
+				lines = append(lines, fmt.Sprintf(settings.tr("%s: paid %s, consumed %s"),
+					members[member], settings.money(paid[member]), settings.money(consumed[member])))
+			}
+		case summaryBalances:
+			lines = append(lines, settings.tr("Balances:"))
+			for _, member := range sortedMemberIds(members) {
+				var debt, change float64
+				if err := calcDebt(int(member), &debt); err != nil {
+					return "", err
+				}
+				if err := calcBalanceChange(int(member), from, to, &change); err != nil {
+					return "", err
+				}
+				sign := "+"
+				if change < 0 {
+					sign, change = "−", -change
+				}
+				lines = append(lines, fmt.Sprintf(settings.tr("%s: %s (%s this period)"), members[member], settings.money(debt), sign+settings.money(change)))
+			}
+		case summarySettleUp:
+			balances := make(map[int64]float64)
+			for member := range members {
+				var debt float64
+				if err := calcDebt(int(member), &debt); err != nil {
+					return "", err
+				}
+				balances[member] = debt
+			}
+			plan := settleUpPlan(balances)
+			if len(plan) == 0 {
+				lines = append(lines, settings.tr("Everybody is settled up."))
+				break
+			}
+			sort.SliceStable(plan, func(i, j int) bool { return members[plan[i].src] < members[plan[j].src] })
+			lines = append(lines, settings.tr("To settle up:"))
+			for _, t := range plan {
+				lines = append(lines, fmt.Sprintf(settings.tr("%s gives %s to %s"), members[t.src], settings.money(t.amount), members[t.dst]))
+			}
+		}
+		parts = append(parts, strings.Join(lines, "\n"))
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"math"
+	"strings"
 	"time"
 )
 
@@ -34,7 +36,7 @@ func (cgt *createGroupTask) Exec() {
 	}
 
 	var execRes sql.Result
-	if execRes, err = stmt.Exec(cgt.groupName, cgt.createTs, cgt.invite); err != nil {
+	if execRes, err = stmt.Exec(cgt.groupName, cgt.createTs.UTC(), cgt.invite); err != nil {
 		cgt.err <- fmt.Errorf("exec insert new group query: %v", err)
 		return
 	}
@@ -50,6 +52,13 @@ func (cgt *createGroupTask) Exec() {
 		return
 	}
 
+	for _, name := range defaultCategories {
+		if _, err := trans.Exec(`INSERT INTO categories (group_id, name) VALUES (?, ?);`, groupId, name); err != nil {
+			cgt.err <- fmt.Errorf("exec insert default category query: %v", err)
+			return
+		}
+	}
+
 	if err := trans.Commit(); err != nil {
 		cgt.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
 		return
@@ -74,6 +83,8 @@ func upsertUserGroup(userId int, userName string, groupId int, isLeader bool) er
 	if _, err = stmt.Exec(userId, userName, groupId, isLeader); err != nil {
 		return fmt.Errorf("exec insert user query: %v", err)
 	}
+	// Username of a new member is stored on the next update
+	rememberProfile(userId, "")
 	return nil
 }
 
@@ -116,29 +127,200 @@ func (jgt *joinGroupTask) Exec() {
 	jgt.err <- nil
 }
 
+const (
+	leaveSettled = iota
+	leaveTransfer
+	leaveRequestWriteOff
+	leaveWriteOff
+)
+
+// Balances below half a cent are treated as settled
+const balanceEpsilon = 0.005
+
 type leaveGroupTask struct {
-	userId int
-	err    chan error
+	userId     int
+	mode       int
+	transferTo int64 // member taking over the balance for leaveTransfer
+	approverId int   // another leader approving the requested write-off for leaveWriteOff
+	err        chan error
 }
 
+// Leaving keeps member's history: all operations are moved to an inactive
+// placeholder so that the Telegram account is free to join another group
 func (lgt *leaveGroupTask) Exec() {
+	log.Println("execing leavegroup")
 	trans, err := db.Begin()
 	if err != nil {
 		lgt.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
 		return
 	}
+	defer trans.Rollback()
 
-	stmt, err := db.Prepare(`DELETE FROM users WHERE id=?;`)
+	var groupId sql.NullInt64
+	var name, nickname, username string
+	var isLeader bool
+	var leaveRequested sql.NullString
+	err = trans.QueryRow(`SELECT group_id, name, IFNULL(nickname, ''), IFNULL(username, ''), is_leader, leave_requested_ts
+FROM users WHERE id=?`, lgt.userId).Scan(&groupId, &name, &nickname, &username, &isLeader, &leaveRequested)
 	if err != nil {
-		lgt.err <- fmt.Errorf("prepare delete user query: %v", err)
+		lgt.err <- fmt.Errorf("select user: %v", err)
 		return
 	}
-	log.Println("execing leavegroup")
-	if _, err = stmt.Exec(lgt.userId); err != nil {
+	if !groupId.Valid {
+		lgt.err <- fmt.Errorf("user %d has no group", lgt.userId)
+		return
+	}
+
+	var debt float64
+	if err = calcDebt(lgt.userId, &debt); err != nil {
+		lgt.err <- fmt.Errorf("calculate debt: %v", err)
+		return
+	}
+	settled := math.Abs(debt) < balanceEpsilon
+
+	switch lgt.mode {
+	case leaveSettled:
+		// Balances of archived groups are frozen and no longer matter
+		var archived bool
+		if err = trans.QueryRow(`SELECT archived_ts IS NOT NULL FROM groups WHERE id=?`, groupId.Int64).Scan(&archived); err != nil {
+			lgt.err <- fmt.Errorf("select group archived: %v", err)
+			return
+		}
+		if !settled && !archived {
+			lgt.err <- &errorOpenBalance{debt}
+			return
+		}
+	case leaveTransfer:
+		var active bool
+		err = trans.QueryRow(`SELECT is_active FROM users WHERE id=? AND group_id=?`, lgt.transferTo, groupId.Int64).Scan(&active)
+		if err != nil || !active || lgt.transferTo == int64(lgt.userId) {
+			lgt.err <- &errorNotAllowed{}
+			return
+		}
+		if !settled {
+			if err = settleBalance(trans, lgt.userId, fmt.Sprintf("Balance of %s transferred", name), debt, []int64{lgt.transferTo}); err != nil {
+				lgt.err <- fmt.Errorf("transfer balance: %v", err)
+				return
+			}
+		}
+	case leaveRequestWriteOff:
+		if _, err = trans.Exec(`UPDATE users SET leave_requested_ts=? WHERE id=?;`, time.Now().UTC(), lgt.userId); err != nil {
+			lgt.err <- fmt.Errorf("exec request leave query: %v", err)
+			return
+		}
+		if err = trans.Commit(); err != nil {
+			lgt.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
+			return
+		}
+		lgt.err <- nil
+		return
+	case leaveWriteOff:
+		var approverIsLeader bool
+		err = trans.QueryRow(`SELECT is_leader FROM users WHERE id=? AND group_id=?`, lgt.approverId, groupId.Int64).Scan(&approverIsLeader)
+		if err != nil || !approverIsLeader || !leaveRequested.Valid || lgt.approverId == lgt.userId {
+			lgt.err <- &errorNotAllowed{}
+			return
+		}
+		if !settled {
+			var others []int64
+			rows, err := trans.Query(`SELECT id FROM users WHERE group_id=? AND is_active=1 AND id!=?`, groupId.Int64, lgt.userId)
+			if err != nil {
+				lgt.err <- fmt.Errorf("select remaining members: %v", err)
+				return
+			}
+			for rows.Next() {
+				var uid int64
+				if err = rows.Scan(&uid); err != nil {
+					break
+				}
+				others = append(others, uid)
+			}
+			rows.Close()
+			if err != nil {
+				lgt.err <- fmt.Errorf("scan remaining members: %v", err)
+				return
+			}
+			if len(others) > 0 {
+				if err = settleBalance(trans, lgt.userId, fmt.Sprintf("Balance of %s written off", name), debt, others); err != nil {
+					lgt.err <- fmt.Errorf("write off balance: %v", err)
+					return
+				}
+			}
+		}
+	}
+
+	// Repayments the member has not confirmed never happened
+	if _, err = trans.Exec(`DELETE FROM payment_requests WHERE repayment_id IN
+(SELECT id FROM repayments WHERE state=? AND (src=? OR dst=?));`, repaymentPending, lgt.userId, lgt.userId); err != nil {
+		lgt.err <- fmt.Errorf("exec delete payment requests query: %v", err)
+		return
+	}
+	if _, err = trans.Exec(`DELETE FROM repayments WHERE state=? AND (src=? OR dst=?);`,
+		repaymentPending, lgt.userId, lgt.userId); err != nil {
+		lgt.err <- fmt.Errorf("exec delete pending repayments query: %v", err)
+		return
+	}
+
+	// Keep history under an inactive placeholder
+	ghostId, err := nextPlaceholderId(trans)
+	if err != nil {
+		lgt.err <- err
+		return
+	}
+	if _, err = trans.Exec(`INSERT INTO users (id, name, group_id, is_leader, nickname, username, is_active) VALUES (?, ?, ?, 0, ?, ?, 0);`,
+		ghostId, name, groupId.Int64, nullIfEmpty(nickname), nullIfEmpty(username)); err != nil {
+		lgt.err <- fmt.Errorf("exec insert inactive member query: %v", err)
+		return
+	}
+	stmts := []string{
+		`UPDATE operations SET src=? WHERE src=?;`,
+		`UPDATE operations SET dst=? WHERE dst=?;`,
+		`UPDATE transactions SET owner_id=? WHERE owner_id=?;`,
+		`UPDATE transaction_item_shares SET member_id=? WHERE member_id=?;`,
+		`UPDATE share_confirmations SET member_id=? WHERE member_id=?;`,
+		`UPDATE repayments SET src=? WHERE src=?;`,
+		`UPDATE repayments SET dst=? WHERE dst=?;`,
+	}
+	for _, stmt := range stmts {
+		if _, err = trans.Exec(stmt, ghostId, lgt.userId); err != nil {
+			lgt.err <- fmt.Errorf("exec move history query: %v", err)
+			return
+		}
+	}
+	// Recurring expenses are not charged to a member who left and nothing is
+	// sent to them any more
+	stmts = []string{
+		`DELETE FROM recurring_shares WHERE member_id=? OR recurring_id IN (SELECT id FROM recurring WHERE owner_id=?);`,
+		`DELETE FROM recurring WHERE owner_id=?;`,
+		`DELETE FROM queued_notifications WHERE member_id=?;`,
+		`DELETE FROM notification_prefs WHERE member_id=?;`,
+		`DELETE FROM payment_requests WHERE creditor_id=? OR debtor_id=?;`,
+		`DELETE FROM balance_reminders WHERE member_id=?;`,
+	}
+	for _, stmt := range stmts {
+		args := make([]interface{}, strings.Count(stmt, "?"))
+		for i := range args {
+			args[i] = lgt.userId
+		}
+		if _, err = trans.Exec(stmt, args...); err != nil {
+			lgt.err <- fmt.Errorf("exec delete recurring expenses query: %v", err)
+			return
+		}
+	}
+	if _, err = trans.Exec(`DELETE FROM users WHERE id=?;`, lgt.userId); err != nil {
 		lgt.err <- fmt.Errorf("exec delete user query: %v", err)
 		return
 	}
 
+	// Group must not stay without a leader
+	if isLeader {
+		if _, err = trans.Exec(`UPDATE users SET is_leader=1 WHERE id=(
+SELECT id FROM users WHERE group_id=? AND id>0 AND is_active=1 ORDER BY id LIMIT 1);`, groupId.Int64); err != nil {
+			lgt.err <- fmt.Errorf("exec promote leader query: %v", err)
+			return
+		}
+	}
+
 	if err := trans.Commit(); err != nil {
 		lgt.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
 		return
@@ -146,13 +328,66 @@ func (lgt *leaveGroupTask) Exec() {
 	lgt.err <- nil
 }
 
+// Moves debt of uid to the given members in equal parts and records it as a
+// transaction paid by uid
+func settleBalance(trans *sql.Tx, uid int, title string, debt float64, members []int64) error {
+	execRes, err := trans.Exec(`INSERT INTO transactions (id, title, ts, owner_id, amount) VALUES (NULL, ?, ?, ?, ?);`,
+		title, time.Now().UTC(), uid, math.Abs(debt))
+	if err != nil {
+		return fmt.Errorf("exec insert transaction query: %v", err)
+	}
+	trid, err := execRes.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("get last insert id: %v", err)
+	}
+	part := math.Abs(debt) / float64(len(members))
+	for _, m := range members {
+		src, dst := int64(uid), m
+		if debt < 0 {
+			src, dst = m, int64(uid)
+		}
+		if _, err = trans.Exec(`INSERT INTO operations (id, src, dst, amount, transaction_id) VALUES (NULL, ?, ?, ?, ?);`,
+			src, dst, part, trid); err != nil {
+			return fmt.Errorf("exec insert operation query: %v", err)
+		}
+	}
+	return nil
+}
+
+func nextPlaceholderId(trans *sql.Tx) (int64, error) {
+	var minId int64
+	if err := trans.QueryRow(`SELECT IFNULL(MIN(id), 0) FROM users`).Scan(&minId); err != nil {
+		return 0, fmt.Errorf("select min user id: %v", err)
+	}
+	if minId > 0 {
+		minId = 0
+	}
+	return minId - 1, nil
+}
+
+func nullIfEmpty(s string) interface{} {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
+
+func nullIfZero(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
 type payTask struct {
-	title    string
-	amount   float64
-	ts       time.Time
-	owner    int
-	members  map[int64]bool
-	transIdx chan int64
+	title      string
+	amount     float64
+	ts         time.Time
+	owner      int
+	categoryId int64             // zero leaves transaction uncategorized
+	shares     map[int64]float64 // weight of every participant in the amount
+	items      []receiptItem     // breakdown of itemised receipt, may be empty
+	transIdx   chan int64
 }
 
 func (pt *payTask) Exec() {
@@ -165,79 +400,167 @@ func (pt *payTask) Exec() {
 		pt.transIdx <- -1
 		return
 	}
+	defer trans.Rollback()
 
-	stmt, err := db.Prepare(`INSERT INTO transactions (id, title, ts, owner_id) VALUES (NULL, ?, ?, ?);`)
+	trid, err := insertTransaction(trans, pt.title, pt.amount, pt.ts, int64(pt.owner), pt.categoryId, pt.shares)
 	if err != nil {
-		logE.Printf(logPrefix+"prepare insert new transaction query: %v", err)
+		logE.Printf(logPrefix+"%v", err)
 		pt.transIdx <- -1
 		return
 	}
-
-	var execRes sql.Result
-	if execRes, err = stmt.Exec(pt.title, pt.ts, pt.owner); err != nil {
-		logE.Printf(logPrefix+"exec insert new transaction query: ", err)
+	if err = insertItems(trans, trid, pt.items); err != nil {
+		logE.Printf(logPrefix+"%v", err)
 		pt.transIdx <- -1
 		return
 	}
-
-	trid, err := execRes.LastInsertId()
-	if err != nil {
-		logE.Printf(logPrefix+"get last insert id: %v", err)
+	if err = insertPendingShares(trans, trid, int64(pt.owner), pt.shares, time.Now()); err != nil {
+		logE.Printf(logPrefix+"%v", err)
 		pt.transIdx <- -1
 		return
 	}
 
-	stmt, err = db.Prepare(`INSERT INTO operations (id, src, dst, amount, transaction_id) VALUES (NULL, ?, ?, ?, ?);`)
-	if err != nil {
-		logE.Printf(logPrefix+"prepare insert operations query: %v", err)
+	if err := trans.Commit(); err != nil {
+		logE.Printf(logPrefix+"commit sqlite-transaction: %v", err)
 		pt.transIdx <- -1
 		return
 	}
 
-	for m, _ := range pt.members {
-		if execRes, err = stmt.Exec(pt.owner, m, pt.amount/float64(len(pt.members)), trid); err != nil {
-			logE.Printf(logPrefix+"exec insert new transaction query: ", err)
-			pt.transIdx <- -1
-			return
-		}
+	pt.transIdx <- trid
+}
+
+// Inserts transaction paid by owner, amount is split between participants in
+// proportion to their weights. Timestamps are stored in UTC, so that they
+// compare as strings
+func insertTransaction(trans *sql.Tx, title string, amount float64, ts time.Time, owner, categoryId int64, shares map[int64]float64) (int64, error) {
+	execRes, err := trans.Exec(`INSERT INTO transactions (id, title, ts, owner_id, amount, category_id) VALUES (NULL, ?, ?, ?, ?, ?);`,
+		title, ts.UTC(), owner, amount, nullIfZero(categoryId))
+	if err != nil {
+		return 0, fmt.Errorf("exec insert new transaction query: %v", err)
+	}
+	trid, err := execRes.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("get last insert id: %v", err)
 	}
 
-	if err := trans.Commit(); err != nil {
-		logE.Printf(logPrefix+"commit sqlite-transaction: %v", err)
-		pt.transIdx <- -1
-		return
+	var totalShares float64
+	for _, share := range shares {
+		totalShares += share
 	}
+	for m, share := range shares {
+		if _, err = trans.Exec(`INSERT INTO operations (id, src, dst, amount, transaction_id) VALUES (NULL, ?, ?, ?, ?);`,
+			owner, m, amount*share/totalShares, trid); err != nil {
+			return 0, fmt.Errorf("exec insert operation query: %v", err)
+		}
+	}
+	return trid, nil
+}
 
-	pt.transIdx <- trid
+func insertItems(trans *sql.Tx, trid int64, items []receiptItem) error {
+	for _, item := range items {
+		execRes, err := trans.Exec(`INSERT INTO transaction_items (id, transaction_id, name, amount, extra) VALUES (NULL, ?, ?, ?, ?);`,
+			trid, item.name, item.amount, item.extra)
+		if err != nil {
+			return fmt.Errorf("exec insert item query: %v", err)
+		}
+		itemId, err := execRes.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("get last insert id: %v", err)
+		}
+		for _, uid := range item.members {
+			if _, err = trans.Exec(`INSERT INTO transaction_item_shares (item_id, member_id) VALUES (?, ?);`, itemId, uid); err != nil {
+				return fmt.Errorf("exec insert item share query: %v", err)
+			}
+		}
+	}
+	return nil
 }
 
 type giveTask struct {
 	amount    float64
 	src       int
 	dst       int
+	requestId int64 // payment request paid with the repayment, optional
+	pendingId int64 // repayment waiting for the recipient to confirm, set on success
 	succeeded chan bool
 }
 
+// Records repayment at once only for placeholders, who cannot confirm it;
+// others are asked whether they received the money
 func (gt *giveTask) Exec() {
 	log.Println(gt)
 	logPrefix := "exec give task: "
 
+	if !isPlaceholder(int64(gt.dst)) {
+		trans, err := db.Begin()
+		if err != nil {
+			logE.Printf(logPrefix+"create new sqlite-transaction: %v", err)
+			gt.succeeded <- false
+			return
+		}
+		defer trans.Rollback()
+
+		execRes, err := trans.Exec(`INSERT INTO repayments (id, src, dst, amount, state, created_ts) VALUES (NULL, ?, ?, ?, ?, ?);`,
+			gt.src, gt.dst, gt.amount, repaymentPending, time.Now().UTC())
+		if err != nil {
+			logE.Printf(logPrefix+"exec insert repayment query: %v", err)
+			gt.succeeded <- false
+			return
+		}
+		if gt.pendingId, err = execRes.LastInsertId(); err != nil {
+			logE.Printf(logPrefix+"get last insert id: %v", err)
+			gt.succeeded <- false
+			return
+		}
+		// Request is paid once, the repayment closes it when confirmed
+		if gt.requestId != 0 {
+			execRes, err = trans.Exec(`UPDATE payment_requests SET repayment_id=?
+WHERE id=? AND creditor_id=? AND debtor_id=? AND state=? AND repayment_id IS NULL;`,
+				gt.pendingId, gt.requestId, gt.dst, gt.src, requestOpen)
+			if err != nil {
+				logE.Printf(logPrefix+"exec update payment request query: %v", err)
+				gt.succeeded <- false
+				return
+			}
+			if affected, err := execRes.RowsAffected(); err != nil || affected == 0 {
+				logI.Printf(logPrefix+"payment request %d is not open", gt.requestId)
+				gt.succeeded <- false
+				return
+			}
+		}
+		if err := trans.Commit(); err != nil {
+			logE.Printf(logPrefix+"commit sqlite-transaction: %v", err)
+			gt.succeeded <- false
+			return
+		}
+		gt.succeeded <- true
+		return
+	}
+
 	trans, err := db.Begin()
 	if err != nil {
 		logE.Printf(logPrefix+"create new sqlite-transaction: %v", err)
 		gt.succeeded <- false
 		return
 	}
+	defer trans.Rollback()
 
-	stmt, err := db.Prepare(`INSERT INTO operations (id, src, dst, amount, transaction_id) VALUES (NULL, ?, ?, ?, NULL);`)
+	execRes, err := trans.Exec(`INSERT INTO operations (id, src, dst, amount, transaction_id) VALUES (NULL, ?, ?, ?, NULL);`,
+		gt.src, gt.dst, gt.amount)
 	if err != nil {
-		logE.Printf(logPrefix+"prepare insert operations query: %v", err)
+		logE.Printf(logPrefix+"exec insert new transaction query: %v", err)
 		gt.succeeded <- false
 		return
 	}
-
-	if _, err := stmt.Exec(gt.src, gt.dst, gt.amount); err != nil {
-		logE.Printf(logPrefix+"exec insert new transaction query: %v", err)
+	operationId, err := execRes.LastInsertId()
+	if err != nil {
+		logE.Printf(logPrefix+"get last insert id: %v", err)
+		gt.succeeded <- false
+		return
+	}
+	// Confirmed at once, the row keeps the date of the repayment
+	if _, err = trans.Exec(`INSERT INTO repayments (id, src, dst, amount, state, created_ts, operation_id) VALUES (NULL, ?, ?, ?, ?, ?, ?);`,
+		gt.src, gt.dst, gt.amount, repaymentConfirmed, time.Now().UTC(), operationId); err != nil {
+		logE.Printf(logPrefix+"exec insert repayment query: %v", err)
 		gt.succeeded <- false
 		return
 	}
@@ -254,115 +577,1262 @@ func (gt *giveTask) Exec() {
 type undoTask struct {
 	trid      int
 	ownerId   int
+	redo      bool // restores previously voided transaction
 	succeeded chan bool
 }
 
+// Voids transaction instead of removing it, so it stays in history and may
+// be restored with redo
 func (ut *undoTask) Exec() {
 	log.Println(ut)
 	logPrefix := "exec undo task: "
 
-	trans, err := db.Begin()
+	allowed, err := canModifyTransaction(int64(ut.trid), ut.ownerId)
 	if err != nil {
-		logE.Printf(logPrefix+"create new sqlite-transaction: %v", err)
+		logE.Printf(logPrefix+"check access to transaction %d: %v", ut.trid, err)
+		ut.succeeded <- false
+		return
+	}
+	if !allowed {
+		logI.Printf(logPrefix+"user %d is not allowed to undo transaction %d", ut.ownerId, ut.trid)
 		ut.succeeded <- false
 		return
 	}
 
-	stmt, err := db.Prepare(`DELETE FROM	operations WHERE transaction_id=?;`)
+	var execRes sql.Result
+	if ut.redo {
+		execRes, err = db.Exec(`UPDATE transactions SET voided_ts=NULL, voided_by=NULL WHERE id=? AND voided_ts IS NOT NULL;`, ut.trid)
+	} else {
+		execRes, err = db.Exec(`UPDATE transactions SET voided_ts=?, voided_by=? WHERE id=? AND voided_ts IS NULL;`, time.Now().UTC(), ut.ownerId, ut.trid)
+	}
 	if err != nil {
-		logE.Printf(logPrefix+"prepare delete operations query: %v", err)
+		logE.Printf(logPrefix+"exec void transaction query: %v", err)
 		ut.succeeded <- false
 		return
 	}
-
-	if _, err := stmt.Exec(ut.trid); err != nil {
-		logE.Printf(logPrefix+"exec delete operations query: %v", err)
+	if affected, err := execRes.RowsAffected(); err != nil || affected == 0 {
+		logI.Printf(logPrefix+"transaction %d is already in requested state", ut.trid)
 		ut.succeeded <- false
 		return
 	}
 
-	stmt, err = db.Prepare(`DELETE FROM	transactions WHERE id=? AND owner_id=?;`)
+	ut.succeeded <- true
+}
+
+type resetTask struct {
+	callerId int
+	err      chan error
+}
+
+// Removes transactions and repayments of caller's group keeping members and
+// settings
+func (rt *resetTask) Exec() {
+	trans, err := db.Begin()
 	if err != nil {
-		logE.Printf(logPrefix+"prepare delete transaction query: %v", err)
-		ut.succeeded <- false
+		rt.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
 		return
 	}
+	defer trans.Rollback()
 
-	if _, err := stmt.Exec(ut.trid, ut.ownerId); err != nil {
-		logE.Printf(logPrefix+"exec delete transaction query: %v", err)
-		ut.succeeded <- false
+	groupId, err := selectLedGroup(trans.QueryRow, rt.callerId)
+	if err != nil {
+		rt.err <- err
+		return
+	}
+	var resetPolicy string
+	if err = trans.QueryRow(`SELECT reset_policy FROM groups WHERE id=?`, groupId).Scan(&resetPolicy); err != nil {
+		rt.err <- fmt.Errorf("select reset policy: %v", err)
+		return
+	}
+	if resetPolicy != resetPolicyLeader {
+		rt.err <- &errorNotAllowed{}
+		return
+	}
+	if err = deleteGroupLedger(trans, groupId); err != nil {
+		rt.err <- err
 		return
 	}
 
 	if err := trans.Commit(); err != nil {
-		logE.Printf(logPrefix+"commit sqlite-transaction: %v", err)
-		ut.succeeded <- false
+		rt.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
 		return
 	}
 
-	ut.succeeded <- true
+	rt.err <- nil
 }
 
-type resetTask struct {
-	callerId int
-	err      chan error
+// Deletes transactions, repayments and everything attached to them in the
+// group
+func deleteGroupLedger(trans *sql.Tx, groupId int64) error {
+	groupUsers := `(SELECT id FROM users WHERE group_id=?)`
+	groupTransactions := `(SELECT id FROM transactions WHERE owner_id IN ` + groupUsers + `)`
+	stmts := []string{
+		`DELETE FROM operations WHERE src IN ` + groupUsers + ` OR dst IN ` + groupUsers + `
+OR transaction_id IN ` + groupTransactions + `;`,
+		`DELETE FROM transaction_item_shares WHERE item_id IN (SELECT id FROM transaction_items WHERE transaction_id IN ` + groupTransactions + `);`,
+		`DELETE FROM transaction_items WHERE transaction_id IN ` + groupTransactions + `;`,
+		`DELETE FROM share_confirmations WHERE transaction_id IN ` + groupTransactions + `;`,
+		`DELETE FROM transaction_revisions WHERE transaction_id IN ` + groupTransactions + `;`,
+		`DELETE FROM payment_requests WHERE creditor_id IN ` + groupUsers + ` OR debtor_id IN ` + groupUsers + `;`,
+		`DELETE FROM repayments WHERE src IN ` + groupUsers + ` OR dst IN ` + groupUsers + `;`,
+		`DELETE FROM transactions WHERE owner_id IN ` + groupUsers + `;`,
+	}
+	for _, stmt := range stmts {
+		args := make([]interface{}, strings.Count(stmt, "?"))
+		for i := range args {
+			args[i] = groupId
+		}
+		if _, err := trans.Exec(stmt, args...); err != nil {
+			return fmt.Errorf("exec delete ledger query: %v", err)
+		}
+	}
+	return nil
 }
 
-func (rt *resetTask) Exec() {
+type addPlaceholderTask struct {
+	ownerId   int
+	name      string
+	claimCode string
+	err       chan error
+}
+
+func (apt *addPlaceholderTask) Exec() {
 	trans, err := db.Begin()
 	if err != nil {
-		rt.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
+		apt.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
+		return
+	}
+	defer trans.Rollback()
+
+	var groupId sql.NullInt64
+	if err = trans.QueryRow(`SELECT group_id FROM users WHERE id=?`, apt.ownerId).Scan(&groupId); err != nil {
+		apt.err <- fmt.Errorf("select owner group: %v", err)
+		return
+	}
+	if !groupId.Valid {
+		apt.err <- &errorNotAllowed{}
 		return
 	}
 
-	rows, err := db.Query(`SELECT is_leader FROM users WHERE id=?`, rt.callerId)
+	placeholderId, err := nextPlaceholderId(trans)
 	if err != nil {
-		rt.err <- fmt.Errorf("select is_leader: %v", err)
+		apt.err <- err
 		return
 	}
-	if !rows.Next() {
-		rt.err <- fmt.Errorf("no user with id %d found", rt.callerId)
+
+	if _, err = trans.Exec(`INSERT INTO users (id, name, group_id, is_leader, claim_code) VALUES (?, ?, ?, 0, ?);`,
+		placeholderId, apt.name, groupId.Int64, apt.claimCode); err != nil {
+		apt.err <- fmt.Errorf("exec insert placeholder query: %v", err)
 		return
 	}
 
-	var isLeader bool
-	if err = rows.Scan(&isLeader); err != nil {
-		rt.err <- fmt.Errorf("scan is_leader: %v", err)
+	if err := trans.Commit(); err != nil {
+		apt.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
 		return
 	}
-	rows.Close()
+	apt.err <- nil
+}
 
-	if !isLeader {
-		rt.err <- &errorNotAllowed{}
+type claimPlaceholderTask struct {
+	userId    int
+	userName  string
+	claimCode string
+	err       chan error
+}
+
+func (cpt *claimPlaceholderTask) Exec() {
+	trans, err := db.Begin()
+	if err != nil {
+		cpt.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
 		return
 	}
+	defer trans.Rollback()
 
-	stmt, err := db.Prepare(`DELETE FROM operations;`)
+	var placeholderId, placeholderGroup int64
+	err = trans.QueryRow(`SELECT id, group_id FROM users WHERE id<0 AND claim_code=?`, cpt.claimCode).
+		Scan(&placeholderId, &placeholderGroup)
+	if err == sql.ErrNoRows {
+		cpt.err <- fmt.Errorf("no placeholder with claim code %q found", cpt.claimCode)
+		return
+	}
 	if err != nil {
-		rt.err <- fmt.Errorf("prepare truncate query: %v", err)
+		cpt.err <- fmt.Errorf("select placeholder: %v", err)
+		return
+	}
+
+	// The claiming user may either have no group yet or already belong to the
+	// placeholder's group; history is never moved across groups
+	var userGroup sql.NullInt64
+	err = trans.QueryRow(`SELECT group_id FROM users WHERE id=?`, cpt.userId).Scan(&userGroup)
+	if err != nil && err != sql.ErrNoRows {
+		cpt.err <- fmt.Errorf("select user group: %v", err)
+		return
+	}
+	if userGroup.Valid && userGroup.Int64 != placeholderGroup {
+		cpt.err <- &errorNotAllowed{}
+		return
+	}
+
+	stmts := []string{
+		`UPDATE operations SET src=? WHERE src=?;`,
+		`UPDATE operations SET dst=? WHERE dst=?;`,
+		`UPDATE transactions SET owner_id=? WHERE owner_id=?;`,
+		`UPDATE recurring_shares SET member_id=? WHERE member_id=?;`,
+		`UPDATE transaction_item_shares SET member_id=? WHERE member_id=?;`,
+		`UPDATE repayments SET src=? WHERE src=?;`,
+		`UPDATE repayments SET dst=? WHERE dst=?;`,
+	}
+	for _, stmt := range stmts {
+		if _, err = trans.Exec(stmt, cpt.userId, placeholderId); err != nil {
+			cpt.err <- fmt.Errorf("exec move placeholder history query: %v", err)
+			return
+		}
+	}
+
+	if _, err = trans.Exec(`DELETE FROM users WHERE id=?;`, placeholderId); err != nil {
+		cpt.err <- fmt.Errorf("exec delete placeholder query: %v", err)
+		return
+	}
+	if _, err = trans.Exec(`UPDATE users SET name=?, group_id=? WHERE id=?;`, cpt.userName, placeholderGroup, cpt.userId); err != nil {
+		cpt.err <- fmt.Errorf("exec update user group query: %v", err)
+		return
+	}
+	if _, err = trans.Exec(`INSERT OR IGNORE INTO users (id, name, group_id, is_leader) VALUES (?, ?, ?, 0);`,
+		cpt.userId, cpt.userName, placeholderGroup); err != nil {
+		cpt.err <- fmt.Errorf("exec insert user query: %v", err)
 		return
 	}
 
-	if _, err := stmt.Exec(); err != nil {
-		rt.err <- fmt.Errorf("exec truncate query: %v", err)
+	if err := trans.Commit(); err != nil {
+		cpt.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
+		return
+	}
+	rememberProfile(cpt.userId, "")
+	cpt.err <- nil
+}
+
+// Keeps stored names in sync with Telegram profiles; errors are only logged
+// since nobody waits for the result
+type refreshUserTask struct {
+	userId   int
+	userName string
+	username string
+	profile  string
+}
+
+func (rut *refreshUserTask) Exec() {
+	logPrefix := fmt.Sprintf("exec refresh user task %d: ", rut.userId)
+	if _, err := db.Exec(`UPDATE users SET name=?, username=? WHERE id=?;`, rut.userName, rut.username, rut.userId); err != nil {
+		logE.Printf(logPrefix+"exec update user name query: %v", err)
 		return
 	}
+	rememberProfile(rut.userId, rut.profile)
+}
+
+type setNicknameTask struct {
+	callerId int
+	memberId int64
+	nickname string
+	err      chan error
+}
 
-	stmt, err = db.Prepare(`DELETE FROM transactions;`)
+func (snt *setNicknameTask) Exec() {
+	trans, err := db.Begin()
 	if err != nil {
-		rt.err <- fmt.Errorf("prepare truncate query: %v", err)
+		snt.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
+		return
+	}
+	defer trans.Rollback()
+
+	var callerGroup, memberGroup sql.NullInt64
+	var isLeader bool
+	if err = trans.QueryRow(`SELECT group_id, is_leader FROM users WHERE id=?`, snt.callerId).Scan(&callerGroup, &isLeader); err != nil {
+		snt.err <- fmt.Errorf("select caller group: %v", err)
+		return
+	}
+	if err = trans.QueryRow(`SELECT group_id FROM users WHERE id=?`, snt.memberId).Scan(&memberGroup); err != nil {
+		snt.err <- fmt.Errorf("select member group: %v", err)
+		return
+	}
+
+	// Members may rename themselves and placeholders, leaders may rename anyone
+	sameGroup := callerGroup.Valid && memberGroup.Valid && callerGroup.Int64 == memberGroup.Int64
+	if !sameGroup || !(isLeader || snt.memberId == int64(snt.callerId) || isPlaceholder(snt.memberId)) {
+		snt.err <- &errorNotAllowed{}
 		return
 	}
 
-	if _, err := stmt.Exec(); err != nil {
-		rt.err <- fmt.Errorf("exec truncate query: %v", err)
+	if _, err = trans.Exec(`UPDATE users SET nickname=? WHERE id=?;`, nullIfEmpty(snt.nickname), snt.memberId); err != nil {
+		snt.err <- fmt.Errorf("exec update nickname query: %v", err)
 		return
 	}
 
 	if err := trans.Commit(); err != nil {
-		rt.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
+		snt.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
 		return
 	}
+	snt.err <- nil
+}
 
-	rt.err <- nil
+// Group columns which may be changed through /settings
+var settingColumns = map[string]bool{
+	"name":               true,
+	"currency":           true,
+	"timezone":           true,
+	"language":           true,
+	"date_format":        true,
+	"split_mode":         true,
+	"edit_policy":        true,
+	"reset_policy":       true,
+	"approval":           true,
+	"auto_accept_hours":  true,
+	"reminder_schedule":  true,
+	"reminder_threshold": true,
+	"quiet_hours":        true,
+	"summary_schedule":   true,
+	"summary_sections":   true,
+}
+
+type updateSettingTask struct {
+	callerId int
+	column   string
+	value    string
+	err      chan error
+}
+
+func (ust *updateSettingTask) Exec() {
+	if !settingColumns[ust.column] {
+		ust.err <- fmt.Errorf("unknown setting %q", ust.column)
+		return
+	}
+
+	var groupId sql.NullInt64
+	var isLeader bool
+	err := db.QueryRow(`SELECT group_id, is_leader FROM users WHERE id=?`, ust.callerId).Scan(&groupId, &isLeader)
+	if err != nil && err != sql.ErrNoRows {
+		ust.err <- fmt.Errorf("select caller group: %v", err)
+		return
+	}
+	if !groupId.Valid || !isLeader {
+		ust.err <- &errorNotAllowed{}
+		return
+	}
+
+	if _, err = db.Exec(fmt.Sprintf(`UPDATE groups SET %s=? WHERE id=?;`, ust.column), ust.value, groupId.Int64); err != nil {
+		ust.err <- fmt.Errorf("exec update %s query: %v", ust.column, err)
+		return
+	}
+	ust.err <- nil
+}
+
+type archiveGroupTask struct {
+	callerId int
+	err      chan error
+}
+
+func (agt *archiveGroupTask) Exec() {
+	var groupId sql.NullInt64
+	var isLeader bool
+	err := db.QueryRow(`SELECT group_id, is_leader FROM users WHERE id=?`, agt.callerId).Scan(&groupId, &isLeader)
+	if err != nil && err != sql.ErrNoRows {
+		agt.err <- fmt.Errorf("select caller group: %v", err)
+		return
+	}
+	if !groupId.Valid || !isLeader {
+		agt.err <- &errorNotAllowed{}
+		return
+	}
+
+	if _, err = db.Exec(`UPDATE groups SET archived_ts=? WHERE id=? AND archived_ts IS NULL;`, time.Now().UTC(), groupId.Int64); err != nil {
+		agt.err <- fmt.Errorf("exec archive group query: %v", err)
+		return
+	}
+	agt.err <- nil
+}
+
+type deleteGroupTask struct {
+	callerId int
+	members  []int64 // Telegram accounts of the removed group, set on success
+	err      chan error
+}
+
+// Removes the group with all its members, transactions and operations
+func (dgt *deleteGroupTask) Exec() {
+	trans, err := db.Begin()
+	if err != nil {
+		dgt.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
+		return
+	}
+	defer trans.Rollback()
+
+	var groupId sql.NullInt64
+	var isLeader bool
+	err = trans.QueryRow(`SELECT group_id, is_leader FROM users WHERE id=?`, dgt.callerId).Scan(&groupId, &isLeader)
+	if err != nil && err != sql.ErrNoRows {
+		dgt.err <- fmt.Errorf("select caller group: %v", err)
+		return
+	}
+	if !groupId.Valid || !isLeader {
+		dgt.err <- &errorNotAllowed{}
+		return
+	}
+
+	rows, err := trans.Query(`SELECT id FROM users WHERE group_id=? AND id>0`, groupId.Int64)
+	if err != nil {
+		dgt.err <- fmt.Errorf("select group members: %v", err)
+		return
+	}
+	for rows.Next() {
+		var uid int64
+		if err = rows.Scan(&uid); err != nil {
+			break
+		}
+		dgt.members = append(dgt.members, uid)
+	}
+	rows.Close()
+	if err != nil {
+		dgt.err <- fmt.Errorf("scan group members: %v", err)
+		return
+	}
+
+	if err = deleteGroupLedger(trans, groupId.Int64); err != nil {
+		dgt.err <- err
+		return
+	}
+
+	groupUsers := `(SELECT id FROM users WHERE group_id=?)`
+	stmts := []string{
+		`DELETE FROM recurring_shares WHERE recurring_id IN (SELECT id FROM recurring WHERE owner_id IN ` + groupUsers + `);`,
+		`DELETE FROM recurring WHERE owner_id IN ` + groupUsers + `;`,
+		`DELETE FROM budgets WHERE group_id=?;`,
+		`DELETE FROM categories WHERE group_id=?;`,
+		`DELETE FROM queued_notifications WHERE group_id=?;`,
+		`DELETE FROM notification_prefs WHERE group_id=?;`,
+		`DELETE FROM balance_reminders WHERE group_id=?;`,
+		`DELETE FROM users WHERE group_id=?;`,
+		`DELETE FROM groups WHERE id=?;`,
+	}
+	for _, stmt := range stmts {
+		args := make([]interface{}, strings.Count(stmt, "?"))
+		for i := range args {
+			args[i] = groupId.Int64
+		}
+		if _, err = trans.Exec(stmt, args...); err != nil {
+			dgt.err <- fmt.Errorf("exec delete group query: %v", err)
+			return
+		}
+	}
+
+	if err := trans.Commit(); err != nil {
+		dgt.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
+		return
+	}
+	dgt.err <- nil
+}
+
+type editTask struct {
+	trid     int64
+	callerId int
+	title    string
+	amount   float64
+	ts       time.Time
+	owner    int64
+	shares   map[int64]float64 // weights of new participants; nil keeps the current split
+	affected []int64           // members whose balance changed, set on success
+	err      chan error
+}
+
+// Replaces transaction contents keeping its id; previous version goes to
+// transaction_revisions
+func (et *editTask) Exec() {
+	allowed, err := canModifyTransaction(et.trid, et.callerId)
+	if err != nil {
+		et.err <- fmt.Errorf("check access: %v", err)
+		return
+	}
+	if !allowed {
+		et.err <- &errorNotAllowed{}
+		return
+	}
+
+	prev, err := selectTransaction(et.trid)
+	if err != nil || prev == nil {
+		et.err <- fmt.Errorf("select transaction: %v", err)
+		return
+	}
+
+	// Payer and participants must be active members of the same group
+	groupMembers, err := selectGroupMembers(et.callerId)
+	if err != nil {
+		et.err <- fmt.Errorf("select group members: %v", err)
+		return
+	}
+	if _, ok := groupMembers[et.owner]; !ok && et.owner != prev.owner {
+		et.err <- &errorNotAllowed{}
+		return
+	}
+	for uid := range et.shares {
+		if _, ok := groupMembers[uid]; !ok {
+			et.err <- &errorNotAllowed{}
+			return
+		}
+	}
+
+	trans, err := db.Begin()
+	if err != nil {
+		et.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
+		return
+	}
+	defer trans.Rollback()
+
+	var prevOps []string
+	for dst, amount := range prev.shares {
+		prevOps = append(prevOps, fmt.Sprintf("%d:%.2f", dst, amount))
+	}
+	if _, err = trans.Exec(`INSERT INTO transaction_revisions
+(id, transaction_id, title, amount, ts, owner_id, operations, edited_by, edited_ts)
+VALUES (NULL, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		prev.id, prev.title, prev.amount, prev.time.UTC(), prev.owner, strings.Join(prevOps, ","), et.callerId, time.Now().UTC()); err != nil {
+		et.err <- fmt.Errorf("exec insert revision query: %v", err)
+		return
+	}
+
+	if _, err = trans.Exec(`UPDATE transactions SET title=?, amount=?, ts=?, owner_id=? WHERE id=?;`,
+		et.title, et.amount, et.ts.UTC(), et.owner, et.trid); err != nil {
+		et.err <- fmt.Errorf("exec update transaction query: %v", err)
+		return
+	}
+
+	shares := et.shares
+	if shares == nil {
+		shares = prev.shares
+	}
+	var totalShares float64
+	for _, share := range shares {
+		totalShares += share
+	}
+	if _, err = trans.Exec(`DELETE FROM operations WHERE transaction_id=?;`, et.trid); err != nil {
+		et.err <- fmt.Errorf("exec delete operations query: %v", err)
+		return
+	}
+
+	// Item breakdown no longer adds up once amount or split is changed
+	if et.shares != nil || et.amount != prev.amount {
+		stmts := []string{
+			`DELETE FROM transaction_item_shares WHERE item_id IN (SELECT id FROM transaction_items WHERE transaction_id=?);`,
+			`DELETE FROM transaction_items WHERE transaction_id=?;`,
+		}
+		for _, stmt := range stmts {
+			if _, err = trans.Exec(stmt, et.trid); err != nil {
+				et.err <- fmt.Errorf("exec delete items query: %v", err)
+				return
+			}
+		}
+	}
+	for m, share := range shares {
+		if _, err = trans.Exec(`INSERT INTO operations (id, src, dst, amount, transaction_id) VALUES (NULL, ?, ?, ?, ?);`,
+			et.owner, m, et.amount*share/totalShares, et.trid); err != nil {
+			et.err <- fmt.Errorf("exec insert operation query: %v", err)
+			return
+		}
+	}
+
+	// Participants confirm the changed split again
+	if et.shares != nil || et.amount != prev.amount || et.owner != prev.owner {
+		if _, err = trans.Exec(`DELETE FROM share_confirmations WHERE transaction_id=?;`, et.trid); err != nil {
+			et.err <- fmt.Errorf("exec delete confirmations query: %v", err)
+			return
+		}
+		if err = insertPendingShares(trans, et.trid, et.owner, shares, time.Now()); err != nil {
+			et.err <- err
+			return
+		}
+	}
+
+	if err := trans.Commit(); err != nil {
+		et.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
+		return
+	}
+
+	affected := map[int64]bool{prev.owner: true, et.owner: true}
+	for uid := range prev.shares {
+		affected[uid] = true
+	}
+	for uid := range shares {
+		affected[uid] = true
+	}
+	for uid := range affected {
+		et.affected = append(et.affected, uid)
+	}
+	et.err <- nil
+}
+
+// Returns group of the caller if caller leads it and the group is not archived
+func selectLedGroup(query func(string, ...interface{}) *sql.Row, callerId int) (int64, error) {
+	var groupId sql.NullInt64
+	var isLeader, archived bool
+	err := query(`SELECT U.group_id, U.is_leader, G.archived_ts IS NOT NULL FROM users U, groups G
+WHERE U.id=? AND G.id=U.group_id`, callerId).Scan(&groupId, &isLeader, &archived)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("select caller group: %v", err)
+	}
+	if !groupId.Valid || !isLeader || archived {
+		return 0, &errorNotAllowed{}
+	}
+	return groupId.Int64, nil
+}
+
+type addCategoryTask struct {
+	callerId int
+	name     string
+	err      chan error
+}
+
+func (act *addCategoryTask) Exec() {
+	groupId, err := selectLedGroup(db.QueryRow, act.callerId)
+	if err != nil {
+		act.err <- err
+		return
+	}
+	if _, err = db.Exec(`INSERT INTO categories (group_id, name) VALUES (?, ?);`, groupId, act.name); err != nil {
+		act.err <- fmt.Errorf("exec insert category query: %v", err)
+		return
+	}
+	act.err <- nil
+}
+
+type renameCategoryTask struct {
+	callerId   int
+	categoryId int64
+	name       string
+	err        chan error
+}
+
+func (rct *renameCategoryTask) Exec() {
+	groupId, err := selectLedGroup(db.QueryRow, rct.callerId)
+	if err != nil {
+		rct.err <- err
+		return
+	}
+	if _, err = db.Exec(`UPDATE categories SET name=? WHERE id=? AND group_id=?;`, rct.name, rct.categoryId, groupId); err != nil {
+		rct.err <- fmt.Errorf("exec rename category query: %v", err)
+		return
+	}
+	rct.err <- nil
+}
+
+type deleteCategoryTask struct {
+	callerId   int
+	categoryId int64
+	err        chan error
+}
+
+// Removes category along with its budgets, its transactions become
+// uncategorized
+func (dct *deleteCategoryTask) Exec() {
+	trans, err := db.Begin()
+	if err != nil {
+		dct.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
+		return
+	}
+	defer trans.Rollback()
+
+	groupId, err := selectLedGroup(trans.QueryRow, dct.callerId)
+	if err != nil {
+		dct.err <- err
+		return
+	}
+	res, err := trans.Exec(`DELETE FROM categories WHERE id=? AND group_id=?;`, dct.categoryId, groupId)
+	if err != nil {
+		dct.err <- fmt.Errorf("exec delete category query: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		dct.err <- &errorNotAllowed{}
+		return
+	}
+	if _, err = trans.Exec(`UPDATE transactions SET category_id=NULL WHERE category_id=?;`, dct.categoryId); err != nil {
+		dct.err <- fmt.Errorf("exec uncategorize transactions query: %v", err)
+		return
+	}
+	if _, err = trans.Exec(`DELETE FROM budgets WHERE category_id=?;`, dct.categoryId); err != nil {
+		dct.err <- fmt.Errorf("exec delete category budgets query: %v", err)
+		return
+	}
+
+	if err := trans.Commit(); err != nil {
+		dct.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
+		return
+	}
+	dct.err <- nil
+}
+
+type addRecurringTask struct {
+	callerId int
+	expense  *recurringExpense // id is set on success
+	err      chan error
+}
+
+func (art *addRecurringTask) Exec() {
+	settings, err := getUserSettings(art.callerId)
+	if err != nil {
+		art.err <- err
+		return
+	}
+	groupMembers, err := selectGroupMembers(art.callerId)
+	if err != nil {
+		art.err <- fmt.Errorf("select group members: %v", err)
+		return
+	}
+	if settings.archived || art.expense.owner != int64(art.callerId) {
+		art.err <- &errorNotAllowed{}
+		return
+	}
+	for uid := range art.expense.shares {
+		if _, ok := groupMembers[uid]; !ok {
+			art.err <- &errorNotAllowed{}
+			return
+		}
+	}
+
+	trans, err := db.Begin()
+	if err != nil {
+		art.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
+		return
+	}
+	defer trans.Rollback()
+
+	re := art.expense
+	execRes, err := trans.Exec(`INSERT INTO recurring
+(id, owner_id, title, amount, category_id, schedule, schedule_day, schedule_month, next_ts)
+VALUES (NULL, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		re.owner, re.title, re.amount, nullIfZero(re.categoryId), re.schedule, re.day, re.month, re.next.UTC())
+	if err != nil {
+		art.err <- fmt.Errorf("exec insert recurring expense query: %v", err)
+		return
+	}
+	id, err := execRes.LastInsertId()
+	if err != nil {
+		art.err <- fmt.Errorf("get last insert id: %v", err)
+		return
+	}
+	for uid, weight := range re.shares {
+		if _, err = trans.Exec(`INSERT INTO recurring_shares (recurring_id, member_id, weight) VALUES (?, ?, ?);`, id, uid, weight); err != nil {
+			art.err <- fmt.Errorf("exec insert recurring share query: %v", err)
+			return
+		}
+	}
+
+	if err := trans.Commit(); err != nil {
+		art.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
+		return
+	}
+	re.id = id
+	art.err <- nil
+}
+
+const (
+	recurringSkip = iota
+	recurringSetAmount
+	recurringDelete
+)
+
+type changeRecurringTask struct {
+	callerId int
+	id       int64
+	action   int
+	amount   float64 // amount of the next occurrence for recurringSetAmount
+	err      chan error
+}
+
+// Changes the next occurrence of a recurring expense or removes it; allowed to
+// its payer and group leader
+func (crt *changeRecurringTask) Exec() {
+	re, err := selectRecurring(crt.id)
+	if err != nil || re == nil {
+		crt.err <- fmt.Errorf("select recurring expense: %v", err)
+		return
+	}
+
+	var callerIsLeader, sameGroup bool
+	err = db.QueryRow(`SELECT C.is_leader, C.group_id=O.group_id FROM users C, users O WHERE C.id=? AND O.id=?`,
+		crt.callerId, re.owner).Scan(&callerIsLeader, &sameGroup)
+	if err != nil && err != sql.ErrNoRows {
+		crt.err <- fmt.Errorf("select caller group: %v", err)
+		return
+	}
+	settings, err := getUserSettings(crt.callerId)
+	if err != nil {
+		crt.err <- err
+		return
+	}
+	if !sameGroup || settings.archived || re.owner != int64(crt.callerId) && !callerIsLeader {
+		crt.err <- &errorNotAllowed{}
+		return
+	}
+
+	switch crt.action {
+	case recurringSkip:
+		_, err = db.Exec(`UPDATE recurring SET next_ts=?, next_amount=NULL WHERE id=?;`, re.nextAfter(re.next, settings.location()).UTC(), re.id)
+	case recurringSetAmount:
+		_, err = db.Exec(`UPDATE recurring SET next_amount=? WHERE id=?;`, crt.amount, re.id)
+	case recurringDelete:
+		if _, err = db.Exec(`DELETE FROM recurring_shares WHERE recurring_id=?;`, re.id); err == nil {
+			_, err = db.Exec(`DELETE FROM recurring WHERE id=?;`, re.id)
+		}
+	default:
+		err = fmt.Errorf("unknown action %d", crt.action)
+	}
+	if err != nil {
+		crt.err <- fmt.Errorf("exec change recurring expense query: %v", err)
+		return
+	}
+	crt.err <- nil
+}
+
+type runRecurringTask struct {
+	id      int64
+	now     time.Time
+	created []int64 // transactions created for due occurrences, set on success
+	err     chan error
+}
+
+// Creates a transaction for every occurrence due by now and moves the
+// schedule past it; nothing is charged in archived groups or to members who
+// are gone
+func (rrt *runRecurringTask) Exec() {
+	re, err := selectRecurring(rrt.id)
+	if err != nil || re == nil {
+		rrt.err <- fmt.Errorf("select recurring expense: %v", err)
+		return
+	}
+	settings, err := getUserSettings(int(re.owner))
+	if err != nil {
+		rrt.err <- err
+		return
+	}
+	groupMembers, err := selectGroupMembers(int(re.owner))
+	if err != nil {
+		rrt.err <- fmt.Errorf("select group members: %v", err)
+		return
+	}
+	shares := make(map[int64]float64)
+	for uid, weight := range re.shares {
+		if _, ok := groupMembers[uid]; ok {
+			shares[uid] = weight
+		}
+	}
+	_, ownerActive := groupMembers[re.owner]
+	charge := ownerActive && !settings.archived && len(shares) > 0
+
+	trans, err := db.Begin()
+	if err != nil {
+		rrt.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
+		return
+	}
+	defer trans.Rollback()
+
+	var created []int64
+	amount := re.amount
+	if re.nextAmount != 0 {
+		amount = re.nextAmount
+	}
+	next := re.next
+	for ; !next.After(rrt.now); next = re.nextAfter(next, settings.location()) {
+		if !charge {
+			continue
+		}
+		trid, err := insertTransaction(trans, re.title, amount, next, re.owner, re.categoryId, shares)
+		if err != nil {
+			rrt.err <- err
+			return
+		}
+		if err = insertPendingShares(trans, trid, re.owner, shares, rrt.now); err != nil {
+			rrt.err <- err
+			return
+		}
+		created = append(created, trid)
+		amount = re.amount
+	}
+	if _, err = trans.Exec(`UPDATE recurring SET next_ts=?, next_amount=NULL WHERE id=?;`, next.UTC(), re.id); err != nil {
+		rrt.err <- fmt.Errorf("exec advance recurring expense query: %v", err)
+		return
+	}
+
+	if err := trans.Commit(); err != nil {
+		rrt.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
+		return
+	}
+	rrt.created = created
+	rrt.err <- nil
+}
+
+type attachReceiptTask struct {
+	callerId int
+	trid     int64
+	fileId   string
+	path     string // local copy, may be empty
+	err      chan error
+}
+
+func (art *attachReceiptTask) Exec() {
+	allowed, err := canModifyTransaction(art.trid, art.callerId)
+	if err != nil {
+		art.err <- fmt.Errorf("check access: %v", err)
+		return
+	}
+	if !allowed {
+		art.err <- &errorNotAllowed{}
+		return
+	}
+	if _, err = db.Exec(`UPDATE transactions SET receipt_file_id=?, receipt_path=? WHERE id=?;`,
+		art.fileId, nullIfEmpty(art.path), art.trid); err != nil {
+		art.err <- fmt.Errorf("exec attach receipt query: %v", err)
+		return
+	}
+	art.err <- nil
+}
+
+type setNotifyModeTask struct {
+	userId  int
+	groupId int
+	mode    string
+	err     chan error
+}
+
+func (snt *setNotifyModeTask) Exec() {
+	if _, err := db.Exec(`INSERT OR REPLACE INTO notification_prefs (member_id, group_id, mode) VALUES (?, ?, ?);`,
+		snt.userId, snt.groupId, snt.mode); err != nil {
+		snt.err <- fmt.Errorf("exec set notification mode query: %v", err)
+		return
+	}
+	snt.err <- nil
+}
+
+type queueNotificationTask struct {
+	userId  int64
+	groupId int
+	text    string
+	ts      time.Time
+	err     chan error
+}
+
+func (qnt *queueNotificationTask) Exec() {
+	if _, err := db.Exec(`INSERT INTO queued_notifications (member_id, group_id, text, created_ts) VALUES (?, ?, ?, ?);`,
+		qnt.userId, qnt.groupId, qnt.text, qnt.ts.UTC()); err != nil {
+		qnt.err <- fmt.Errorf("exec queue notification query: %v", err)
+		return
+	}
+	qnt.err <- nil
+}
+
+// Drops notices sent in a digest, the ones queued meanwhile stay
+type flushNotificationsTask struct {
+	userId  int64
+	groupId int
+	lastId  int64
+	err     chan error
+}
+
+func (fnt *flushNotificationsTask) Exec() {
+	if _, err := db.Exec(`DELETE FROM queued_notifications WHERE member_id=? AND group_id=? AND id<=?;`,
+		fnt.userId, fnt.groupId, fnt.lastId); err != nil {
+		fnt.err <- fmt.Errorf("exec flush notifications query: %v", err)
+		return
+	}
+	fnt.err <- nil
+}
+
+// Records participant's answer about their share: disputed or automatically
+// accepted shares must be pending, a disputed share may still be accepted
+type answerShareTask struct {
+	trid     int64
+	memberId int64
+	state    string
+	comment  string
+	auto     bool
+	err      chan error
+}
+
+func (ast *answerShareTask) Exec() {
+	from := `state!='accepted'`
+	if ast.state != shareAccepted || ast.auto {
+		from = `state='pending'`
+	}
+	res, err := db.Exec(`UPDATE share_confirmations SET state=?, comment=? WHERE transaction_id=? AND member_id=? AND `+from+`;`,
+		ast.state, nullIfEmpty(ast.comment), ast.trid, ast.memberId)
+	if err != nil {
+		ast.err <- fmt.Errorf("exec answer share query: %v", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		ast.err <- &errorNotAllowed{}
+		return
+	}
+	ast.err <- nil
+}
+
+// Recipient confirms or rejects a pending repayment; confirmed one becomes an
+// operation and changes balances
+type answerRepaymentTask struct {
+	id        int64
+	callerId  int
+	confirmed bool
+	requestId int64 // payment request reopened by rejection, set on success
+	err       chan error
+}
+
+func (art *answerRepaymentTask) Exec() {
+	trans, err := db.Begin()
+	if err != nil {
+		art.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
+		return
+	}
+	defer trans.Rollback()
+
+	var src, dst int64
+	var amount float64
+	err = trans.QueryRow(`SELECT src, dst, amount FROM repayments WHERE id=? AND dst=? AND state=?`,
+		art.id, art.callerId, repaymentPending).Scan(&src, &dst, &amount)
+	if err == sql.ErrNoRows {
+		art.err <- &errorNotAllowed{}
+		return
+	}
+	if err != nil {
+		art.err <- fmt.Errorf("select pending repayment: %v", err)
+		return
+	}
+
+	state := repaymentRejected
+	var operationId sql.NullInt64
+	if art.confirmed {
+		state = repaymentConfirmed
+		execRes, err := trans.Exec(`INSERT INTO operations (id, src, dst, amount, transaction_id) VALUES (NULL, ?, ?, ?, NULL);`,
+			src, dst, amount)
+		if err != nil {
+			art.err <- fmt.Errorf("exec insert operation query: %v", err)
+			return
+		}
+		if operationId.Int64, err = execRes.LastInsertId(); err != nil {
+			art.err <- fmt.Errorf("get last insert id: %v", err)
+			return
+		}
+		operationId.Valid = true
+	}
+	if _, err = trans.Exec(`UPDATE repayments SET state=?, operation_id=? WHERE id=?;`, state, operationId, art.id); err != nil {
+		art.err <- fmt.Errorf("exec update repayment query: %v", err)
+		return
+	}
+
+	// Payment request stays open until its repayment is confirmed
+	if art.confirmed {
+		_, err = trans.Exec(`UPDATE payment_requests SET state=? WHERE repayment_id=?;`, requestPaid, art.id)
+	} else {
+		err = trans.QueryRow(`SELECT id FROM payment_requests WHERE repayment_id=?`, art.id).Scan(&art.requestId)
+		if err == sql.ErrNoRows {
+			err = nil
+		} else if err == nil {
+			_, err = trans.Exec(`UPDATE payment_requests SET repayment_id=NULL WHERE id=?;`, art.requestId)
+		}
+	}
+	if err != nil {
+		art.err <- fmt.Errorf("exec update payment request query: %v", err)
+		return
+	}
+
+	if err := trans.Commit(); err != nil {
+		art.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
+		return
+	}
+	art.err <- nil
+}
+
+type markRepaymentRemindedTask struct {
+	id  int64
+	ts  time.Time
+	err chan error
+}
+
+func (mrt *markRepaymentRemindedTask) Exec() {
+	if _, err := db.Exec(`UPDATE repayments SET reminded_ts=? WHERE id=?;`, mrt.ts.UTC(), mrt.id); err != nil {
+		mrt.err <- fmt.Errorf("exec mark repayment reminded query: %v", err)
+		return
+	}
+	mrt.err <- nil
+}
+
+// Opens payment request replacing earlier open ones of the creditor to the
+// same debtor
+type requestPaymentTask struct {
+	creditor int
+	debtor   int
+	amount   float64
+	id       int64 // set on success
+	err      chan error
+}
+
+func (rpt *requestPaymentTask) Exec() {
+	trans, err := db.Begin()
+	if err != nil {
+		rpt.err <- fmt.Errorf("create new sqlite-transaction: %v", err)
+		return
+	}
+	defer trans.Rollback()
+
+	if _, err = trans.Exec(`UPDATE payment_requests SET state=? WHERE creditor_id=? AND debtor_id=? AND state=? AND repayment_id IS NULL;`,
+		requestCancelled, rpt.creditor, rpt.debtor, requestOpen); err != nil {
+		rpt.err <- fmt.Errorf("exec cancel payment requests query: %v", err)
+		return
+	}
+	execRes, err := trans.Exec(`INSERT INTO payment_requests (id, creditor_id, debtor_id, amount, state, created_ts) VALUES (NULL, ?, ?, ?, ?, ?);`,
+		rpt.creditor, rpt.debtor, rpt.amount, requestOpen, time.Now().UTC())
+	if err != nil {
+		rpt.err <- fmt.Errorf("exec insert payment request query: %v", err)
+		return
+	}
+	if rpt.id, err = execRes.LastInsertId(); err != nil {
+		rpt.err <- fmt.Errorf("get last insert id: %v", err)
+		return
+	}
+
+	if err := trans.Commit(); err != nil {
+		rpt.err <- fmt.Errorf("commit sqlite-transaction: %v", err)
+		return
+	}
+	rpt.err <- nil
+}
+
+// Closes open requests of the creditor to the debtor who paid off the debt
+// otherwise
+type closePaymentRequestsTask struct {
+	creditor int64
+	debtor   int64
+	err      chan error
+}
+
+func (cpt *closePaymentRequestsTask) Exec() {
+	if _, err := db.Exec(`UPDATE payment_requests SET state=? WHERE creditor_id=? AND debtor_id=? AND state=? AND repayment_id IS NULL;`,
+		requestPaid, cpt.creditor, cpt.debtor, requestOpen); err != nil {
+		cpt.err <- fmt.Errorf("exec close payment requests query: %v", err)
+		return
+	}
+	cpt.err <- nil
+}
+
+// Records scheduled balance check of the member and ends their snooze
+type markBalanceCheckedTask struct {
+	memberId int64
+	groupId  int
+	ts       time.Time
+	err      chan error
+}
+
+func (mct *markBalanceCheckedTask) Exec() {
+	if _, err := db.Exec(`INSERT OR REPLACE INTO balance_reminders (member_id, group_id, checked_ts, snoozed_until) VALUES (?, ?, ?, NULL);`,
+		mct.memberId, mct.groupId, mct.ts.UTC()); err != nil {
+		mct.err <- fmt.Errorf("exec mark balance checked query: %v", err)
+		return
+	}
+	mct.err <- nil
+}
+
+type snoozeReminderTask struct {
+	memberId int64
+	groupId  int
+	until    time.Time
+	err      chan error
+}
+
+func (srt *snoozeReminderTask) Exec() {
+	if _, err := db.Exec(`INSERT INTO balance_reminders (member_id, group_id, snoozed_until) VALUES (?, ?, ?)
+ON CONFLICT (member_id, group_id) DO UPDATE SET snoozed_until=excluded.snoozed_until;`,
+		srt.memberId, srt.groupId, srt.until.UTC()); err != nil {
+		srt.err <- fmt.Errorf("exec snooze reminder query: %v", err)
+		return
+	}
+	srt.err <- nil
+}
+
+type addBudgetTask struct {
+	callerId int
+	budget   *budget
+	err      chan error
+}
+
+func (abt *addBudgetTask) Exec() {
+	groupId, err := selectLedGroup(db.QueryRow, abt.callerId)
+	if err != nil {
+		abt.err <- err
+		return
+	}
+	var from, to interface{}
+	if abt.budget.from.Valid {
+		from, to = abt.budget.from.Time.UTC(), abt.budget.to.Time.UTC()
+	}
+	if _, err = db.Exec(`INSERT INTO budgets (group_id, category_id, amount, period, from_ts, to_ts) VALUES (?, ?, ?, ?, ?, ?);`,
+		groupId, nullIfZero(abt.budget.categoryId), abt.budget.amount, abt.budget.period, from, to); err != nil {
+		abt.err <- fmt.Errorf("exec insert budget query: %v", err)
+		return
+	}
+	abt.err <- nil
+}
+
+type deleteBudgetTask struct {
+	callerId int
+	budgetId int64
+	err      chan error
+}
+
+func (dbt *deleteBudgetTask) Exec() {
+	groupId, err := selectLedGroup(db.QueryRow, dbt.callerId)
+	if err != nil {
+		dbt.err <- err
+		return
+	}
+	if _, err = db.Exec(`DELETE FROM budgets WHERE id=? AND group_id=?;`, dbt.budgetId, groupId); err != nil {
+		dbt.err <- fmt.Errorf("exec delete budget query: %v", err)
+		return
+	}
+	dbt.err <- nil
+}
+
+// Records alert level reached in the budget period unless it was announced
+// already
+type markBudgetAlertTask struct {
+	id     int64
+	period time.Time // start of the budget period
+	level  int
+	marked bool // set when the level was not announced before
+	err    chan error
+}
+
+func (mbt *markBudgetAlertTask) Exec() {
+	res, err := db.Exec(`UPDATE budgets SET alert_level=?, alert_period_ts=?
+WHERE id=? AND (alert_period_ts IS NULL OR alert_period_ts!=? OR alert_level<?);`,
+		mbt.level, mbt.period.UTC(), mbt.id, mbt.period.UTC(), mbt.level)
+	if err != nil {
+		mbt.err <- fmt.Errorf("exec mark budget alert query: %v", err)
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		mbt.err <- fmt.Errorf("get affected rows: %v", err)
+		return
+	}
+	mbt.marked = affected != 0
+	mbt.err <- nil
+}
+
+type markSummarySentTask struct {
+	groupId int
+	period  time.Time // end of the summarized period
+	err     chan error
+}
+
+func (mst *markSummarySentTask) Exec() {
+	if _, err := db.Exec(`UPDATE groups SET summary_sent_ts=? WHERE id=?;`, mst.period.UTC(), mst.groupId); err != nil {
+		mst.err <- fmt.Errorf("exec mark summary sent query: %v", err)
+		return
+	}
+	mst.err <- nil
 }